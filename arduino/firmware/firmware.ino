@@ -23,11 +23,23 @@ const char *TIME_SERVER = "10.0.0.1"; //NTP Server
 
 // --- Sleep Parameters ---
 #define uS_TO_S_FACTOR 1000000ULL // Conversion factor for micro seconds to seconds
-#define TIME_TO_SLEEP 120         // Sleep time in seconds (adjust as needed)
+#define TIME_TO_SLEEP 120         // Sleep time in seconds when the server does not send next_wake_seconds
+
+#define PAIRING_POLL_INTERVAL 30  // Seconds between registration attempts while waiting for pairing approval
+
+// --- Download Parameters ---
+#define DOWNLOAD_ATTEMPTS 5          // Number of attempts before giving up on an image
+#define DOWNLOAD_STALL_TIMEOUT 10000 // Abort a transfer after this many ms without data
+
+// --- Battery Parameters ---
+#define BATTERY_DIVIDER 2.0 // Ratio of the voltage divider in front of the ADC pin
+#define BATTERY_EMPTY_V 3.3 // Voltage reported as 0%
+#define BATTERY_FULL_V 4.2  // Voltage reported as 100%
 
 // Device specific settings
 const int TOUCH_PIN = 2; // Replace with the actual touch pin number
 const int TOUCH_THRESHOLD = 40;
+const int BATTERY_PIN = 1; // ADC pin measuring the battery through the divider
 // Custom E-ink Adapter Board
 const int SDI = 4;
 const int CLK = 5;
@@ -39,26 +51,39 @@ const int BUSY_PIN = 16;
 const int SDO = 17; // NC
 
 String bearer_token = "";
+bool pairing_pending = false;
+uint64_t sleep_seconds = TIME_TO_SLEEP; // Set from next_wake_seconds in image responses
+bool running_commands = false;           // Commands are not run again from their own image updates
+String wake_reason = "power_on";         // Reported with the telemetry
+int download_failures = -1;              // Failed plane downloads in a row, -1 if nothing was downloaded this wake
 
 GxEPD2_7C<GxEPD2_730c_GDEY073D46, GxEPD2_730c_GDEY073D46::HEIGHT / 4> display(GxEPD2_730c_GDEY073D46(/*CS=5*/ CS, /*DC=*/DC, /*RST=*/RES, /*BUSY=*/BUSY_PIN)); // GDEY073D46 800x480 7-color, (N-FPC-001 2021.11.26)
 SPIClass hspi(HSPI);
 
-bool updateImage();
+bool updateImage(String trigger = "touch", uint32_t command_id = 0);
 void drawFull(uint8_t *downloadedImages[]);
 void setClock();
 bool connectToWiFi();
 String getMacAddress();
 bool register_device();
+void clear_token();
+void show_pairing_code(String code);
+void clear_display();
+void clear_etags();
+void goToSleepFor(uint64_t seconds);
+void report_telemetry();
 bool download_and_display(JsonArray images);
 void start_up();
 
 // Forward declarations for JSON helper functions
 bool parseJsonResponse(String response, JsonDocument &doc);
+void readNextWake(JsonDocument &doc);
+void handleCommands(JsonDocument &doc);
 
 // HTTP helper functions
 String httpsPOST(String url, String jsonPayload, String auth = "");
 String httpsGET(String url, String auth = "");
-uint8_t *downloadImage(String download_url);
+uint8_t *downloadImage(String download_url, String &etag, bool &not_modified);
 
 void enableOutput()
 {
@@ -79,11 +104,13 @@ void setup()
   if (wakeup_reason == ESP_SLEEP_WAKEUP_TIMER)
   {
     Serial.println("Wakeup caused by timer");
+    wake_reason = "timer";
     runRoutine();
   }
   else if (wakeup_reason == ESP_SLEEP_WAKEUP_TOUCHPAD)
   {
     Serial.println("Wakeup caused by touch");
+    wake_reason = "touch";
     runTouchRoutine();
   }
   else
@@ -91,6 +118,7 @@ void setup()
     Serial.println("Power-on or reset");
     runRoutine();
   }
+  report_telemetry();
   goToSleep();
 }
 
@@ -124,12 +152,107 @@ bool parseJsonResponse(String response, JsonDocument &doc)
   }
   return true;
 }
+// Use the sleep time the server asked for, it knows when the next image is due
+void readNextWake(JsonDocument &doc)
+{
+  uint32_t seconds = doc["data"]["next_wake_seconds"] | 0;
+  if (seconds > 0)
+  {
+    sleep_seconds = seconds;
+    Serial.printf("Next wake in %u seconds\n", seconds);
+  }
+}
+
+// Run the commands the server queued. They are acknowledged first, so a
+// reboot or a command that hangs is not delivered again.
+void handleCommands(JsonDocument &doc)
+{
+  JsonArray commands = doc["data"]["commands"].as<JsonArray>();
+  if (running_commands || commands.isNull() || commands.size() == 0)
+  {
+    return;
+  }
+
+  JsonDocument ack;
+  ack["action"] = "ack_commands";
+  JsonArray acks = ack["commands"].to<JsonArray>();
+  for (JsonVariant command : commands)
+  {
+    String kind = command["kind"].as<String>();
+    JsonObject entry = acks.add<JsonObject>();
+    entry["id"] = command["id"];
+    if (kind == "show_image" || kind == "refresh" || kind == "clear_screen" || kind == "reboot" || kind == "re_register")
+    {
+      entry["status"] = "acknowledged";
+    }
+    else
+    {
+      entry["status"] = "failed";
+      entry["result"] = "unknown command " + kind;
+    }
+  }
+  String jsonPayload;
+  serializeJson(ack, jsonPayload);
+  if (httpsPOST(SERVER_URL + "/dev", jsonPayload, bearer_token).isEmpty())
+  {
+    Serial.println("Failed to acknowledge commands, they are sent again");
+    return;
+  }
+
+  running_commands = true;
+  bool reboot = false;
+  bool re_register = false;
+  for (JsonVariant command : commands)
+  {
+    String kind = command["kind"].as<String>();
+    Serial.println("Running command " + kind);
+    if (kind == "show_image")
+    {
+      updateImage("manual", command["id"].as<uint32_t>());
+    }
+    else if (kind == "refresh")
+    {
+      updateImage("manual");
+    }
+    else if (kind == "clear_screen")
+    {
+      clear_display();
+    }
+    else if (kind == "reboot")
+    {
+      reboot = true;
+    }
+    else if (kind == "re_register")
+    {
+      re_register = true;
+    }
+  }
+  running_commands = false;
+
+  // Restarting ends the wake, so it comes last
+  if (re_register)
+  {
+    clear_token();
+  }
+  if (reboot || re_register)
+  {
+    Serial.println("Restarting...");
+    delay(1000);
+    ESP.restart();
+  }
+}
+
 void goToSleep()
+{
+  goToSleepFor(sleep_seconds);
+}
+
+void goToSleepFor(uint64_t seconds)
 {
   Serial.println("Configuring deep sleep...");
 
   // Configure wakeup sources
-  esp_sleep_enable_timer_wakeup(TIME_TO_SLEEP * uS_TO_S_FACTOR);
+  esp_sleep_enable_timer_wakeup(seconds * uS_TO_S_FACTOR);
   touchSleepWakeUpEnable(TOUCH_PIN, TOUCH_THRESHOLD); // NULL = no ISR, only for deep sleep wake
   esp_sleep_enable_touchpad_wakeup();
 
@@ -236,6 +359,12 @@ void start_up()
   {
     if (!register_device())
     {
+      if (pairing_pending)
+      {
+        // Check again for approval after a short sleep
+        Serial.println("Waiting for pairing approval...");
+        goToSleepFor(PAIRING_POLL_INTERVAL);
+      }
       Serial.println("Device registration failed. Restarting...");
       delay(5000);
       ESP.restart();
@@ -255,6 +384,14 @@ bool register_device()
   JsonDocument doc;
   doc["device_name"] = DEVICE_NAME;
   doc["device_id"] = getMacAddress();
+  preferences.begin(CONFIG_NAME, true); // Read-only mode
+  String pairing_secret = preferences.getString("pairing_secret", "");
+  String shown_code = preferences.getString("pairing_code", "");
+  preferences.end();
+  if (!pairing_secret.isEmpty())
+  {
+    doc["pairing_secret"] = pairing_secret;
+  }
   String jsonPayload;
   serializeJson(doc, jsonPayload);
 
@@ -272,10 +409,36 @@ bool register_device()
   }
   if (!responseDoc["success"])
   {
-    Serial.println("[HTTPS] Registration failed:" + responseDoc["success"].as<String>());
+    Serial.println("[HTTPS] Registration failed:" + responseDoc["error"].as<String>());
+    // Another code is still pending or too many were requested, wait for it
+    // to expire instead of restarting right away
+    if (responseDoc["error"] == "Pairing already pending for this device" || responseDoc["error"] == "Too many pairing requests, try again later")
+    {
+      pairing_pending = true;
+    }
     return false; // Registration failed
   }
 
+  // Unknown device, show the pairing code so an admin can approve it
+  if (responseDoc["data"]["message"] == "Pairing required" || responseDoc["data"]["message"] == "Pairing pending")
+  {
+    pairing_pending = true;
+    String code = responseDoc["data"]["pairing_code"].as<String>();
+    Serial.println("[HTTPS] Pairing code: " + code);
+    preferences.begin(CONFIG_NAME, false);
+    if (!responseDoc["data"]["pairing_secret"].isNull())
+    {
+      preferences.putString("pairing_secret", responseDoc["data"]["pairing_secret"].as<String>());
+    }
+    preferences.putString("pairing_code", code);
+    preferences.end();
+    if (code != shown_code)
+    {
+      show_pairing_code(code);
+    }
+    return false;
+  }
+
   // Check if the registration was successful
   if (responseDoc["data"]["message"] != "Device registered")
   {
@@ -288,11 +451,60 @@ bool register_device()
   bearer_token = responseDoc["data"]["token"].as<String>();
   preferences.begin(CONFIG_NAME, false);
   preferences.putString("bearer_token", bearer_token);
+  preferences.remove("pairing_code");
   preferences.end();
   Serial.println("Bearer token saved: " + bearer_token);
   return true; // Registration successful
 }
 
+void clear_token()
+{
+  // Token expired or was revoked, register again on the next wake
+  Serial.println("Bearer token rejected, clearing it");
+  bearer_token = "";
+  preferences.begin(CONFIG_NAME, false);
+  preferences.remove("bearer_token");
+  preferences.end();
+}
+
+void clear_display()
+{
+  init_display();
+  display.setFullWindow();
+  display.firstPage();
+  do
+  {
+    display.fillScreen(GxEPD_WHITE);
+  } while (display.nextPage());
+  display.hibernate();
+  clear_etags();
+  Serial.println("Display cleared");
+}
+
+void show_pairing_code(String code)
+{
+  init_display();
+  display.setRotation(0);
+  display.setFullWindow();
+  display.setTextColor(GxEPD_BLACK);
+  display.firstPage();
+  do
+  {
+    display.fillScreen(GxEPD_WHITE);
+    display.setTextSize(3);
+    display.setCursor(40, 120);
+    display.print("Pairing code");
+    display.setTextSize(8);
+    display.setCursor(40, 200);
+    display.print(code);
+    display.setTextSize(2);
+    display.setCursor(40, 320);
+    display.print("Device: " + getMacAddress());
+  } while (display.nextPage());
+  display.hibernate();
+  clear_etags();
+}
+
 bool getImage()
 {
   Serial.println("Getting image...");
@@ -321,28 +533,42 @@ bool getImage()
   {
     String error = responseDoc["error"].as<String>();
     Serial.println("[HTTPS] Update failed:" + error);
+    if (error == "Unauthorized device")
+    {
+      clear_token();
+    }
     return false; // Update failed
   }
+  readNextWake(responseDoc);
   // Check if the update was successful
   if (responseDoc["data"]["message"] == "No image update needed")
   {
     Serial.println("[HTTPS] No image update needed");
+    handleCommands(responseDoc);
     return true; // No update needed
   }
   // Print the response
   Serial.println("[HTTPS] Update successful");
   // Use the image data from the response
   JsonArray images = responseDoc["data"]["image"].as<JsonArray>();
-  return download_and_display(images);
+  bool displayed = download_and_display(images);
+  handleCommands(responseDoc);
+  return displayed;
 }
 
-bool updateImage()
+bool updateImage(String trigger, uint32_t command_id)
 {
   Serial.println("Updating image...");
 
   // Create JSON payload for image update
   JsonDocument doc;
   doc["action"] = "update_image";
+  doc["trigger"] = trigger;
+  if (command_id > 0)
+  {
+    // Show the image of a show_image command instead of the next one
+    doc["command_id"] = command_id;
+  }
   String jsonPayload;
   serializeJson(doc, jsonPayload);
 
@@ -362,20 +588,43 @@ bool updateImage()
   {
     String error = responseDoc["error"].as<String>();
     Serial.println("[HTTPS] Update failed:" + error);
+    if (error == "Unauthorized device")
+    {
+      clear_token();
+    }
     return false; // Update failed
   }
+  readNextWake(responseDoc);
 
   // Print the response
   Serial.println("[HTTPS] Update successful");
   // Use the image data from the response
   JsonArray images = responseDoc["data"]["image"].as<JsonArray>();
-  return download_and_display(images);
+  bool displayed = download_and_display(images);
+  handleCommands(responseDoc);
+  return displayed;
 }
 
+// Download the color planes and draw them. The ETag of every plane that is
+// shown is kept, so planes the server reports unchanged are not downloaded
+// and the panel is not refreshed when the image is the same.
 bool download_and_display(JsonArray images)
 {
   uint8_t *downloadedImages[COLORS] = {nullptr};
+  String urls[COLORS];
+  String etags[COLORS];
+  bool not_modified[COLORS] = {false};
   int imageCount = 0;
+  int unchangedCount = 0;
+  int failedCount = 0;
+
+  preferences.begin(CONFIG_NAME, true);
+  for (int i = 0; i < COLORS; i++)
+  {
+    etags[i] = preferences.getString(("etag" + String(i)).c_str(), "");
+  }
+  download_failures = preferences.getInt("dl_failures", 0);
+  preferences.end();
 
   for (JsonVariant image : images)
   {
@@ -385,8 +634,15 @@ bool download_and_display(JsonArray images)
     String download_url = image.as<String>();
     Serial.println("Downloading image " + String(imageCount + 1) + ": " + download_url);
 
-    downloadedImages[imageCount] = downloadImage(download_url);
-    if (downloadedImages[imageCount])
+    downloadedImages[imageCount] = downloadImage(download_url, etags[imageCount], not_modified[imageCount]);
+    urls[imageCount] = download_url;
+    if (not_modified[imageCount])
+    {
+      Serial.println("Image " + String(imageCount + 1) + " unchanged");
+      unchangedCount++;
+      imageCount++;
+    }
+    else if (downloadedImages[imageCount])
     {
       Serial.println("Image " + String(imageCount + 1) + " downloaded successfully");
       imageCount++;
@@ -394,6 +650,32 @@ bool download_and_display(JsonArray images)
     else
     {
       Serial.println("Failed to download image " + String(imageCount + 1));
+      failedCount++;
+    }
+  }
+
+  if (imageCount > 0 && unchangedCount == imageCount && failedCount == 0)
+  {
+    Serial.println("Image unchanged, keeping the display as it is");
+    download_failures = 0;
+    preferences.begin(CONFIG_NAME, false);
+    preferences.putInt("dl_failures", download_failures);
+    preferences.end();
+    return true;
+  }
+  // Some planes changed, the unchanged ones are needed to redraw as well
+  for (int i = 0; i < imageCount; i++)
+  {
+    if (not_modified[i])
+    {
+      etags[i] = "";
+      not_modified[i] = false;
+      downloadedImages[i] = downloadImage(urls[i], etags[i], not_modified[i]);
+      if (!downloadedImages[i])
+      {
+        Serial.println("Failed to download image " + String(i + 1));
+        failedCount++;
+      }
     }
   }
 
@@ -405,6 +687,25 @@ bool download_and_display(JsonArray images)
   display.hibernate(); // Put the display to sleep to save power
   Serial.println("Display hibernated");
 
+  // Remember what is shown, planes that failed are downloaded again next time
+  // Failures add up across wakes until an image is shown completely
+  download_failures = failedCount > 0 ? download_failures + failedCount : 0;
+  preferences.begin(CONFIG_NAME, false);
+  preferences.putInt("dl_failures", download_failures);
+  for (int i = 0; i < COLORS; i++)
+  {
+    String key = "etag" + String(i);
+    if (downloadedImages[i] && !etags[i].isEmpty())
+    {
+      preferences.putString(key.c_str(), etags[i]);
+    }
+    else
+    {
+      preferences.remove(key.c_str());
+    }
+  }
+  preferences.end();
+
   // Free the downloaded image data when done using it
   for (int i = 0; i < imageCount; i++)
   {
@@ -418,9 +719,69 @@ bool download_and_display(JsonArray images)
   return true; // Update successful
 }
 
-uint8_t *downloadImage(String download_url)
+float read_battery_voltage()
+{
+  return analogReadMilliVolts(BATTERY_PIN) * BATTERY_DIVIDER / 1000.0;
+}
+
+int battery_level(float voltage)
+{
+  float level = (voltage - BATTERY_EMPTY_V) / (BATTERY_FULL_V - BATTERY_EMPTY_V) * 100;
+  return constrain((int)roundf(level), 0, 100);
+}
+
+// Report battery, signal and download health, once per wake before sleeping
+void report_telemetry()
+{
+  if (bearer_token.isEmpty() || WiFi.status() != WL_CONNECTED)
+  {
+    return;
+  }
+  Serial.println("Reporting telemetry...");
+
+  JsonDocument doc;
+  doc["action"] = "update_telemetry";
+  float voltage = read_battery_voltage();
+  doc["battery_voltage"] = voltage;
+  doc["battery_level"] = battery_level(voltage);
+  doc["rssi"] = WiFi.RSSI();
+  doc["wake_reason"] = wake_reason;
+  doc["free_heap"] = ESP.getFreeHeap();
+  doc["free_psram"] = ESP.getFreePsram();
+  if (download_failures >= 0)
+  {
+    // Only when images were fetched, a quiet wake says nothing about downloads
+    doc["download_failures"] = download_failures;
+  }
+  String jsonPayload;
+  serializeJson(doc, jsonPayload);
+
+  String response = httpsPOST(SERVER_URL + "/dev", jsonPayload, bearer_token);
+  JsonDocument responseDoc;
+  if (response.isEmpty() || !parseJsonResponse(response, responseDoc) || !responseDoc["success"])
+  {
+    Serial.println("[HTTPS] Telemetry not accepted:" + response);
+  }
+}
+
+// Forget the ETags of the shown image, after the panel showed something else
+void clear_etags()
+{
+  preferences.begin(CONFIG_NAME, false);
+  for (int i = 0; i < COLORS; i++)
+  {
+    preferences.remove(("etag" + String(i)).c_str());
+  }
+  preferences.end();
+}
+
+// Download a color plane. A non-empty etag is sent as If-None-Match, and
+// not_modified is set instead of downloading if the plane is unchanged. The
+// ETag of a downloaded plane is returned in etag.
+uint8_t *downloadImage(String download_url, String &etag, bool &not_modified)
 {
   Serial.println("Downloading image from: " + download_url);
+  not_modified = false;
 
   // Use the GET helper function to retrieve headers first to get content length
   NetworkClientSecure *client = new NetworkClientSecure;
@@ -432,69 +793,136 @@ uint8_t *downloadImage(String download_url)
 
   client->setCACertBundle(x509_crt_bundle, x509_crt_bundle_len);
 
+  uint8_t *buffer = nullptr;
+  size_t contentLength = 0;
+  size_t totalRead = 0;
+  String known_etag = etag;
+
+  // Interrupted transfers are resumed with a Range request instead of
+  // starting over from zero
+  for (int attempt = 0; attempt < DOWNLOAD_ATTEMPTS; attempt++)
   {
     HTTPClient https;
-    if (https.begin(*client, SERVER_URL + "/" + download_url))
+    const char *headerKeys[] = {"ETag"};
+    if (!https.begin(*client, SERVER_URL + "/" + download_url))
     {
-      https.addHeader("Authorization", "Bearer " + bearer_token);
+      Serial.println("[HTTPS] Unable to connect");
+      delay(1000);
+      continue;
+    }
+    https.collectHeaders(headerKeys, 1);
+    https.addHeader("Authorization", "Bearer " + bearer_token);
+    if (buffer && totalRead > 0)
+    {
+      Serial.printf("Resuming download at byte %d of %d\n", totalRead, contentLength);
+      https.addHeader("Range", "bytes=" + String(totalRead) + "-");
+      // Only resume if the file has not changed in the meantime
+      https.addHeader("If-Range", etag);
+    }
+    else if (!known_etag.isEmpty())
+    {
+      // Skip the download if this plane is already on the display
+      https.addHeader("If-None-Match", known_etag);
+    }
 
-      int httpCode = https.GET();
-      if (httpCode > 0 && httpCode == HTTP_CODE_OK)
+    int httpCode = https.GET();
+    if (httpCode == HTTP_CODE_NOT_MODIFIED)
+    {
+      Serial.println("Image not modified");
+      https.end();
+      if (buffer)
       {
-        int contentLength = https.getSize();
-        Serial.printf("Content length: %d\n", contentLength);
-
-        // Check if there's content to download
-        if (contentLength > 0)
+        free(buffer);
+      }
+      delete client;
+      not_modified = true;
+      return nullptr;
+    }
+    if (httpCode == HTTP_CODE_OK)
+    {
+      // Full content, (re)start from the beginning
+      int size = https.getSize();
+      Serial.printf("Content length: %d\n", size);
+      if (size <= 0)
+      {
+        https.end();
+        break;
+      }
+      if (buffer && (size_t)size != contentLength)
+      {
+        free(buffer);
+        buffer = nullptr;
+      }
+      contentLength = size;
+      totalRead = 0;
+      etag = https.header("ETag");
+      if (!buffer)
+      {
+        buffer = (uint8_t *)heap_caps_malloc(contentLength, MALLOC_CAP_SPIRAM);
+        if (!buffer)
         {
-          uint8_t *buffer = (uint8_t *)heap_caps_malloc(contentLength, MALLOC_CAP_SPIRAM);
+          Serial.println("Failed to allocate PSRAM for image, falling back to regular memory");
+          buffer = (uint8_t *)malloc(contentLength);
           if (!buffer)
           {
-            Serial.println("Failed to allocate PSRAM for image, falling back to regular memory");
-            buffer = (uint8_t *)malloc(contentLength);
-            if (!buffer)
-            {
-              Serial.println("Failed to allocate memory for image");
-              https.end();
-              delete client;
-              return nullptr;
-            }
-          }
-          else
-          {
-            Serial.println("Using PSRAM for image buffer");
+            Serial.println("Failed to allocate memory for image");
+            https.end();
+            break;
           }
+        }
+        else
+        {
+          Serial.println("Using PSRAM for image buffer");
+        }
+      }
+    }
+    else if (httpCode != HTTP_CODE_PARTIAL_CONTENT || !buffer)
+    {
+      Serial.printf("[HTTPS] GET... failed, error: %s\n", https.errorToString(httpCode).c_str());
+      https.end();
+      if (httpCode > 0)
+      {
+        break; // The server answered, retrying will not help
+      }
+      delay(1000);
+      continue;
+    }
 
-          WiFiClient *stream = https.getStreamPtr();
-          size_t totalRead = 0;
-          size_t bytesRead = 0;
-
-          // Read all data
-          while (https.connected() && (totalRead < contentLength))
-          {
-            if (stream->available())
-            {
-              bytesRead = stream->read(buffer + totalRead, contentLength - totalRead);
-              totalRead += bytesRead;
-              // Serial.printf("Downloaded: %d of %d bytes\n", totalRead, contentLength);
-            }
-            delay(1);
-          }
+    WiFiClient *stream = https.getStreamPtr();
+    unsigned long lastData = millis();
 
-          Serial.println("Download complete");
-          https.end();
-          delete client;
-          return buffer;
-        }
+    // Read until complete or the connection stalls
+    while (https.connected() && (totalRead < contentLength))
+    {
+      if (stream->available())
+      {
+        size_t bytesRead = stream->read(buffer + totalRead, contentLength - totalRead);
+        totalRead += bytesRead;
+        lastData = millis();
+        // Serial.printf("Downloaded: %d of %d bytes\n", totalRead, contentLength);
       }
-      else
+      else if (millis() - lastData > DOWNLOAD_STALL_TIMEOUT)
       {
-        Serial.printf("[HTTPS] GET... failed, error: %s\n", https.errorToString(httpCode).c_str());
+        Serial.println("Download stalled");
+        break;
       }
-      https.end();
+      delay(1);
+    }
+    https.end();
+
+    if (totalRead == contentLength)
+    {
+      Serial.println("Download complete");
+      delete client;
+      return buffer;
     }
+    Serial.printf("Download interrupted after %d of %d bytes\n", totalRead, contentLength);
   }
 
+  if (buffer)
+  {
+    free(buffer);
+  }
   delete client;
   return nullptr;
 }
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Admin roles, each role includes the permissions of the ones before it
+const (
+	roleViewer = "viewer"
+	roleEditor = "editor"
+	roleOwner  = "owner"
+)
+
+var roleLevels = map[string]int{
+	roleViewer: 1,
+	roleEditor: 2,
+	roleOwner:  3,
+}
+
+// Hash compared against when a username does not exist, so a failed login
+// takes the same time whether or not the user exists. It is computed on the
+// first failed login instead of at startup.
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	return hash
+})
+
+func hasRole(admin AdminUser, role string) bool {
+	return roleLevels[admin.Role] >= roleLevels[role]
+}
+
+// authAdmin identifies the admin user of a request. Accepted credentials are
+// an API key as Bearer token, HTTP basic auth with username and password, or
+// the admin_key from the configuration which acts as an owner.
+func authAdmin(c *gin.Context, db *gorm.DB) (AdminUser, error) {
+	if username, password, ok := c.Request.BasicAuth(); ok {
+		var admin AdminUser
+		result := db.Where("username = ?", username).First(&admin)
+		if result.Error != nil {
+			bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+			return AdminUser{}, fmt.Errorf("invalid username or password")
+		}
+		if admin.PasswordHash == "" {
+			bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+			return AdminUser{}, fmt.Errorf("password login disabled for %s", username)
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(admin.PasswordHash), []byte(password)); err != nil {
+			return AdminUser{}, fmt.Errorf("invalid username or password")
+		}
+		return admin, nil
+	}
+
+	apiKey, err := getBearerToken(c)
+	if err != nil {
+		return AdminUser{}, err
+	}
+	if adminKey := config().AdminKey; adminKey != "" && subtle.ConstantTimeCompare([]byte(apiKey), []byte(adminKey)) == 1 {
+		return AdminUser{Username: "config:admin_key", Role: roleOwner}, nil
+	}
+	keyHash := hashToken(apiKey)
+	var admin AdminUser
+	if err := db.Where("api_key_hash = ?", keyHash).First(&admin).Error; err != nil {
+		return AdminUser{}, fmt.Errorf("invalid API key")
+	}
+	if subtle.ConstantTimeCompare([]byte(admin.APIKeyHash), []byte(keyHash)) != 1 {
+		return AdminUser{}, fmt.Errorf("invalid API key")
+	}
+	return admin, nil
+}
+
+// requireAdmin authenticates the request and checks the admin has at least
+// the given role. On failure the error response is written and ok is false.
+func requireAdmin(c *gin.Context, db *gorm.DB, role string) (AdminUser, bool) {
+	admin, err := authAdmin(c, db)
+	if err != nil {
+		requestLogger(c).Warn("Unauthorized admin access", "path", c.FullPath(), "error", err)
+		c.JSON(http.StatusUnauthorized, errorResponse("Unauthorized access"))
+		return AdminUser{}, false
+	}
+	if !hasRole(admin, role) {
+		requestLogger(c).Warn("Admin lacks role", "admin", admin.Username, "admin_role", admin.Role, "role", role, "path", c.FullPath())
+		c.JSON(http.StatusForbidden, errorResponse("Insufficient permissions"))
+		return AdminUser{}, false
+	}
+	return admin, true
+}
+
+// recordAudit writes an entry to the audit log. Failures are logged but do
+// not fail the request, the change itself has already been made.
+func recordAudit(db *gorm.DB, admin AdminUser, action string, targetType string, targetID string, details string) {
+	entry := AuditLog{
+		Actor:      admin.Username,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Details:    details,
+	}
+	if err := db.Create(&entry).Error; err != nil {
+		slog.Error("Error writing audit log entry", "action", action, "admin", admin.Username, "error", err)
+	}
+}
+
+// ensureAdminUser creates an owner account on first start when neither admin
+// users nor an ADMIN_KEY exist, and prints its API key once.
+func ensureAdminUser(db *gorm.DB) error {
+	var count int64
+	if err := db.Model(&AdminUser{}).Count(&count).Error; err != nil {
+		return fmt.Errorf("failed to count admin users: %w", err)
+	}
+	if count > 0 || config().AdminKey != "" {
+		return nil
+	}
+	apiKey, err := generateToken()
+	if err != nil {
+		return err
+	}
+	admin := AdminUser{
+		Username:   "admin",
+		APIKeyHash: hashToken(apiKey),
+		Role:       roleOwner,
+	}
+	if err := db.Create(&admin).Error; err != nil {
+		return fmt.Errorf("failed to create initial admin user: %w", err)
+	}
+	// The key is written to stderr directly, so it does not end up in log
+	// files or a log collector
+	slog.Info("Created initial admin user, its API key follows on stderr and is shown only once", "admin", admin.Username, "role", admin.Role)
+	fmt.Fprintf(os.Stderr, "Admin API key of %s: %s\n", admin.Username, apiKey)
+	return nil
+}
+
+func handleAdminUserListRequest(c *gin.Context, db *gorm.DB) {
+	if _, ok := requireAdmin(c, db, roleOwner); !ok {
+		return
+	}
+	var admins []AdminUser
+	if err := db.Order("username ASC").Find(&admins).Error; err != nil {
+		requestLogger(c).Error("Error fetching admin users", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"users": admins,
+	}))
+}
+
+// applyAdminCredentials updates role and password of an admin user from the
+// request, and creates a new API key when asked. The new key is returned.
+func applyAdminCredentials(admin *AdminUser, requestData map[string]interface{}) (string, error) {
+	if role, ok := requestData["role"].(string); ok {
+		if _, valid := roleLevels[role]; !valid {
+			return "", fmt.Errorf("invalid role: %s", role)
+		}
+		admin.Role = role
+	}
+	if password, ok := requestData["password"].(string); ok && password != "" {
+		if len(password) < 8 {
+			return "", fmt.Errorf("password must be at least 8 characters")
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash password: %w", err)
+		}
+		admin.PasswordHash = string(hash)
+	}
+	apiKey := ""
+	if generate, ok := requestData["generate_api_key"].(bool); ok && generate {
+		key, err := generateToken()
+		if err != nil {
+			return "", err
+		}
+		apiKey = key
+		admin.APIKeyHash = hashToken(key)
+	}
+	return apiKey, nil
+}
+
+func handleAdminUserCreateRequest(c *gin.Context, db *gorm.DB) {
+	actor, ok := requireAdmin(c, db, roleOwner)
+	if !ok {
+		return
+	}
+	var requestData map[string]interface{}
+	if err := c.BindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse("Invalid JSON"))
+		return
+	}
+	username, ok := requestData["username"].(string)
+	if !ok || username == "" {
+		c.JSON(http.StatusBadRequest, errorResponse("username is required"))
+		return
+	}
+	admin := AdminUser{Username: username, Role: roleViewer}
+	if _, ok := requestData["password"].(string); !ok {
+		// Without a password the user can only log in with an API key
+		requestData["generate_api_key"] = true
+	}
+	apiKey, err := applyAdminCredentials(&admin, requestData)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(err.Error()))
+		return
+	}
+
+	var count int64
+	db.Model(&AdminUser{}).Where("username = ?", username).Count(&count)
+	if count > 0 {
+		c.JSON(http.StatusConflict, errorResponse("Admin user already exists"))
+		return
+	}
+	if err := db.Create(&admin).Error; err != nil {
+		requestLogger(c).Error("Error creating admin user", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	recordAudit(db, actor, "user_create", "admin_user", admin.Username, "role="+admin.Role)
+
+	data := map[string]interface{}{
+		"message": "Admin user created",
+		"user":    admin,
+	}
+	if apiKey != "" {
+		data["api_key"] = apiKey
+	}
+	c.JSON(http.StatusOK, successResponse(data))
+	requestLogger(c).Info("Admin user created", "admin", admin.Username, "role", admin.Role, "created_by", actor.Username)
+}
+
+func handleAdminUserUpdateRequest(c *gin.Context, db *gorm.DB) {
+	actor, ok := requireAdmin(c, db, roleOwner)
+	if !ok {
+		return
+	}
+	var requestData map[string]interface{}
+	if err := c.BindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse("Invalid JSON"))
+		return
+	}
+	username, ok := requestData["username"].(string)
+	if !ok || username == "" {
+		c.JSON(http.StatusBadRequest, errorResponse("username is required"))
+		return
+	}
+	var admin AdminUser
+	if err := db.Where("username = ?", username).First(&admin).Error; err != nil {
+		c.JSON(http.StatusNotFound, errorResponse("Admin user not found"))
+		return
+	}
+	previousRole := admin.Role
+	apiKey, err := applyAdminCredentials(&admin, requestData)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(err.Error()))
+		return
+	}
+	if previousRole == roleOwner && admin.Role != roleOwner && countOwners(db) <= 1 {
+		c.JSON(http.StatusConflict, errorResponse("Cannot demote the last owner"))
+		return
+	}
+	if err := db.Save(&admin).Error; err != nil {
+		requestLogger(c).Error("Error updating admin user", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	details := "role=" + admin.Role
+	if password, ok := requestData["password"].(string); ok && password != "" {
+		details += " password_changed=true"
+	}
+	details += " api_key_rotated=" + strconv.FormatBool(apiKey != "")
+	recordAudit(db, actor, "user_update", "admin_user", admin.Username, details)
+
+	data := map[string]interface{}{
+		"message": "Admin user updated",
+		"user":    admin,
+	}
+	if apiKey != "" {
+		data["api_key"] = apiKey
+	}
+	c.JSON(http.StatusOK, successResponse(data))
+}
+
+func countOwners(db *gorm.DB) int64 {
+	var count int64
+	db.Model(&AdminUser{}).Where("role = ?", roleOwner).Count(&count)
+	return count
+}
+
+func handleAdminUserDeleteRequest(c *gin.Context, db *gorm.DB) {
+	actor, ok := requireAdmin(c, db, roleOwner)
+	if !ok {
+		return
+	}
+	var requestData map[string]interface{}
+	if err := c.BindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse("Invalid JSON"))
+		return
+	}
+	username, ok := requestData["username"].(string)
+	if !ok || username == "" {
+		c.JSON(http.StatusBadRequest, errorResponse("username is required"))
+		return
+	}
+	var admin AdminUser
+	if err := db.Where("username = ?", username).First(&admin).Error; err != nil {
+		c.JSON(http.StatusNotFound, errorResponse("Admin user not found"))
+		return
+	}
+	if admin.Role == roleOwner && countOwners(db) <= 1 {
+		c.JSON(http.StatusConflict, errorResponse("Cannot delete the last owner"))
+		return
+	}
+	if err := db.Delete(&admin).Error; err != nil {
+		requestLogger(c).Error("Error deleting admin user", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	recordAudit(db, actor, "user_delete", "admin_user", admin.Username, "")
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"message":  "Admin user deleted",
+		"username": admin.Username,
+	}))
+}
+
+func handleAdminAuditLogRequest(c *gin.Context, db *gorm.DB) {
+	if _, ok := requireAdmin(c, db, roleOwner); !ok {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	query := db.Order("created_at DESC").Limit(limit)
+	if actor := c.Query("actor"); actor != "" {
+		query = query.Where("actor = ?", actor)
+	}
+	if targetType := c.Query("target_type"); targetType != "" {
+		query = query.Where("target_type = ?", targetType)
+	}
+	if targetID := c.Query("target_id"); targetID != "" {
+		query = query.Where("target_id = ?", targetID)
+	}
+	var entries []AuditLog
+	if err := query.Find(&entries).Error; err != nil {
+		requestLogger(c).Error("Error fetching audit log", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"entries": entries,
+	}))
+}
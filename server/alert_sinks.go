@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Supported alert sink types
+const (
+	alertSinkWebhook = "webhook"
+	alertSinkSMTP    = "smtp"
+	alertSinkNtfy    = "ntfy"
+	alertSinkGotify  = "gotify"
+)
+
+// alertNotification is sent to the sinks when an alert fires or resolves
+type alertNotification struct {
+	DeviceID   string    `json:"device_id"`
+	DeviceName string    `json:"device_name"`
+	Kind       string    `json:"kind"`
+	State      string    `json:"state"`
+	Message    string    `json:"message"`
+	Time       time.Time `json:"time"`
+}
+
+// title is a one line summary, e.g. "Kitchen: low battery resolved"
+func (n alertNotification) title() string {
+	title := n.DeviceName + ": " + strings.ReplaceAll(n.Kind, "_", " ")
+	if n.State == alertResolved {
+		title += " resolved"
+	}
+	return title
+}
+
+// alertSink delivers notifications to one destination
+type alertSink interface {
+	send(ctx context.Context, notification alertNotification) error
+}
+
+func newAlertSink(cfg AlertSinkConfig) (alertSink, error) {
+	switch cfg.Type {
+	case alertSinkWebhook:
+		return webhookSink{url: cfg.URL}, nil
+	case alertSinkNtfy:
+		return ntfySink{url: cfg.URL, token: cfg.Token}, nil
+	case alertSinkGotify:
+		return gotifySink{url: strings.TrimSuffix(cfg.URL, "/"), token: cfg.Token}, nil
+	case alertSinkSMTP:
+		return smtpSink{cfg: cfg}, nil
+	}
+	return nil, fmt.Errorf("unknown alert sink type %q", cfg.Type)
+}
+
+// sendAlertNotification delivers a notification to all configured sinks. A
+// failing sink does not keep the others from being tried.
+func sendAlertNotification(ctx context.Context, sinks []AlertSinkConfig, notification alertNotification) error {
+	var errs []error
+	for i, cfg := range sinks {
+		sink, err := newAlertSink(cfg)
+		if err == nil {
+			err = sink.send(ctx, notification)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("alert sink %d (%s): %w", i, cfg.Type, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+var alertHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// postAlert sends body to url and checks for a success status
+func postAlert(ctx context.Context, url string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := alertHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned %s: %s", url, resp.Status, bytes.TrimSpace(detail))
+	}
+	return nil
+}
+
+// webhookSink posts the notification as JSON
+type webhookSink struct {
+	url string
+}
+
+func (s webhookSink) send(ctx context.Context, notification alertNotification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	return postAlert(ctx, s.url, body, map[string]string{"Content-Type": "application/json"})
+}
+
+// ntfySink publishes to an ntfy topic, url includes the topic
+type ntfySink struct {
+	url   string
+	token string
+}
+
+func (s ntfySink) send(ctx context.Context, notification alertNotification) error {
+	headers := map[string]string{
+		"Title":    notification.title(),
+		"Priority": "high",
+		"Tags":     "warning",
+	}
+	if notification.State == alertResolved {
+		headers["Priority"] = "default"
+		headers["Tags"] = "white_check_mark"
+	}
+	if s.token != "" {
+		headers["Authorization"] = "Bearer " + s.token
+	}
+	return postAlert(ctx, s.url, []byte(notification.Message), headers)
+}
+
+// gotifySink posts a message with an application token
+type gotifySink struct {
+	url   string
+	token string
+}
+
+func (s gotifySink) send(ctx context.Context, notification alertNotification) error {
+	priority := 8
+	if notification.State == alertResolved {
+		priority = 4
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"title":    notification.title(),
+		"message":  notification.Message,
+		"priority": priority,
+	})
+	if err != nil {
+		return err
+	}
+	return postAlert(ctx, s.url+"/message", body, map[string]string{
+		"Content-Type": "application/json",
+		"X-Gotify-Key": s.token,
+	})
+}
+
+// smtpSink sends a plain text mail. STARTTLS is used when the server offers
+// it; credentials are only sent over TLS or to localhost.
+type smtpSink struct {
+	cfg AlertSinkConfig
+}
+
+func (s smtpSink) send(ctx context.Context, notification alertNotification) error {
+	host, _, err := net.SplitHostPort(s.cfg.SMTPServer)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if s.cfg.Username != "" {
+		auth = smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, host)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.cfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: [EinkPhotoFrame] %s\r\n", notification.title())
+	fmt.Fprintf(&msg, "Date: %s\r\n", notification.Time.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\nDevice: %s (%s)\r\nTime: %s\r\n", notification.Message,
+		notification.DeviceName, notification.DeviceID, notification.Time.Format(time.RFC3339))
+	// net/smtp has no context support, give up waiting once ctx is done
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.cfg.SMTPServer, auth, s.cfg.From, s.cfg.To, msg.Bytes())
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sinkRequest is a request received by a stand-in notification service
+type sinkRequest struct {
+	method string
+	path   string
+	header http.Header
+	body   []byte
+}
+
+// newSinkServer starts an HTTP server recording every request and answering
+// with status.
+func newSinkServer(t *testing.T, status int) (*httptest.Server, <-chan sinkRequest) {
+	t.Helper()
+	requests := make(chan sinkRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- sinkRequest{method: r.Method, path: r.URL.Path, header: r.Header.Clone(), body: body}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func receive(t *testing.T, requests <-chan sinkRequest) sinkRequest {
+	t.Helper()
+	select {
+	case req := <-requests:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request received")
+		return sinkRequest{}
+	}
+}
+
+func testNotification(state string) alertNotification {
+	return alertNotification{
+		DeviceID:   "frame1",
+		DeviceName: "Kitchen",
+		Kind:       alertLowBattery,
+		State:      state,
+		Message:    "Battery at 12%, below 20%",
+		Time:       time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	server, requests := newSinkServer(t, http.StatusNoContent)
+	sink, err := newAlertSink(AlertSinkConfig{Type: alertSinkWebhook, URL: server.URL + "/hook"})
+	if err != nil {
+		t.Fatalf("newAlertSink: %v", err)
+	}
+	notification := testNotification(alertFiring)
+	if err := sink.send(context.Background(), notification); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	req := receive(t, requests)
+	if req.method != http.MethodPost || req.path != "/hook" {
+		t.Errorf("got %s %s, want POST /hook", req.method, req.path)
+	}
+	if got := req.header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type %q, want application/json", got)
+	}
+	var got alertNotification
+	if err := json.Unmarshal(req.body, &got); err != nil {
+		t.Fatalf("body is not JSON: %v: %s", err, req.body)
+	}
+	if got != notification {
+		t.Errorf("body %+v, want %+v", got, notification)
+	}
+}
+
+func TestNtfySink(t *testing.T) {
+	server, requests := newSinkServer(t, http.StatusOK)
+
+	sink, _ := newAlertSink(AlertSinkConfig{Type: alertSinkNtfy, URL: server.URL + "/frames", Token: "tk_secret"})
+	if err := sink.send(context.Background(), testNotification(alertFiring)); err != nil {
+		t.Fatalf("send firing: %v", err)
+	}
+	req := receive(t, requests)
+	if req.method != http.MethodPost || req.path != "/frames" {
+		t.Errorf("got %s %s, want POST /frames", req.method, req.path)
+	}
+	want := map[string]string{
+		"Title":         "Kitchen: low battery",
+		"Priority":      "high",
+		"Tags":          "warning",
+		"Authorization": "Bearer tk_secret",
+	}
+	for name, value := range want {
+		if got := req.header.Get(name); got != value {
+			t.Errorf("firing: %s %q, want %q", name, got, value)
+		}
+	}
+	if string(req.body) != "Battery at 12%, below 20%" {
+		t.Errorf("firing: body %q, want the message", req.body)
+	}
+
+	// Resolved notifications are quieter, no token means no Authorization
+	sink, _ = newAlertSink(AlertSinkConfig{Type: alertSinkNtfy, URL: server.URL + "/frames"})
+	if err := sink.send(context.Background(), testNotification(alertResolved)); err != nil {
+		t.Fatalf("send resolved: %v", err)
+	}
+	req = receive(t, requests)
+	want = map[string]string{
+		"Title":         "Kitchen: low battery resolved",
+		"Priority":      "default",
+		"Tags":          "white_check_mark",
+		"Authorization": "",
+	}
+	for name, value := range want {
+		if got := req.header.Get(name); got != value {
+			t.Errorf("resolved: %s %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestGotifySink(t *testing.T) {
+	server, requests := newSinkServer(t, http.StatusOK)
+	// A trailing slash on the server URL is tolerated
+	sink, _ := newAlertSink(AlertSinkConfig{Type: alertSinkGotify, URL: server.URL + "/gotify/", Token: "app-token"})
+
+	for _, tt := range []struct {
+		state    string
+		title    string
+		priority float64
+	}{
+		{alertFiring, "Kitchen: low battery", 8},
+		{alertResolved, "Kitchen: low battery resolved", 4},
+	} {
+		if err := sink.send(context.Background(), testNotification(tt.state)); err != nil {
+			t.Fatalf("send %s: %v", tt.state, err)
+		}
+		req := receive(t, requests)
+		if req.method != http.MethodPost || req.path != "/gotify/message" {
+			t.Errorf("%s: got %s %s, want POST /gotify/message", tt.state, req.method, req.path)
+		}
+		if got := req.header.Get("X-Gotify-Key"); got != "app-token" {
+			t.Errorf("%s: X-Gotify-Key %q, want app-token", tt.state, got)
+		}
+		if got := req.header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("%s: Content-Type %q, want application/json", tt.state, got)
+		}
+		var body map[string]interface{}
+		if err := json.Unmarshal(req.body, &body); err != nil {
+			t.Fatalf("%s: body is not JSON: %v", tt.state, err)
+		}
+		if body["title"] != tt.title || body["message"] != "Battery at 12%, below 20%" || body["priority"] != tt.priority {
+			t.Errorf("%s: body %v", tt.state, body)
+		}
+	}
+}
+
+func TestSendAlertNotificationTriesAllSinks(t *testing.T) {
+	failing, _ := newSinkServer(t, http.StatusInternalServerError)
+	working, requests := newSinkServer(t, http.StatusOK)
+	sinks := []AlertSinkConfig{
+		{Type: alertSinkWebhook, URL: failing.URL},
+		{Type: "pager"},
+		{Type: alertSinkWebhook, URL: working.URL},
+	}
+
+	err := sendAlertNotification(context.Background(), sinks, testNotification(alertFiring))
+	if err == nil {
+		t.Fatal("expected an error for the failing and the unknown sink")
+	}
+	for _, want := range []string{"alert sink 0 (webhook)", "500", `alert sink 1 (pager): unknown alert sink type "pager"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+	receive(t, requests)
+}
+
+// smtpSession is what a stand-in SMTP server received
+type smtpSession struct {
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+// newSMTPServer accepts one SMTP session on a local port and reports what
+// the client sent. It offers AUTH but not STARTTLS.
+func newSMTPServer(t *testing.T) (string, <-chan smtpSession) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	sessions := make(chan smtpSession, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		text := textproto.NewConn(conn)
+		var session smtpSession
+		text.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			command, arg, _ := strings.Cut(line, " ")
+			switch strings.ToUpper(command) {
+			case "EHLO", "HELO":
+				text.PrintfLine("250-localhost")
+				text.PrintfLine("250 AUTH PLAIN")
+			case "AUTH":
+				session.auth = arg
+				text.PrintfLine("235 Authenticated")
+			case "MAIL":
+				session.from = arg
+				text.PrintfLine("250 OK")
+			case "RCPT":
+				session.to = append(session.to, arg)
+				text.PrintfLine("250 OK")
+			case "DATA":
+				text.PrintfLine("354 Go ahead")
+				data, err := text.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				session.data = string(data)
+				text.PrintfLine("250 Queued")
+			case "QUIT":
+				text.PrintfLine("221 Bye")
+				sessions <- session
+				return
+			default:
+				text.PrintfLine("250 OK")
+			}
+		}
+	}()
+	return listener.Addr().String(), sessions
+}
+
+func TestSMTPSink(t *testing.T) {
+	addr, sessions := newSMTPServer(t)
+	sink, _ := newAlertSink(AlertSinkConfig{
+		Type:       alertSinkSMTP,
+		SMTPServer: addr,
+		Username:   "frames",
+		Password:   "hunter2",
+		From:       "frames@example.com",
+		To:         []string{"a@example.com", "b@example.com"},
+	})
+	if err := sink.send(context.Background(), testNotification(alertFiring)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	var session smtpSession
+	select {
+	case session = <-sessions:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no SMTP session completed")
+	}
+	mechanism, credentials, _ := strings.Cut(session.auth, " ")
+	decoded, _ := base64.StdEncoding.DecodeString(credentials)
+	if mechanism != "PLAIN" || string(decoded) != "\x00frames\x00hunter2" {
+		t.Errorf("AUTH %q, want PLAIN with the configured credentials", session.auth)
+	}
+	if session.from != "FROM:<frames@example.com>" {
+		t.Errorf("MAIL %q", session.from)
+	}
+	if len(session.to) != 2 || session.to[0] != "TO:<a@example.com>" || session.to[1] != "TO:<b@example.com>" {
+		t.Errorf("RCPT %q", session.to)
+	}
+	for _, want := range []string{
+		"From: frames@example.com\n",
+		"To: a@example.com, b@example.com\n",
+		"Subject: [EinkPhotoFrame] Kitchen: low battery\n",
+		"Battery at 12%, below 20%\n",
+		"Device: Kitchen (frame1)\n",
+		"Time: 2026-03-01T12:00:00Z\n",
+	} {
+		if !strings.Contains(session.data, want) {
+			t.Errorf("mail does not contain %q:\n%s", want, session.data)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Kinds of alerts, in the order they are checked
+const (
+	alertLowBattery       = "low_battery"
+	alertOffline          = "offline"
+	alertDownloadFailures = "download_failures"
+)
+
+var alertKinds = []string{alertLowBattery, alertOffline, alertDownloadFailures}
+
+// States of a notification
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// deviceProblems checks a device against the alert conditions. Returns the
+// message of every problem found by kind.
+func deviceProblems(db *gorm.DB, cfg AlertsConfig, device Device, settings *DeviceSetting, now time.Time) (map[string]string, error) {
+	problems := make(map[string]string)
+	telemetry, found, err := latestTelemetry(db, device.DeviceID, "battery_level")
+	if err != nil {
+		return nil, err
+	}
+	if found && *telemetry.BatteryLevel < cfg.BatteryThreshold {
+		problems[alertLowBattery] = fmt.Sprintf("Battery at %d%%, below %d%%", *telemetry.BatteryLevel, cfg.BatteryThreshold)
+	}
+	// Devices that never checked in are waiting to be set up, not offline
+	if device.LastSeenAt != nil && settings != nil {
+		schedule, err := loadDeviceSchedule(db, *settings)
+		if err != nil {
+			return nil, err
+		}
+		// When the device was told to wake, after any quiet window
+		expected := nextWakeAt(device, *settings, schedule, *device.LastSeenAt)
+		interval := time.Duration(settings.ImgUpdateInterval) * time.Second
+		if now.Sub(expected) > time.Duration(cfg.OfflineIntervals-1)*interval {
+			problems[alertOffline] = fmt.Sprintf("Not seen since %s, expected at %s and every %s after",
+				device.LastSeenAt.Format(time.RFC3339), expected.Format(time.RFC3339), interval)
+		}
+	}
+	telemetry, found, err = latestTelemetry(db, device.DeviceID, "download_failures")
+	if err != nil {
+		return nil, err
+	}
+	if found && *telemetry.DownloadFailures >= cfg.DownloadFailures {
+		problems[alertDownloadFailures] = fmt.Sprintf("%d image downloads failed in a row", *telemetry.DownloadFailures)
+	}
+	return problems, nil
+}
+
+// evaluateAlerts checks all devices, opens alerts for new problems and
+// resolves those that cleared, notifying the sinks of every change. Failed
+// notifications are logged and not retried.
+func evaluateAlerts(ctx context.Context, db *gorm.DB) error {
+	cfg := config().Alerts
+	now := time.Now()
+	var devices []Device
+	if err := db.Find(&devices).Error; err != nil {
+		return fmt.Errorf("failed to fetch devices: %w", err)
+	}
+	settingsByDevice, err := effectiveSettingsByDevice(db)
+	if err != nil {
+		return err
+	}
+	var open []Alert
+	if err := db.Where("resolved_at IS NULL").Find(&open).Error; err != nil {
+		return fmt.Errorf("failed to fetch open alerts: %w", err)
+	}
+	openByDevice := make(map[string]map[string]Alert)
+	for _, alert := range open {
+		if openByDevice[alert.DeviceID] == nil {
+			openByDevice[alert.DeviceID] = make(map[string]Alert)
+		}
+		openByDevice[alert.DeviceID][alert.Kind] = alert
+	}
+
+	notify := func(device Device, kind string, state string, message string) {
+		notification := alertNotification{
+			DeviceID:   device.DeviceID,
+			DeviceName: device.DeviceName,
+			Kind:       kind,
+			State:      state,
+			Message:    message,
+			Time:       now,
+		}
+		logger := loggerFrom(ctx).With("device_id", device.DeviceID, "kind", kind)
+		if state == alertFiring {
+			logger.Warn("Alert firing", "message", message)
+		} else {
+			logger.Info("Alert resolved", "message", message)
+		}
+		if err := sendAlertNotification(ctx, cfg.Sinks, notification); err != nil {
+			logger.Error("Error sending alert notification", "error", err)
+		}
+	}
+	resolve := func(device Device, alert Alert, message string) error {
+		if err := db.Model(&alert).Update("resolved_at", now).Error; err != nil {
+			return fmt.Errorf("failed to resolve alert %d: %w", alert.ID, err)
+		}
+		notify(device, alert.Kind, alertResolved, message)
+		return nil
+	}
+
+	for _, device := range devices {
+		var settings *DeviceSetting
+		if s, ok := settingsByDevice[device.DeviceID]; ok {
+			settings = &s
+		}
+		problems, err := deviceProblems(db, cfg, device, settings, now)
+		if err != nil {
+			return fmt.Errorf("failed to check device %s: %w", device.DeviceID, err)
+		}
+		for _, kind := range alertKinds {
+			alert, isOpen := openByDevice[device.DeviceID][kind]
+			message, hasProblem := problems[kind]
+			switch {
+			case hasProblem && !isOpen:
+				alert = Alert{DeviceID: device.DeviceID, Kind: kind, Message: message, FiredAt: now}
+				if err := db.Create(&alert).Error; err != nil {
+					return fmt.Errorf("failed to record alert: %w", err)
+				}
+				notify(device, kind, alertFiring, message)
+			case !hasProblem && isOpen:
+				if err := resolve(device, alert, "Back to normal: "+alert.Message); err != nil {
+					return err
+				}
+			}
+		}
+		delete(openByDevice, device.DeviceID)
+	}
+	// Alerts of removed devices
+	for deviceID, alerts := range openByDevice {
+		for _, alert := range alerts {
+			if err := resolve(Device{DeviceID: deviceID, DeviceName: deviceID}, alert, "Device was removed"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runAlertCommand handles "alert check", which evaluates the alerts once
+// like the server does every alerts.interval, and "alert test", which sends
+// a test notification to every configured sink.
+func runAlertCommand(args []string) int {
+	if len(args) != 1 || (args[0] != "check" && args[0] != "test") {
+		return commandUsage("alert")
+	}
+	db, err := openCommandDB()
+	if err != nil {
+		slog.Error("Failed to open database", "error", err)
+		return 1
+	}
+	defer dbClose(db)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if args[0] == "check" {
+		err = evaluateAlerts(ctx, db)
+	} else {
+		sinks := config().Alerts.Sinks
+		if len(sinks) == 0 {
+			fmt.Fprintln(os.Stderr, "no alert sinks configured")
+			return 1
+		}
+		err = sendAlertNotification(ctx, sinks, alertNotification{
+			DeviceID:   "test",
+			DeviceName: "Test frame",
+			Kind:       "test",
+			State:      alertFiring,
+			Message:    "Test notification from the EinkPhotoFrame server",
+			Time:       time.Now(),
+		})
+		if err == nil {
+			fmt.Printf("Test notification sent to %d sinks\n", len(sinks))
+		}
+	}
+	if err != nil {
+		slog.Error("alert "+args[0]+" failed", "error", err)
+		return 1
+	}
+	return 0
+}
+
+func handleAdminAlertListRequest(c *gin.Context, db *gorm.DB) {
+	// Alerts newest first, only open ones unless state=all
+	if _, ok := requireAdmin(c, db, roleViewer); !ok {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	query := db.Order("id DESC").Limit(limit)
+	switch c.DefaultQuery("state", "open") {
+	case "open":
+		query = query.Where("resolved_at IS NULL")
+	case "all":
+	default:
+		c.JSON(http.StatusBadRequest, errorResponse("state must be open or all"))
+		return
+	}
+	if deviceID := c.Query("device_id"); deviceID != "" {
+		query = query.Where("device_id = ?", deviceID)
+	}
+	var alerts []Alert
+	if err := query.Find(&alerts).Error; err != nil {
+		requestLogger(c).Error("Error fetching alerts", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"alerts": alerts,
+	}))
+}
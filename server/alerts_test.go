@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func testAlertsConfig() AlertsConfig {
+	return AlertsConfig{
+		Interval:         300,
+		BatteryThreshold: 20,
+		OfflineIntervals: 3,
+		DownloadFailures: 3,
+	}
+}
+
+// addTelemetry stores a report of the device taken at reportedAt
+func addTelemetry(t *testing.T, db *gorm.DB, deviceID string, reportedAt time.Time, report DeviceTelemetry) {
+	t.Helper()
+	report.DeviceID = deviceID
+	report.ReportedAt = reportedAt
+	report.Samples = 1
+	if err := db.Create(&report).Error; err != nil {
+		t.Fatalf("store telemetry: %v", err)
+	}
+}
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func TestDeviceProblemsThresholds(t *testing.T) {
+	useTestConfig(t, nil)
+	db := newTestDB(t)
+	cfg := testAlertsConfig()
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		telemetry []DeviceTelemetry
+		want      []string
+	}{
+		{"no telemetry", nil, nil},
+		{"battery below threshold", []DeviceTelemetry{{BatteryLevel: intPtr(19)}}, []string{alertLowBattery}},
+		{"battery at threshold", []DeviceTelemetry{{BatteryLevel: intPtr(20)}}, nil},
+		{"latest battery report counts", []DeviceTelemetry{{BatteryLevel: intPtr(5)}, {BatteryLevel: intPtr(80)}}, nil},
+		{"failures below threshold", []DeviceTelemetry{{DownloadFailures: intPtr(2)}}, nil},
+		{"failures at threshold", []DeviceTelemetry{{DownloadFailures: intPtr(3)}}, []string{alertDownloadFailures}},
+		{"failures reset", []DeviceTelemetry{{DownloadFailures: intPtr(4)}, {DownloadFailures: intPtr(0)}}, nil},
+		{"reports without the field are skipped", []DeviceTelemetry{{BatteryLevel: intPtr(10)}, {RSSI: intPtr(-70)}}, []string{alertLowBattery}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			device, _ := newTestDevice(t, db, "threshold"+string(rune('a'+i)))
+			for j, report := range tt.telemetry {
+				addTelemetry(t, db, device.DeviceID, now.Add(time.Duration(j-len(tt.telemetry))*time.Minute), report)
+			}
+			problems, err := deviceProblems(db, cfg, device, nil, now)
+			if err != nil {
+				t.Fatalf("deviceProblems: %v", err)
+			}
+			if len(problems) != len(tt.want) {
+				t.Fatalf("problems %v, want %v", problems, tt.want)
+			}
+			for _, kind := range tt.want {
+				if _, ok := problems[kind]; !ok {
+					t.Errorf("problems %v, want %s", problems, kind)
+				}
+			}
+		})
+	}
+}
+
+func TestDeviceProblemsOffline(t *testing.T) {
+	useTestConfig(t, nil)
+	db := newTestDB(t)
+	cfg := testAlertsConfig()
+	now := time.Now()
+	settings := DeviceSetting{ImgUpdateInterval: 600}
+
+	tests := []struct {
+		name     string
+		lastSeen *time.Time
+		want     bool
+	}{
+		{"never seen", nil, false},
+		{"seen just now", &now, false},
+		// Due 10 minutes after the last visit, two more intervals are allowed
+		{"missed two updates", timePtr(now.Add(-29 * time.Minute)), false},
+		{"missed three updates", timePtr(now.Add(-31 * time.Minute)), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			device := Device{DeviceID: "frame1", DeviceName: "Kitchen", LastSeenAt: tt.lastSeen}
+			if tt.lastSeen != nil {
+				device.UpdatedAt = *tt.lastSeen
+			}
+			settings.DeviceID = device.DeviceID
+			problems, err := deviceProblems(db, cfg, device, &settings, now)
+			if err != nil {
+				t.Fatalf("deviceProblems: %v", err)
+			}
+			if _, got := problems[alertOffline]; got != tt.want {
+				t.Errorf("offline %v, want %v (problems %v)", got, tt.want, problems)
+			}
+		})
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func TestEvaluateAlertsFiresAndResolves(t *testing.T) {
+	server, requests := newSinkServer(t, http.StatusOK)
+	useTestConfig(t, func(cfg *Config) {
+		cfg.Alerts = testAlertsConfig()
+		cfg.Alerts.Sinks = []AlertSinkConfig{{Type: alertSinkWebhook, URL: server.URL}}
+	})
+	db := newTestDB(t)
+	device, _ := newTestDevice(t, db, "frame1")
+	now := time.Now()
+	ctx := context.Background()
+
+	notification := func() alertNotification {
+		t.Helper()
+		var n alertNotification
+		if err := json.Unmarshal(receive(t, requests).body, &n); err != nil {
+			t.Fatalf("notification is not JSON: %v", err)
+		}
+		return n
+	}
+	openAlerts := func() []Alert {
+		t.Helper()
+		var alerts []Alert
+		if err := db.Where("resolved_at IS NULL").Find(&alerts).Error; err != nil {
+			t.Fatalf("fetch alerts: %v", err)
+		}
+		return alerts
+	}
+
+	addTelemetry(t, db, device.DeviceID, now.Add(-2*time.Minute), DeviceTelemetry{BatteryLevel: intPtr(12)})
+	if err := evaluateAlerts(ctx, db); err != nil {
+		t.Fatalf("evaluateAlerts: %v", err)
+	}
+	n := notification()
+	if n.DeviceID != "frame1" || n.Kind != alertLowBattery || n.State != alertFiring || n.Message != "Battery at 12%, below 20%" {
+		t.Errorf("firing notification %+v", n)
+	}
+	if alerts := openAlerts(); len(alerts) != 1 || alerts[0].Kind != alertLowBattery {
+		t.Fatalf("open alerts %+v, want one low battery alert", alerts)
+	}
+
+	// An alert that is already open is not sent again
+	if err := evaluateAlerts(ctx, db); err != nil {
+		t.Fatalf("evaluateAlerts: %v", err)
+	}
+	select {
+	case req := <-requests:
+		t.Fatalf("unexpected notification %s", req.body)
+	default:
+	}
+
+	addTelemetry(t, db, device.DeviceID, now.Add(-time.Minute), DeviceTelemetry{BatteryLevel: intPtr(85)})
+	if err := evaluateAlerts(ctx, db); err != nil {
+		t.Fatalf("evaluateAlerts: %v", err)
+	}
+	n = notification()
+	if n.Kind != alertLowBattery || n.State != alertResolved || !strings.HasPrefix(n.Message, "Back to normal: Battery at 12%") {
+		t.Errorf("resolved notification %+v", n)
+	}
+	if alerts := openAlerts(); len(alerts) != 0 {
+		t.Errorf("open alerts %+v after the battery recovered", alerts)
+	}
+	var resolved Alert
+	if err := db.First(&resolved).Error; err != nil {
+		t.Fatalf("fetch alert: %v", err)
+	}
+	if resolved.ResolvedAt == nil {
+		t.Error("alert has no resolved_at")
+	}
+}
+
+func TestEvaluateAlertsResolvesRemovedDevices(t *testing.T) {
+	server, requests := newSinkServer(t, http.StatusOK)
+	useTestConfig(t, func(cfg *Config) {
+		cfg.Alerts = testAlertsConfig()
+		cfg.Alerts.Sinks = []AlertSinkConfig{{Type: alertSinkWebhook, URL: server.URL}}
+	})
+	db := newTestDB(t)
+	alert := Alert{DeviceID: "gone", Kind: alertOffline, Message: "Not seen", FiredAt: time.Now()}
+	if err := db.Create(&alert).Error; err != nil {
+		t.Fatalf("create alert: %v", err)
+	}
+
+	if err := evaluateAlerts(context.Background(), db); err != nil {
+		t.Fatalf("evaluateAlerts: %v", err)
+	}
+	var n alertNotification
+	if err := json.Unmarshal(receive(t, requests).body, &n); err != nil {
+		t.Fatalf("notification is not JSON: %v", err)
+	}
+	if n.DeviceID != "gone" || n.State != alertResolved || n.Message != "Device was removed" {
+		t.Errorf("notification %+v", n)
+	}
+}
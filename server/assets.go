@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// How long a signed asset URL handed to a device stays valid
+const assetURLTTL = 15 * time.Minute
+
+// Claims embedded in the token of a signed asset URL
+type assetClaims struct {
+	DeviceID  string `json:"dev"`
+	ImageUUID string `json:"img"`
+	File      string `json:"file"`
+	jwt.RegisteredClaims
+}
+
+// signAssetURL returns a relative URL for a cached file that only the given
+// device can fetch, and only until the token expires.
+func signAssetURL(device Device, imageUUID string, file string) (string, error) {
+	now := time.Now()
+	claims := assetClaims{
+		DeviceID:  device.DeviceID,
+		ImageUUID: imageUUID,
+		File:      file,
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(assetURLTTL)),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	tokenString, err := token.SignedString([]byte(config().JWTMasterKey))
+	if err != nil {
+		return "", fmt.Errorf("failed to sign asset token: %w", err)
+	}
+	return fmt.Sprintf("assets/%s?token=%s", file, tokenString), nil
+}
+
+// contentETag returns a strong ETag derived from the file contents, so a
+// device can tell whether the payload it already holds is still current. The
+// reader is rewound afterwards.
+func contentETag(r io.ReadSeeker) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("\"%x\"", hash.Sum(nil)[:16]), nil
+}
+
+func parseAssetToken(tokenString string) (*assetClaims, error) {
+	claims := &assetClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(config().JWTMasterKey), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// cleanAssetName validates the requested asset path and returns the bare file
+// name. Only plain file names directly inside the cache directory are allowed.
+func cleanAssetName(path string) (string, error) {
+	name := strings.TrimPrefix(path, "/")
+	if name == "" || name == "." || name == ".." {
+		return "", fmt.Errorf("empty asset name")
+	}
+	if strings.ContainsAny(name, `/\`) || strings.Contains(name, "..") || filepath.Base(name) != name {
+		return "", fmt.Errorf("invalid asset name: %q", path)
+	}
+	return name, nil
+}
+
+func handleAssetRequest(c *gin.Context, db *gorm.DB) {
+	// Check authentication first
+	device, err := authDevice(c, db)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, errorResponse("Unauthorized access to assets"))
+		return
+	}
+	logger := requestLogger(c)
+
+	name, err := cleanAssetName(c.Param("filepath"))
+	if err != nil {
+		logger.Warn("Invalid asset path requested", "error", err)
+		c.JSON(http.StatusForbidden, errorResponse("Forbidden"))
+		return
+	}
+
+	tokenString := c.Query("token")
+	if tokenString == "" {
+		c.JSON(http.StatusForbidden, errorResponse("Missing asset token"))
+		return
+	}
+	claims, err := parseAssetToken(tokenString)
+	if err != nil {
+		logger.Warn("Invalid asset token presented", "error", err)
+		c.JSON(http.StatusForbidden, errorResponse("Invalid or expired asset token"))
+		return
+	}
+	// The token must have been issued to this device for this exact file
+	if claims.DeviceID != device.DeviceID || claims.File != name || !strings.HasPrefix(name, claims.ImageUUID+"_") {
+		logger.Warn("Asset token of another device or file presented", "token_device_id", claims.DeviceID, "token_file", claims.File)
+		c.JSON(http.StatusForbidden, errorResponse("Forbidden"))
+		return
+	}
+
+	fullPath := filepath.Join(config().CacheDir, name)
+	file, err := os.Open(fullPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			c.JSON(http.StatusNotFound, errorResponse("Asset not found"))
+		} else {
+			logger.Error("Error opening asset", "path", fullPath, "error", err)
+			c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		}
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		c.JSON(http.StatusNotFound, errorResponse("Asset not found"))
+		return
+	}
+	etag, err := contentETag(file)
+	if err != nil {
+		logger.Error("Error hashing asset", "path", fullPath, "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+
+	// ServeContent takes care of If-None-Match, If-Range, Range and
+	// Content-Length once the ETag header is set. Payload files are rewritten
+	// on every image request, so the modification time is deliberately left
+	// out and the content hash is the only validator.
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, no-cache")
+	c.Header("Content-Type", "application/octet-stream")
+	http.ServeContent(c.Writer, c.Request, name, time.Time{}, file)
+	assetBytesServed.Add(float64(max(c.Writer.Size(), 0)))
+	logger.Info("Asset served", "file", name, "bytes", max(c.Writer.Size(), 0))
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+type assetTest struct {
+	server *httptest.Server
+	db     *gorm.DB
+	cfg    *Config
+}
+
+// newAssetTest serves the asset route like the API server does
+func newAssetTest(t *testing.T) *assetTest {
+	t.Helper()
+	cfg := useTestConfig(t, nil)
+	db := newTestDB(t)
+	router := gin.New()
+	router.GET("/assets/*filepath", func(c *gin.Context) {
+		handleAssetRequest(c, db)
+	})
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return &assetTest{server: server, db: db, cfg: cfg}
+}
+
+// writeAsset stores a payload file in the cache directory.
+func (a *assetTest) writeAsset(t *testing.T, name string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(a.cfg.CacheDir, name), data, 0o600); err != nil {
+		t.Fatalf("write asset: %v", err)
+	}
+}
+
+// get fetches a relative asset URL as the device holding token.
+func (a *assetTest) get(t *testing.T, url string, token string, header http.Header) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, a.server.URL+"/"+url, nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	return resp, body
+}
+
+func testPayload(size int, seed byte) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i) ^ seed
+	}
+	return data
+}
+
+func TestAssetResumeWithRange(t *testing.T) {
+	a := newAssetTest(t)
+	device, token := newTestDevice(t, a.db, "frame1")
+	const name = "img-1_0.bin"
+	payload := testPayload(4096, 0x5a)
+	a.writeAsset(t, name, payload)
+	url, err := signAssetURL(device, "img-1", name)
+	if err != nil {
+		t.Fatalf("signAssetURL: %v", err)
+	}
+
+	resp, body := a.get(t, url, token, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("full download: status %d, want 200", resp.StatusCode)
+	}
+	if !bytes.Equal(body, payload) {
+		t.Fatalf("full download returned %d bytes, want the payload", len(body))
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("full download has no ETag")
+	}
+
+	// The connection dropped after 1000 bytes, continue from there
+	resp, body = a.get(t, url, token, http.Header{
+		"Range":    {"bytes=1000-"},
+		"If-Range": {etag},
+	})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("resume: status %d, want 206", resp.StatusCode)
+	}
+	if got, want := resp.Header.Get("Content-Range"), "bytes 1000-4095/4096"; got != want {
+		t.Errorf("resume: Content-Range %q, want %q", got, want)
+	}
+	if !bytes.Equal(body, payload[1000:]) {
+		t.Errorf("resume returned %d bytes, want the last %d of the payload", len(body), len(payload)-1000)
+	}
+}
+
+func TestAssetResumeAfterChangeSendsFullFile(t *testing.T) {
+	a := newAssetTest(t)
+	device, token := newTestDevice(t, a.db, "frame1")
+	const name = "img-1_0.bin"
+	a.writeAsset(t, name, testPayload(4096, 0x5a))
+	url, err := signAssetURL(device, "img-1", name)
+	if err != nil {
+		t.Fatalf("signAssetURL: %v", err)
+	}
+	resp, _ := a.get(t, url, token, nil)
+	oldETag := resp.Header.Get("ETag")
+
+	// The payload was rendered again between the two attempts
+	changed := testPayload(4096, 0xa5)
+	a.writeAsset(t, name, changed)
+
+	resp, body := a.get(t, url, token, http.Header{
+		"Range":    {"bytes=1000-"},
+		"If-Range": {oldETag},
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("stale resume: status %d, want 200", resp.StatusCode)
+	}
+	if !bytes.Equal(body, changed) {
+		t.Errorf("stale resume returned %d bytes, want the full new payload", len(body))
+	}
+	if resp.Header.Get("ETag") == oldETag {
+		t.Error("ETag did not change with the content")
+	}
+}
+
+func TestAssetIfNoneMatch(t *testing.T) {
+	a := newAssetTest(t)
+	device, token := newTestDevice(t, a.db, "frame1")
+	const name = "img-1_0.bin"
+	a.writeAsset(t, name, testPayload(512, 0x01))
+	url, err := signAssetURL(device, "img-1", name)
+	if err != nil {
+		t.Fatalf("signAssetURL: %v", err)
+	}
+	resp, _ := a.get(t, url, token, nil)
+	etag := resp.Header.Get("ETag")
+
+	resp, body := a.get(t, url, token, http.Header{"If-None-Match": {etag}})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("status %d, want 304", resp.StatusCode)
+	}
+	if len(body) != 0 {
+		t.Errorf("304 response has a %d byte body", len(body))
+	}
+
+	resp, _ = a.get(t, url, token, http.Header{"If-None-Match": {`"other"`}})
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("mismatching ETag: status %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestAssetAccessDenied(t *testing.T) {
+	a := newAssetTest(t)
+	device, token := newTestDevice(t, a.db, "frame1")
+	other, _ := newTestDevice(t, a.db, "frame2")
+	expired, expiredToken := newTestDevice(t, a.db, "frame3")
+	if err := a.db.Model(&expired).UpdateColumn("token_expires_at", time.Now().Add(-time.Minute)).Error; err != nil {
+		t.Fatalf("expire token: %v", err)
+	}
+
+	const name = "img-1_0.bin"
+	a.writeAsset(t, name, testPayload(256, 0x10))
+	if err := os.WriteFile(filepath.Join(filepath.Dir(a.cfg.CacheDir), "secret.bin"), []byte("secret"), 0o600); err != nil {
+		t.Fatalf("write secret: %v", err)
+	}
+
+	sign := func(device Device, imageUUID string, file string) string {
+		t.Helper()
+		url, err := signAssetURL(device, imageUUID, file)
+		if err != nil {
+			t.Fatalf("signAssetURL: %v", err)
+		}
+		return url
+	}
+	_, tokenQuery, _ := strings.Cut(sign(device, "img-1", name), "?")
+	_, otherQuery, _ := strings.Cut(sign(other, "img-1", name), "?")
+
+	claims := assetClaims{
+		DeviceID:  device.DeviceID,
+		ImageUUID: "img-1",
+		File:      name,
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(time.Now().Add(-time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute)),
+		},
+	}
+	expiredAsset, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(a.cfg.JWTMasterKey))
+	if err != nil {
+		t.Fatalf("sign expired token: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		url    string
+		token  string
+		status int
+	}{
+		{"path traversal", "assets/..%2fsecret.bin?" + tokenQuery, token, http.StatusForbidden},
+		{"backslash traversal", "assets/..%5csecret.bin?" + tokenQuery, token, http.StatusForbidden},
+		{"token for another file", "assets/img-1_1.bin?" + tokenQuery, token, http.StatusForbidden},
+		{"token of another device", "assets/" + name + "?" + otherQuery, token, http.StatusForbidden},
+		{"expired asset token", "assets/" + name + "?token=" + expiredAsset, token, http.StatusForbidden},
+		{"missing asset token", "assets/" + name, token, http.StatusForbidden},
+		{"unknown device token", sign(device, "img-1", name), "not-a-token", http.StatusUnauthorized},
+		{"expired device token", sign(expired, "img-1", name), expiredToken, http.StatusUnauthorized},
+		{"missing file", sign(device, "img-2", "img-2_0.bin"), token, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := a.get(t, tt.url, tt.token, nil)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if bytes.Contains(body, []byte("secret")) {
+				t.Error("response leaked a file outside the cache directory")
+			}
+		})
+	}
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// command is a subcommand of the server binary
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) int
+}
+
+// Subcommands, so administration can be scripted without the admin API.
+// Without a subcommand the server is started. Filled in init because the
+// commands print their own usage from this list.
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "serve", runServe},
+		{"migrate", "migrate up [version] | down [version] | status", runMigrateCommand},
+		{"device", "device add <device_id> [-name name] | list [-json] | remove <device_id> | rotate-token <device_id> | forget-pairing <device_id>", runDeviceCommand},
+		{"library", "library scan", runLibraryCommand},
+		{"cache", "cache prune [-dry-run] [-min-age duration]", runCacheCommand},
+		{"render", "render <image file or uuid> [-palette name] [-algo name] [-strength n] [-width n] [-height n] [-resize method] [-o file] [-payload] [-contact-sheet file] [-columns n]", runRenderCommand},
+		{"export", "export [-o file]", runExportCommand},
+		{"import", "import <file>", runImportCommand},
+		{"alert", "alert check | test", runAlertCommand},
+	}
+}
+
+// runCommand runs the subcommand named by args[0]. Returns the process exit
+// code.
+func runCommand(args []string) int {
+	if len(args) == 0 {
+		return runServe(nil)
+	}
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd.run(args[1:])
+		}
+	}
+	if args[0] != "help" && args[0] != "-h" && args[0] != "--help" {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", args[0])
+	}
+	fmt.Fprintln(os.Stderr, "usage:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %s\n", cmd.usage)
+	}
+	return 2
+}
+
+// commandUsage prints the usage line of a command and returns the exit code
+// for invalid arguments.
+func commandUsage(name string) int {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			fmt.Fprintf(os.Stderr, "usage: %s\n", cmd.usage)
+		}
+	}
+	return 2
+}
+
+// parseFlags parses the flags of a command, which may come before or after
+// its positional arguments ("render photo.jpg -palette 7Eink"). Returns the
+// positional arguments.
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// openCommandDB loads the configuration and opens the database for a
+// command. Unlike dbInit it leaves the dithered image cache alone, so it is
+// safe to use while the server is running.
+func openCommandDB() (*gorm.DB, error) {
+	cfg, err := loadConfig(configPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
+	applyConfig(cfg, nil)
+	db, err := dbOpen(config().Database)
+	if err != nil {
+		return nil, err
+	}
+	if err := dbPrepare(db, config().Database); err != nil {
+		dbClose(db)
+		return nil, err
+	}
+	return db, nil
+}
+
+// commandActor is the audit log identity of changes made from the command
+// line.
+func commandActor() AdminUser {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	return AdminUser{Username: "cli:" + name, Role: roleOwner}
+}
+
+// runMigrateCommand handles "migrate up [version]", "migrate down [version]"
+// and "migrate status". Without a version, up applies all pending migrations
+// and down rolls back the latest one. Returns the process exit code.
+func runMigrateCommand(args []string) int {
+	if len(args) < 1 || len(args) > 2 {
+		return commandUsage("migrate")
+	}
+
+	cfg, err := loadConfig(configPath())
+	if err != nil {
+		slog.Error("Failed to load configuration", "error", err)
+		return 1
+	}
+	applyConfig(cfg, nil)
+	db, err := dbOpen(config().Database)
+	if err != nil {
+		slog.Error("Failed to open database", "error", err)
+		return 1
+	}
+	defer dbClose(db)
+
+	var target int
+	if len(args) == 2 {
+		target, err = strconv.Atoi(args[1])
+		if err != nil || target < 0 {
+			fmt.Fprintf(os.Stderr, "invalid version: %s\n", args[1])
+			return 2
+		}
+	}
+
+	switch args[0] {
+	case "up":
+		if len(args) == 1 {
+			target = latestSchemaVersion()
+		}
+		err = migrateUp(db, target)
+	case "down":
+		if len(args) == 1 {
+			applied, err := appliedMigrations(db)
+			if err != nil {
+				slog.Error("Failed to read applied migrations", "error", err)
+				return 1
+			}
+			// Roll back only the newest applied migration
+			for version := range applied {
+				if version > target {
+					target = version
+				}
+			}
+			target--
+			if target < 0 {
+				target = 0
+			}
+		}
+		err = migrateDown(db, target)
+	case "status":
+		err = printMigrationStatus(db)
+	default:
+		return commandUsage("migrate")
+	}
+	if err != nil {
+		slog.Error("Migration failed", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// runDeviceCommand manages devices like the admin API does. Changes are
+// recorded in the audit log.
+func runDeviceCommand(args []string) int {
+	if len(args) == 0 {
+		return commandUsage("device")
+	}
+	fs := flag.NewFlagSet("device "+args[0], flag.ContinueOnError)
+	name := fs.String("name", "", "device name, defaults to the device_id")
+	asJSON := fs.Bool("json", false, "print the device list as JSON")
+	positional, err := parseFlags(fs, args[1:])
+	if err != nil {
+		return 2
+	}
+	switch args[0] {
+	case "list":
+		if len(positional) != 0 {
+			return commandUsage("device")
+		}
+	case "add", "remove", "rotate-token", "forget-pairing":
+		if len(positional) != 1 || positional[0] == "" {
+			return commandUsage("device")
+		}
+	default:
+		return commandUsage("device")
+	}
+
+	db, err := openCommandDB()
+	if err != nil {
+		slog.Error("Failed to open database", "error", err)
+		return 1
+	}
+	defer dbClose(db)
+
+	switch args[0] {
+	case "list":
+		err = listDevices(db, *asJSON)
+	case "add":
+		err = addDevice(db, positional[0], *name)
+	case "remove":
+		err = removeDevice(db, positional[0])
+	case "rotate-token":
+		var device Device
+		if err = db.Where("device_id = ?", positional[0]).First(&device).Error; err == nil {
+			ctx := withLogger(context.Background(), slog.Default().With("device_id", device.DeviceID))
+			err = rotateDeviceToken(ctx, db, &device)
+		}
+		if err == nil {
+			recordAudit(db, commandActor(), "device_rotate_token", "device", device.DeviceID, "reapproval_required")
+			fmt.Printf("Token and pairing of device %s revoked, it must be approved again through a new pairing code\n", device.DeviceID)
+		}
+	case "forget-pairing":
+		var device Device
+		if err = db.Where("device_id = ?", positional[0]).First(&device).Error; err == nil {
+			ctx := withLogger(context.Background(), slog.Default().With("device_id", device.DeviceID))
+			err = forgetDevicePairing(ctx, db, &device)
+		}
+		if err == nil {
+			recordAudit(db, commandActor(), "device_forget_pairing", "device", device.DeviceID, "reapproval_required")
+			fmt.Printf("Pairing of device %s forgotten, it must be approved again through a new pairing code\n", device.DeviceID)
+		}
+	}
+	if err != nil {
+		slog.Error("device "+args[0]+" failed", "error", err)
+		return 1
+	}
+	return 0
+}
+
+func listDevices(db *gorm.DB, asJSON bool) error {
+	var devices []Device
+	if err := db.Order("device_id").Find(&devices).Error; err != nil {
+		return fmt.Errorf("failed to fetch devices: %w", err)
+	}
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(devices)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE ID\tNAME\tCURRENT IMAGE\tTOKEN EXPIRES\tLAST UPDATE")
+	for _, device := range devices {
+		expires := "no token"
+		if device.DeviceTokenHash != "" {
+			expires = device.TokenExpiresAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", device.DeviceID, device.DeviceName, device.CurrentImage,
+			expires, device.UpdatedAt.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+// addDevice registers a device with default settings, so the frame can get a
+// token from /register with the same device_id and name.
+func addDevice(db *gorm.DB, deviceID string, name string) error {
+	if name == "" {
+		name = deviceID
+	}
+	device := Device{
+		DeviceID:   deviceID,
+		DeviceName: name,
+		CreatedAt:  time.Now(),
+		UpdatedAt:  time.Now(),
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&Device{}).Where("device_id = ?", deviceID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("device with device_id %s already exists", deviceID)
+		}
+		if err := tx.Create(&device).Error; err != nil {
+			return err
+		}
+		return tx.Create(&DeviceSetting{DeviceID: deviceID}).Error
+	})
+	if err != nil {
+		return err
+	}
+	recordAudit(db, commandActor(), "device_register", "device", device.DeviceID, "name="+device.DeviceName)
+	fmt.Printf("Device %s (%s) added\n", device.DeviceID, device.DeviceName)
+	return nil
+}
+
+// removeDevice deletes a device with its settings, telemetry and pairing
+// request. The frame has to be enrolled again to get back in.
+func removeDevice(db *gorm.DB, deviceID string) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("device_id = ?", deviceID).Delete(&Device{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("device %s not found", deviceID)
+		}
+		for _, model := range []interface{}{&DeviceSetting{}, &DeviceTelemetry{}, &PairingRequest{}, &DeviceSchedule{}, &DeviceCommand{}} {
+			if err := tx.Where("device_id = ?", deviceID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	recordAudit(db, commandActor(), "device_remove", "device", deviceID, "")
+	fmt.Printf("Device %s removed\n", deviceID)
+	return nil
+}
+
+// runLibraryCommand handles "library scan", which picks up added and removed
+// images without waiting for the next image_dir_refresh.
+func runLibraryCommand(args []string) int {
+	if len(args) != 1 || args[0] != "scan" {
+		return commandUsage("library")
+	}
+	db, err := openCommandDB()
+	if err != nil {
+		slog.Error("Failed to open database", "error", err)
+		return 1
+	}
+	defer dbClose(db)
+
+	if err := refreshImages(db); err != nil {
+		slog.Error("Failed to refresh images", "error", err)
+		return 1
+	}
+	if err := updateRandomList(db); err != nil {
+		slog.Error("Failed to update random image list", "error", err)
+		return 1
+	}
+	var count int64
+	db.Model(&DBImage{}).Count(&count)
+	fmt.Printf("Library contains %d images\n", count)
+	return 0
+}
+
+// Files the server writes to the cache directory, with the dithered image
+// UUID as first submatch. The cache directory may be shared (it defaults to
+// the user cache directory), so nothing else in it is touched.
+var cacheFilePattern = regexp.MustCompile(`^(?:dithered_([0-9a-f-]{36})\.png|([0-9a-f-]{36})_\d+\.bin)(?:\.tmp\d+)?$`)
+
+// runCacheCommand handles "cache prune", which deletes dithered images whose
+// files are gone and cached files neither a dithered image nor a recent
+// screen refers to anymore.
+func runCacheCommand(args []string) int {
+	if len(args) == 0 || args[0] != "prune" {
+		return commandUsage("cache")
+	}
+	fs := flag.NewFlagSet("cache prune", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "only list what would be deleted")
+	// Files are written before their database record, keep recent ones
+	minAge := fs.Duration("min-age", time.Hour, "keep unreferenced files younger than this")
+	if positional, err := parseFlags(fs, args[1:]); err != nil || len(positional) != 0 {
+		return 2
+	}
+
+	db, err := openCommandDB()
+	if err != nil {
+		slog.Error("Failed to open database", "error", err)
+		return 1
+	}
+	defer dbClose(db)
+
+	if err := pruneCache(db, config().CacheDir, *minAge, *dryRun); err != nil {
+		slog.Error("Cache prune failed", "error", err)
+		return 1
+	}
+	return 0
+}
+
+func pruneCache(db *gorm.DB, cacheDir string, minAge time.Duration, dryRun bool) error {
+	var ditheredImages []DitheredImage
+	if err := db.Find(&ditheredImages).Error; err != nil {
+		return fmt.Errorf("failed to fetch dithered images: %w", err)
+	}
+	referenced := make(map[string]bool, len(ditheredImages))
+	var staleRecords int
+	for _, dithered := range ditheredImages {
+		if _, err := os.Stat(dithered.Path); errors.Is(err, os.ErrNotExist) {
+			staleRecords++
+			fmt.Printf("Stale record: dithered image %s (%s missing)\n", dithered.UUID, dithered.Path)
+			if !dryRun {
+				if err := db.Delete(&dithered).Error; err != nil {
+					return fmt.Errorf("failed to delete dithered image %s: %w", dithered.UUID, err)
+				}
+			}
+			continue
+		}
+		referenced[dithered.UUID] = true
+	}
+	// Payloads of recent screens are kept to reconstruct them
+	recentScreens, err := recentScreenPayloads(db)
+	if err != nil {
+		return err
+	}
+	for _, uuid := range recentScreens {
+		referenced[uuid] = true
+	}
+
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return fmt.Errorf("failed to read cache directory: %w", err)
+	}
+	var removedFiles int
+	var freed int64
+	for _, entry := range entries {
+		match := cacheFilePattern.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		uuid := match[1] + match[2]
+		if referenced[uuid] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < minAge {
+			continue
+		}
+		path := filepath.Join(cacheDir, entry.Name())
+		fmt.Printf("Unreferenced file: %s\n", path)
+		if !dryRun {
+			if err := os.Remove(path); err != nil {
+				slog.Warn("Failed to delete unreferenced file", "path", path, "error", err)
+				continue
+			}
+		}
+		removedFiles++
+		freed += info.Size()
+	}
+
+	verb := "Deleted"
+	if dryRun {
+		verb = "Would delete"
+	}
+	fmt.Printf("%s %d stale records and %d files (%.1f MiB)\n", verb, staleRecords, removedFiles, float64(freed)/(1<<20))
+	return nil
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds all server settings. It is read from a YAML file, and every
+// setting can be overridden by an environment variable (also loaded from .env).
+type Config struct {
+	Server   ServerConfig   `yaml:"server"`
+	Database DatabaseConfig `yaml:"database"`
+	// Directory scanned for source images
+	ImageDir string `yaml:"image_dir"`
+	// Seconds between rescans of the image directory
+	ImageDirRefresh int `yaml:"image_dir_refresh"`
+	// Directory for dithered images and device payloads
+	CacheDir string `yaml:"cache_dir"`
+	// Bootstrap admin key with owner access, optional
+	AdminKey string `yaml:"admin_key"`
+	// Key used to sign asset URLs, random per run if empty
+	JWTMasterKey string `yaml:"jwt_master_key"`
+	// Lifetime of device bearer tokens in seconds
+	DeviceTokenTTL int `yaml:"device_token_ttl"`
+	// Days telemetry reports are kept as sent, older ones are merged into
+	// hourly averages
+	TelemetryRawDays int `yaml:"telemetry_raw_days"`
+	// Days hourly telemetry is kept, 0 keeps it forever
+	TelemetryRetentionDays int          `yaml:"telemetry_retention_days"`
+	Alerts                 AlertsConfig `yaml:"alerts"`
+	Log                    LogConfig    `yaml:"log"`
+}
+
+// ServerConfig holds listener settings, which only take effect on restart.
+type ServerConfig struct {
+	Listen string `yaml:"listen"`
+	// One of none, file or self_signed
+	TLSMode  string `yaml:"tls_mode"`
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// Where the self-signed CA and server certificate are kept
+	TLSDir string `yaml:"tls_dir"`
+	// Host names and IPs for the self-signed server certificate, all local
+	// addresses if empty
+	TLSHosts []string `yaml:"tls_hosts"`
+}
+
+// DatabaseConfig holds database settings, which only take effect on restart.
+type DatabaseConfig struct {
+	// sqlite or postgres
+	Driver string `yaml:"driver"`
+	// File path for sqlite, connection string for postgres
+	DSN string `yaml:"dsn"`
+	// Apply pending migrations on startup
+	AutoMigrate bool `yaml:"auto_migrate"`
+}
+
+// LogConfig holds logging settings, they apply on reload too.
+type LogConfig struct {
+	// debug, info, warn or error; debug includes every device authentication
+	Level string `yaml:"level"`
+	// text or json
+	Format string `yaml:"format"`
+}
+
+// AlertsConfig holds the conditions devices are checked for and where alerts
+// are sent.
+type AlertsConfig struct {
+	// Seconds between checks, 0 disables alerting
+	Interval int `yaml:"interval"`
+	// Battery level in percent below which a device alerts
+	BatteryThreshold int `yaml:"battery_threshold"`
+	// A device is offline after missing this many image updates
+	OfflineIntervals int `yaml:"offline_intervals"`
+	// Consecutive failed downloads reported by a device before it alerts
+	DownloadFailures int `yaml:"download_failures"`
+	// Where notifications are delivered, alerts are only listed in the admin
+	// API if empty
+	Sinks []AlertSinkConfig `yaml:"sinks"`
+}
+
+// AlertSinkConfig configures one notification destination. Which fields are
+// used depends on Type.
+type AlertSinkConfig struct {
+	// webhook, smtp, ntfy or gotify
+	Type string `yaml:"type"`
+	// Webhook URL, ntfy topic URL or Gotify server URL
+	URL string `yaml:"url"`
+	// ntfy access token or Gotify application token
+	Token string `yaml:"token"`
+	// SMTP server as host:port
+	SMTPServer string   `yaml:"smtp_server"`
+	Username   string   `yaml:"username"`
+	Password   string   `yaml:"password"`
+	From       string   `yaml:"from"`
+	To         []string `yaml:"to"`
+}
+
+// Supported database drivers
+const (
+	dbDriverSQLite   = "sqlite"
+	dbDriverPostgres = "postgres"
+)
+
+// Environment variables that override config file values
+var envOverrides = []struct {
+	name  string
+	apply func(cfg *Config, value string) error
+}{
+	{"LISTEN_ADDR", func(cfg *Config, v string) error { cfg.Server.Listen = v; return nil }},
+	{"TLS_MODE", func(cfg *Config, v string) error { cfg.Server.TLSMode = v; return nil }},
+	{"TLS_DIR", func(cfg *Config, v string) error { cfg.Server.TLSDir = v; return nil }},
+	{"TLS_HOSTS", func(cfg *Config, v string) error { cfg.Server.TLSHosts = splitList(v); return nil }},
+	{"TLS_CERT_FILE", func(cfg *Config, v string) error { cfg.Server.CertFile = v; return nil }},
+	{"TLS_KEY_FILE", func(cfg *Config, v string) error { cfg.Server.KeyFile = v; return nil }},
+	{"DB_DRIVER", func(cfg *Config, v string) error { cfg.Database.Driver = v; return nil }},
+	{"DB_DSN", func(cfg *Config, v string) error { cfg.Database.DSN = v; return nil }},
+	{"DB_AUTO_MIGRATE", func(cfg *Config, v string) (err error) { cfg.Database.AutoMigrate, err = strconv.ParseBool(v); return }},
+	{"IMAGE_DIR", func(cfg *Config, v string) error { cfg.ImageDir = v; return nil }},
+	{"IMAGE_DIR_REFRESH", func(cfg *Config, v string) (err error) { cfg.ImageDirRefresh, err = strconv.Atoi(v); return }},
+	{"CACHE_DIR", func(cfg *Config, v string) error { cfg.CacheDir = v; return nil }},
+	{"ADMIN_KEY", func(cfg *Config, v string) error { cfg.AdminKey = v; return nil }},
+	{"JWT_MASTER_KEY", func(cfg *Config, v string) error { cfg.JWTMasterKey = v; return nil }},
+	{"DEVICE_TOKEN_TTL", func(cfg *Config, v string) (err error) { cfg.DeviceTokenTTL, err = strconv.Atoi(v); return }},
+	{"TELEMETRY_RAW_DAYS", func(cfg *Config, v string) (err error) { cfg.TelemetryRawDays, err = strconv.Atoi(v); return }},
+	{"TELEMETRY_RETENTION_DAYS", func(cfg *Config, v string) (err error) { cfg.TelemetryRetentionDays, err = strconv.Atoi(v); return }},
+	{"ALERT_INTERVAL", func(cfg *Config, v string) (err error) { cfg.Alerts.Interval, err = strconv.Atoi(v); return }},
+	{"ALERT_BATTERY_THRESHOLD", func(cfg *Config, v string) (err error) { cfg.Alerts.BatteryThreshold, err = strconv.Atoi(v); return }},
+	{"ALERT_OFFLINE_INTERVALS", func(cfg *Config, v string) (err error) { cfg.Alerts.OfflineIntervals, err = strconv.Atoi(v); return }},
+	{"ALERT_DOWNLOAD_FAILURES", func(cfg *Config, v string) (err error) { cfg.Alerts.DownloadFailures, err = strconv.Atoi(v); return }},
+	{"LOG_LEVEL", func(cfg *Config, v string) error { cfg.Log.Level = v; return nil }},
+	{"LOG_FORMAT", func(cfg *Config, v string) error { cfg.Log.Format = v; return nil }},
+	{"ALERT_WEBHOOK_URL", func(cfg *Config, v string) error {
+		cfg.Alerts.Sinks = append(cfg.Alerts.Sinks, AlertSinkConfig{Type: alertSinkWebhook, URL: v})
+		return nil
+	}},
+}
+
+// splitList splits a comma separated value, trimming the entries and dropping
+// blank ones
+func splitList(value string) []string {
+	var entries []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+var currentConfig atomic.Pointer[Config]
+
+// config returns the active configuration. The returned value must not be
+// modified, a reload replaces it as a whole.
+func config() *Config {
+	return currentConfig.Load()
+}
+
+func defaultConfig() Config {
+	cacheDir, _ := os.UserCacheDir()
+	return Config{
+		Server: ServerConfig{
+			Listen:   ":8080",
+			TLSMode:  tlsModeFile,
+			CertFile: "cert.pem",
+			KeyFile:  "key.pem",
+			TLSDir:   "./tls",
+		},
+		Database: DatabaseConfig{
+			Driver:      dbDriverSQLite,
+			DSN:         "./db.db",
+			AutoMigrate: true,
+		},
+		ImageDir:               "./images",
+		ImageDirRefresh:        86400,
+		CacheDir:               cacheDir,
+		DeviceTokenTTL:         30 * 86400,
+		TelemetryRawDays:       7,
+		TelemetryRetentionDays: 365,
+		Alerts: AlertsConfig{
+			Interval:         300,
+			BatteryThreshold: 20,
+			OfflineIntervals: 3,
+			DownloadFailures: 3,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: logFormatText,
+		},
+	}
+}
+
+// configPath returns the config file location, set with CONFIG_FILE.
+func configPath() string {
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		return path
+	}
+	return "config.yaml"
+}
+
+// loadConfig reads defaults, the config file if present and environment
+// overrides, then validates the result.
+func loadConfig(path string) (*Config, error) {
+	if err := godotenv.Load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("Error loading .env file", "error", err)
+	}
+
+	cfg := defaultConfig()
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+		slog.Info("Loaded config file", "path", path)
+	} else if errors.Is(err, os.ErrNotExist) {
+		slog.Info("Config file not found, using defaults and environment", "path", path)
+	} else {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	for _, override := range envOverrides {
+		value, ok := os.LookupEnv(override.name)
+		if !ok || value == "" {
+			continue
+		}
+		if err := override.apply(&cfg, value); err != nil {
+			return nil, fmt.Errorf("environment variable %s: invalid value %q: %w", override.name, value, err)
+		}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// validate checks the configuration and prepares directories. All problems
+// are reported together.
+func (cfg *Config) validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(cfg.Server.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("server.listen: %q is not a host:port address: %w", cfg.Server.Listen, err))
+	}
+	switch cfg.Server.TLSMode {
+	case tlsModeNone:
+	case tlsModeFile:
+		if cfg.Server.CertFile == "" || cfg.Server.KeyFile == "" {
+			errs = append(errs, fmt.Errorf("server.cert_file and server.key_file are required with tls_mode %q", tlsModeFile))
+		} else {
+			for _, file := range []string{cfg.Server.CertFile, cfg.Server.KeyFile} {
+				if _, err := os.Stat(file); err != nil {
+					errs = append(errs, fmt.Errorf("server: TLS file: %w (use tls_mode %q to generate one)", err, tlsModeSelfSigned))
+				}
+			}
+		}
+	case tlsModeSelfSigned:
+		if cfg.Server.TLSDir == "" {
+			errs = append(errs, fmt.Errorf("server.tls_dir is required with tls_mode %q", tlsModeSelfSigned))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("server.tls_mode: %q is not one of %q, %q or %q", cfg.Server.TLSMode, tlsModeNone, tlsModeFile, tlsModeSelfSigned))
+	}
+	if cfg.Database.Driver != dbDriverSQLite && cfg.Database.Driver != dbDriverPostgres {
+		errs = append(errs, fmt.Errorf("database.driver: %q is not one of %q or %q", cfg.Database.Driver, dbDriverSQLite, dbDriverPostgres))
+	}
+	if cfg.Database.DSN == "" {
+		errs = append(errs, fmt.Errorf("database.dsn is required"))
+	}
+	if info, err := os.Stat(cfg.ImageDir); err != nil {
+		errs = append(errs, fmt.Errorf("image_dir: %w", err))
+	} else if !info.IsDir() {
+		errs = append(errs, fmt.Errorf("image_dir: %s is not a directory", cfg.ImageDir))
+	}
+	if cfg.ImageDirRefresh < 0 {
+		errs = append(errs, fmt.Errorf("image_dir_refresh: must not be negative, got %d", cfg.ImageDirRefresh))
+	}
+	if cfg.CacheDir == "" {
+		errs = append(errs, fmt.Errorf("cache_dir is required"))
+	} else if err := os.MkdirAll(cfg.CacheDir, 0o755); err != nil {
+		errs = append(errs, fmt.Errorf("cache_dir: %w", err))
+	}
+	if cfg.DeviceTokenTTL <= 0 {
+		errs = append(errs, fmt.Errorf("device_token_ttl: must be positive, got %d", cfg.DeviceTokenTTL))
+	}
+	if cfg.TelemetryRawDays <= 0 {
+		errs = append(errs, fmt.Errorf("telemetry_raw_days: must be positive, got %d", cfg.TelemetryRawDays))
+	}
+	if cfg.TelemetryRetentionDays < 0 {
+		errs = append(errs, fmt.Errorf("telemetry_retention_days: must not be negative, got %d", cfg.TelemetryRetentionDays))
+	} else if cfg.TelemetryRetentionDays > 0 && cfg.TelemetryRetentionDays < cfg.TelemetryRawDays {
+		errs = append(errs, fmt.Errorf("telemetry_retention_days: must be 0 or at least telemetry_raw_days (%d), got %d", cfg.TelemetryRawDays, cfg.TelemetryRetentionDays))
+	}
+	errs = append(errs, cfg.Alerts.validate()...)
+	if _, ok := logLevels[cfg.Log.Level]; !ok {
+		errs = append(errs, fmt.Errorf("log.level: %q is not one of debug, info, warn or error", cfg.Log.Level))
+	}
+	if cfg.Log.Format != logFormatText && cfg.Log.Format != logFormatJSON {
+		errs = append(errs, fmt.Errorf("log.format: %q is not one of %q or %q", cfg.Log.Format, logFormatText, logFormatJSON))
+	}
+	if cfg.JWTMasterKey != "" && len(cfg.JWTMasterKey) < 32 {
+		errs = append(errs, fmt.Errorf("jwt_master_key: must be at least 32 characters"))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+func (alerts *AlertsConfig) validate() []error {
+	var errs []error
+	if alerts.Interval < 0 {
+		errs = append(errs, fmt.Errorf("alerts.interval: must not be negative, got %d", alerts.Interval))
+	}
+	if alerts.BatteryThreshold < 0 || alerts.BatteryThreshold > 100 {
+		errs = append(errs, fmt.Errorf("alerts.battery_threshold: must be between 0 and 100, got %d", alerts.BatteryThreshold))
+	}
+	if alerts.OfflineIntervals <= 0 {
+		errs = append(errs, fmt.Errorf("alerts.offline_intervals: must be positive, got %d", alerts.OfflineIntervals))
+	}
+	if alerts.DownloadFailures <= 0 {
+		errs = append(errs, fmt.Errorf("alerts.download_failures: must be positive, got %d", alerts.DownloadFailures))
+	}
+	for i, sink := range alerts.Sinks {
+		if err := sink.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("alerts.sinks[%d]: %w", i, err))
+		}
+	}
+	return errs
+}
+
+func (sink *AlertSinkConfig) validate() error {
+	switch sink.Type {
+	case alertSinkWebhook, alertSinkNtfy, alertSinkGotify:
+		u, err := url.Parse(sink.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("url: %q is not an http(s) URL", sink.URL)
+		}
+		if sink.Type == alertSinkGotify && sink.Token == "" {
+			return fmt.Errorf("token is required for gotify")
+		}
+	case alertSinkSMTP:
+		if _, _, err := net.SplitHostPort(sink.SMTPServer); err != nil {
+			return fmt.Errorf("smtp_server: %q is not a host:port address: %w", sink.SMTPServer, err)
+		}
+		if sink.From == "" || len(sink.To) == 0 {
+			return fmt.Errorf("from and to are required for smtp")
+		}
+	default:
+		return fmt.Errorf("type: %q is not one of %q, %q, %q or %q", sink.Type, alertSinkWebhook, alertSinkSMTP, alertSinkNtfy, alertSinkGotify)
+	}
+	return nil
+}
+
+// applyConfig makes cfg the active configuration. previous is the config
+// being replaced, or nil on startup.
+func applyConfig(cfg *Config, previous *Config) {
+	configureLogging(cfg.Log)
+	if cfg.JWTMasterKey == "" {
+		if previous != nil && previous.JWTMasterKey != "" {
+			// Keep signed URLs valid across reloads
+			cfg.JWTMasterKey = previous.JWTMasterKey
+		} else {
+			slog.Warn("jwt_master_key not set, generating a random key (signed URLs will not survive a restart)")
+			key := make([]byte, 32)
+			if _, err := rand.Read(key); err != nil {
+				slog.Error("Failed to generate JWT master key", "error", err)
+				os.Exit(1)
+			}
+			cfg.JWTMasterKey = hex.EncodeToString(key)
+		}
+	}
+	if previous != nil {
+		// Listener and database settings are bound at startup
+		if !reflect.DeepEqual(cfg.Server, previous.Server) {
+			slog.Warn("Server settings changed, restart to apply them")
+			cfg.Server = previous.Server
+		}
+		if cfg.Database != previous.Database {
+			slog.Warn("Database settings changed, restart to apply them")
+			cfg.Database = previous.Database
+		}
+	}
+	if cfg.AdminKey != "" {
+		slog.Info("admin_key is set, it grants owner access to the admin API")
+	}
+	slog.Info("Using image directory", "path", cfg.ImageDir)
+	slog.Info("Using cache directory", "path", cfg.CacheDir)
+	currentConfig.Store(cfg)
+}
+
+// watchConfigReload reloads the configuration on SIGHUP until ctx is
+// cancelled. Invalid configurations are rejected and the running one is kept.
+func watchConfigReload(ctx context.Context, path string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-signals:
+			}
+			slog.Info("Received SIGHUP, reloading configuration")
+			cfg, err := loadConfig(path)
+			if err != nil {
+				slog.Error("Failed to reload configuration, keeping current one", "error", err)
+				continue
+			}
+			applyConfig(cfg, config())
+			slog.Info("Configuration reloaded")
+		}
+	}()
+}
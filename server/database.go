@@ -1,25 +1,64 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/rand"
 	"os"
 	"time"
 
+	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
-func dbInit() (*gorm.DB, error) {
-	db, err := gorm.Open(sqlite.Open("./db.db"), &gorm.Config{})
+// dbOpen connects to the configured database without touching the schema
+func dbOpen(cfg DatabaseConfig) (*gorm.DB, error) {
+	var dialector gorm.Dialector
+	switch cfg.Driver {
+	case dbDriverSQLite:
+		dialector = sqlite.Open(cfg.DSN)
+	case dbDriverPostgres:
+		dialector = postgres.Open(cfg.DSN)
+	default:
+		return nil, fmt.Errorf("unsupported database driver: %s", cfg.Driver)
+	}
+	db, err := gorm.Open(dialector, &gorm.Config{})
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
-	// Auto migrate schemas
-	err = db.AutoMigrate(&Device{}, &DeviceSetting{}, &DeviceTelemetry{}, &DBImage{}, &DitheredImage{}, &RandomImage{})
+	return db, nil
+}
+
+// dbPrepare brings the schema up to date if cfg.AutoMigrate is set, otherwise
+// it refuses to run against an old schema
+func dbPrepare(db *gorm.DB, cfg DatabaseConfig) error {
+	if cfg.AutoMigrate {
+		if err := migrateUp(db, latestSchemaVersion()); err != nil {
+			return fmt.Errorf("failed to migrate database schema: %w", err)
+		}
+		return nil
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; !ok {
+			return fmt.Errorf("database schema is out of date (migration %d %q pending), run the migrate up command", m.Version, m.Name)
+		}
+	}
+	return nil
+}
+
+func dbInit(cfg DatabaseConfig) (*gorm.DB, error) {
+	db, err := dbOpen(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to migrate database schema: %w", err)
+		return nil, err
+	}
+	if err := dbPrepare(db, cfg); err != nil {
+		return nil, err
 	}
 
 	// Clean DitheredImage table
@@ -30,10 +69,10 @@ func dbInit() (*gorm.DB, error) {
 	for _, dithered := range ditheredImages {
 		// Check if the dithered image file exists
 		if err := db.Delete(&dithered).Error; err != nil {
-			log.Printf("failed to delete dithered image %s from database: %v\n", dithered.Path, err)
+			slog.Error("Failed to delete dithered image from database", "path", dithered.Path, "error", err)
 			continue
 		}
-		log.Printf("Deleted dithered image: %s with UUID: %s (file no longer exists)\n", dithered.Path, dithered.UUID)
+		slog.Info("Deleted dithered image, file no longer exists", "path", dithered.Path, "dithered_uuid", dithered.UUID)
 	}
 
 	return db, nil
@@ -55,7 +94,7 @@ func dbClose(db *gorm.DB) error {
 	return nil
 }
 func refreshImages(db *gorm.DB) error {
-	imagePaths, err := generateFileList(imageDir, []string{".jpg", ".jpeg", ".png", ".bmp"})
+	imagePaths, err := generateFileList(config().ImageDir, []string{".jpg", ".jpeg", ".png", ".bmp"})
 	if err != nil {
 		return fmt.Errorf("failed to generate file list: %w", err)
 	}
@@ -76,14 +115,22 @@ func refreshImages(db *gorm.DB) error {
 		if !imagePathMap[img.Path] {
 			// File doesn't exist anymore, delete from database
 			if err := db.Delete(&img).Error; err != nil {
-				log.Printf("failed to delete non-existent image %s from database: %v\n", img.Path, err)
+				slog.Error("Failed to delete missing image from database", "path", img.Path, "error", err)
 				continue
 			}
 			// Also clean up any dithered versions
 			if err := db.Where("uuid = ?", img.UUID).Delete(&DitheredImage{}).Error; err != nil {
-				log.Printf("failed to delete dithered images for %s: %v\n", img.UUID, err)
+				slog.Error("Failed to delete dithered images", "image_uuid", img.UUID, "error", err)
+			}
+			if err := db.Where("image_uuid = ?", img.UUID).Delete(&PlaylistImage{}).Error; err != nil {
+				slog.Error("Failed to remove image from playlists", "image_uuid", img.UUID, "error", err)
+			}
+			err := db.Model(&Device{}).Where("pinned_image = ?", img.UUID).
+				UpdateColumns(map[string]interface{}{"pinned_image": "", "pinned_until": nil}).Error
+			if err != nil {
+				slog.Error("Failed to unpin image from devices", "image_uuid", img.UUID, "error", err)
 			}
-			log.Printf("Deleted image: %s with UUID: %s (file no longer exists)\n", img.Path, img.UUID)
+			slog.Info("Deleted image, file no longer exists", "path", img.Path, "image_uuid", img.UUID)
 		}
 	}
 
@@ -105,22 +152,22 @@ func refreshImages(db *gorm.DB) error {
 
 		result := db.Create(&image)
 		if result.Error != nil {
-			log.Printf("failed to insert image %s into database: %v\n", path, result.Error)
+			slog.Error("Failed to insert image into database", "path", path, "error", result.Error)
 			continue
 		}
-		fmt.Printf("Inserted image: %s with UUID: %s\n", path, uuid)
+		slog.Info("Inserted image", "path", path, "image_uuid", uuid)
 	}
 	return nil
 }
 
-func addDithered(db *gorm.DB, image DBImage, palette string, ditherAlgorithm string, ditherStrength float32, targetWidth int, targetHeight int, resizeMethod string) (DitheredImage, error) {
+func addDithered(ctx context.Context, db *gorm.DB, image DBImage, palette string, ditherAlgorithm string, ditherStrength float32, targetWidth int, targetHeight int, resizeMethod string) (DitheredImage, error) {
 	if db == nil {
 		return DitheredImage{}, fmt.Errorf("database connection is nil")
 	}
 	// Generate path for dithered image
 	uuid := generateUUID()
-	path := fmt.Sprintf("%s/dithered_%s.png", cacheDir, uuid)
-	img := fetchAndDither(image.Path, palette, ditherAlgorithm, ditherStrength, targetWidth, targetHeight, resizeMethod)
+	path := fmt.Sprintf("%s/dithered_%s.png", config().CacheDir, uuid)
+	img := fetchAndDither(ctx, image.Path, palette, ditherAlgorithm, ditherStrength, targetWidth, targetHeight, resizeMethod)
 	if img == nil {
 		return DitheredImage{}, fmt.Errorf("failed to dither image: %s", image.Path)
 	}
@@ -149,12 +196,12 @@ func addDithered(db *gorm.DB, image DBImage, palette string, ditherAlgorithm str
 		return DitheredImage{}, fmt.Errorf("failed to insert dithered image into database: %w", result.Error)
 	}
 
-	log.Printf("Inserted dithered image with UUID: %s\n", dithered.UUID)
+	loggerFrom(ctx).Info("Inserted dithered image", "dithered_uuid", dithered.UUID, "image_uuid", image.UUID)
 	return dithered, nil
 
 }
 
-func getDithered(db *gorm.DB, image DBImage, palette string, ditherAlgorithm string, ditherStrength float32, targetWidth int, targetHeight int, resizeMethod string) (DitheredImage, error) {
+func getDithered(ctx context.Context, db *gorm.DB, image DBImage, palette string, ditherAlgorithm string, ditherStrength float32, targetWidth int, targetHeight int, resizeMethod string) (DitheredImage, error) {
 	if db == nil {
 		return DitheredImage{}, fmt.Errorf("database connection is nil")
 	}
@@ -175,7 +222,9 @@ func getDithered(db *gorm.DB, image DBImage, palette string, ditherAlgorithm str
 	if result.Error != nil {
 		if result.Error == gorm.ErrRecordNotFound {
 			// Dithered image not found, create it
-			dithered, err := addDithered(db, image, palette, ditherAlgorithm, ditherStrength, targetWidth, targetHeight, resizeMethod)
+			ditheredCacheLookups.WithLabelValues("miss").Inc()
+			loggerFrom(ctx).Debug("Dithered image not cached, rendering", "image_uuid", image.UUID, "palette", palette, "algorithm", ditherAlgorithm)
+			dithered, err := addDithered(ctx, db, image, palette, ditherAlgorithm, ditherStrength, targetWidth, targetHeight, resizeMethod)
 			if err != nil {
 				return DitheredImage{}, fmt.Errorf("failed to create dithered image: %w", err)
 			}
@@ -185,6 +234,8 @@ func getDithered(db *gorm.DB, image DBImage, palette string, ditherAlgorithm str
 		return DitheredImage{}, fmt.Errorf("failed to query dithered image: %w", result.Error)
 	}
 	// return found dithered image
+	ditheredCacheLookups.WithLabelValues("hit").Inc()
+	loggerFrom(ctx).Debug("Using cached dithered image", "dithered_uuid", dithered.UUID)
 	return dithered, nil
 }
 
@@ -207,11 +258,11 @@ func removeDithered(db *gorm.DB, uuid string, palette string, ditherAlgorithm st
 
 	// Delete the image file from cache
 	if err := os.Remove(dithered.Path); err != nil {
-		log.Printf("Warning: Failed to delete cached file %s: %v", dithered.Path, err)
+		slog.Warn("Failed to delete cached file", "path", dithered.Path, "error", err)
 		// Continue anyway as the database record is deleted
 	}
 
-	log.Printf("Deleted dithered image with UUID: %s\n", uuid)
+	slog.Info("Deleted dithered image", "dithered_uuid", uuid)
 	return nil
 }
 
@@ -239,7 +290,7 @@ func createRandomList(db *gorm.DB) error {
 		db.Create(&RandomImage{UUID: img.UUID})
 	}
 
-	log.Println("Random images table created and populated with shuffled UUIDs from images table.")
+	slog.Info("Random images table created and populated with shuffled UUIDs from images table")
 	return nil
 }
 
@@ -259,7 +310,7 @@ func updateRandomList(db *gorm.DB) error {
 			if err := db.Delete(&RandomImage{}, randomImage.ID).Error; err != nil {
 				return fmt.Errorf("failed to delete random image %s: %w", randomImage.UUID, err)
 			}
-			log.Printf("Deleted random image with UUID: %s\n", randomImage.UUID)
+			slog.Debug("Deleted random image", "image_uuid", randomImage.UUID)
 		}
 	}
 	// Now check if we need to add new random images
@@ -309,11 +360,11 @@ func updateRandomList(db *gorm.DB) error {
 				return fmt.Errorf("failed to insert random image %s at position %d: %w", img.UUID, position, err)
 			}
 
-			log.Printf("Inserted random image with UUID: %s at position %d\n", img.UUID, position)
+			slog.Debug("Inserted random image", "image_uuid", img.UUID, "position", position)
 			randomCount++ // Update the count for next iteration
 		}
 	}
-	log.Println("Random images list updated.")
+	slog.Info("Random images list updated")
 	return nil
 }
 func getNextRandom(db *gorm.DB, device Device) (DBImage, error) {
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Kinds of device commands
+const (
+	commandShowImage   = "show_image"   // show ImageUUID now
+	commandRefresh     = "refresh"      // show the next image now
+	commandClearScreen = "clear_screen" // blank the panel
+	commandSetInterval = "set_interval" // applied by the server, see pendingCommands
+	commandReboot      = "reboot"
+	commandReRegister  = "re_register" // drop the token and register again
+)
+
+var commandKinds = []string{commandShowImage, commandRefresh, commandClearScreen, commandSetInterval, commandReboot, commandReRegister}
+
+// Command states, pending and delivered ones are sent with every response
+const (
+	commandPending      = "pending"
+	commandDelivered    = "delivered"
+	commandAcknowledged = "acknowledged"
+	commandFailed       = "failed"
+	commandCancelled    = "cancelled"
+)
+
+// A command not acknowledged after this many deliveries fails, so a frame
+// that cannot run it is not told again forever
+const maxCommandDeliveries = 3
+
+// A frame sends several requests per wake. Requests within this long of a
+// delivery belong to the same wake and do not count as another delivery.
+const commandDeliveryWindow = 5 * time.Minute
+
+// deliveredCommand is a command as sent to a device
+type deliveredCommand struct {
+	ID        uint   `json:"id"`
+	Kind      string `json:"kind"`
+	ImageUUID string `json:"image_uuid,omitempty"`
+}
+
+// newDelivery reports whether sending a command at now counts as another
+// delivery, rather than a repeat within the wake it was last delivered in
+func newDelivery(command DeviceCommand, now time.Time) bool {
+	return command.DeliveredAt == nil || now.Sub(*command.DeliveredAt) >= commandDeliveryWindow
+}
+
+// pendingCommands returns the open commands to send to a device with the
+// response to its current request. set_interval is applied to the settings
+// here, before the request is handled, and needs no acknowledgement. A
+// command delivered maxCommandDeliveries times without an ack fails.
+// markCommandsDelivered records the delivery once the response is written.
+func pendingCommands(db *gorm.DB, device Device) ([]deliveredCommand, error) {
+	var pending []deliveredCommand
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var commands []DeviceCommand
+		err := tx.Where("device_id = ? AND status IN ?", device.DeviceID, []string{commandPending, commandDelivered}).
+			Order("id").Find(&commands).Error
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, command := range commands {
+			switch {
+			case command.Kind == commandSetInterval:
+				var settings DeviceSetting
+				if err := tx.Where(&DeviceSetting{DeviceID: device.DeviceID}).First(&settings).Error; err != nil {
+					return err
+				}
+				// Set on the device, so it overrides the interval of its group
+				update := deviceSettingsUpdate{ImgUpdateInterval: &command.Seconds}
+				if err := trackOverrides(tx, &settings, update); err != nil {
+					return err
+				}
+				settings.ImgUpdateInterval = command.Seconds
+				settings.UpdatedAt = now
+				if err := tx.Save(&settings).Error; err != nil {
+					return err
+				}
+				err := tx.Model(&command).Updates(map[string]interface{}{
+					"status":       commandAcknowledged,
+					"result":       "applied by the server",
+					"completed_at": now,
+				}).Error
+				if err != nil {
+					return err
+				}
+			case command.Deliveries >= maxCommandDeliveries && newDelivery(command, now):
+				err := tx.Model(&command).Updates(map[string]interface{}{
+					"status":       commandFailed,
+					"result":       fmt.Sprintf("not acknowledged after %d deliveries", command.Deliveries),
+					"completed_at": now,
+				}).Error
+				if err != nil {
+					return err
+				}
+			default:
+				pending = append(pending, deliveredCommand{ID: command.ID, Kind: command.Kind, ImageUUID: command.ImageUUID})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch commands of device %s: %w", device.DeviceID, err)
+	}
+	return pending, nil
+}
+
+// markCommandsDelivered records that commands were sent in a successful
+// response. Only the first response of a wake counts as a delivery.
+func markCommandsDelivered(db *gorm.DB, device Device, commands []deliveredCommand) error {
+	ids := make([]uint, len(commands))
+	for i, command := range commands {
+		ids[i] = command.ID
+	}
+	now := time.Now()
+	err := db.Model(&DeviceCommand{}).
+		Where("device_id = ? AND id IN ? AND status IN ?", device.DeviceID, ids, []string{commandPending, commandDelivered}).
+		Where("delivered_at IS NULL OR delivered_at <= ?", now.Add(-commandDeliveryWindow)).
+		Updates(map[string]interface{}{
+			"status":       commandDelivered,
+			"deliveries":   gorm.Expr("deliveries + 1"),
+			"delivered_at": now,
+		}).Error
+	if err != nil {
+		return fmt.Errorf("failed to mark commands of device %s delivered: %w", device.DeviceID, err)
+	}
+	return nil
+}
+
+// commandAck is a device's report on a delivered command
+type commandAck struct {
+	ID     uint
+	Status string
+	Result string
+}
+
+// parseCommandAcks reads the acks a device sent in an ack_commands request
+func parseCommandAcks(requestData map[string]interface{}) ([]commandAck, error) {
+	entries, ok := requestData["commands"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("commands must be a list")
+	}
+	acks := make([]commandAck, 0, len(entries))
+	for _, entry := range entries {
+		fields, ok := entry.(map[string]interface{})
+		// JSON numbers are decoded as float64
+		id, idOK := fields["id"].(float64)
+		if !ok || !idOK || id <= 0 {
+			return nil, fmt.Errorf("every command needs an id")
+		}
+		ack := commandAck{ID: uint(id), Status: commandAcknowledged}
+		if status, ok := fields["status"].(string); ok {
+			ack.Status = status
+		}
+		if ack.Status != commandAcknowledged && ack.Status != commandFailed {
+			return nil, fmt.Errorf("status must be %s or %s", commandAcknowledged, commandFailed)
+		}
+		ack.Result, _ = fields["result"].(string)
+		acks = append(acks, ack)
+	}
+	return acks, nil
+}
+
+// acknowledgeCommands records the acks of a device and returns the number of
+// commands updated. An acknowledged re_register revokes the device token, the
+// device registers again for a new one.
+func acknowledgeCommands(ctx context.Context, db *gorm.DB, device *Device, acks []commandAck) (int, error) {
+	updated := 0
+	revoke := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		for _, ack := range acks {
+			var command DeviceCommand
+			result := tx.Where("id = ? AND device_id = ? AND status = ?", ack.ID, device.DeviceID, commandDelivered).Limit(1).Find(&command)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				// Unknown, cancelled or already acknowledged
+				continue
+			}
+			err := tx.Model(&command).Updates(map[string]interface{}{
+				"status":       ack.Status,
+				"result":       ack.Result,
+				"completed_at": now,
+			}).Error
+			if err != nil {
+				return err
+			}
+			updated++
+			revoke = revoke || (command.Kind == commandReRegister && ack.Status == commandAcknowledged)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to acknowledge commands of device %s: %w", device.DeviceID, err)
+	}
+	if revoke {
+		if err := revokeDeviceToken(ctx, db, device); err != nil {
+			return updated, err
+		}
+	}
+	return updated, nil
+}
+
+// commandImage returns the image of a show_image command a device received
+func commandImage(db *gorm.DB, device Device, commandID uint) (DBImage, error) {
+	var command DeviceCommand
+	err := db.Where("id = ? AND device_id = ? AND kind = ?", commandID, device.DeviceID, commandShowImage).
+		Where("status IN ?", []string{commandDelivered, commandAcknowledged}).First(&command).Error
+	if err != nil {
+		return DBImage{}, fmt.Errorf("show_image command %d not found: %w", commandID, err)
+	}
+	var image DBImage
+	if err := db.Where(&DBImage{UUID: command.ImageUUID}).First(&image).Error; err != nil {
+		return DBImage{}, fmt.Errorf("image %s of command %d not found: %w", command.ImageUUID, commandID, err)
+	}
+	return image, nil
+}
+
+func handleAdminDeviceCommandRequest(c *gin.Context, db *gorm.DB) {
+	// Queue a command for a device, or every device of group_id. It is
+	// delivered on the next request of the device.
+	admin, ok := requireAdmin(c, db, roleEditor)
+	if !ok {
+		return
+	}
+	var request struct {
+		DeviceID  string `json:"device_id"`
+		GroupID   uint   `json:"group_id"`
+		Kind      string `json:"kind"`
+		ImageUUID string `json:"image_uuid"`
+		Seconds   int    `json:"seconds"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse("Invalid JSON"))
+		return
+	}
+	if !slices.Contains(commandKinds, request.Kind) {
+		c.JSON(http.StatusBadRequest, errorResponse(fmt.Sprintf("kind must be one of %v", commandKinds)))
+		return
+	}
+	deviceIDs, err := targetDeviceIDs(db, []string{request.DeviceID}, request.GroupID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errorResponse(err.Error()))
+		return
+	}
+	devices, err := findDevices(db, deviceIDs)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errorResponse(err.Error()))
+		return
+	}
+	template := DeviceCommand{
+		Kind:      request.Kind,
+		Status:    commandPending,
+		CreatedBy: admin.Username,
+		CreatedAt: time.Now(),
+	}
+	details := "kind=" + template.Kind
+	switch template.Kind {
+	case commandShowImage:
+		var count int64
+		db.Model(&DBImage{}).Where("uuid = ?", request.ImageUUID).Count(&count)
+		if count == 0 {
+			c.JSON(http.StatusBadRequest, errorResponse("image_uuid is not a library image"))
+			return
+		}
+		template.ImageUUID = request.ImageUUID
+		details += " image=" + template.ImageUUID
+	case commandSetInterval:
+		if request.Seconds <= 0 {
+			c.JSON(http.StatusBadRequest, errorResponse("seconds must be positive"))
+			return
+		}
+		template.Seconds = request.Seconds
+		details += " seconds=" + strconv.Itoa(template.Seconds)
+	}
+	commands := make([]DeviceCommand, len(devices))
+	for i, device := range devices {
+		commands[i] = template
+		commands[i].DeviceID = device.DeviceID
+	}
+	if err := db.Create(&commands).Error; err != nil {
+		requestLogger(c).Error("Error queueing command", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	for _, command := range commands {
+		recordAudit(db, admin, "device_command", "device", command.DeviceID, details)
+	}
+	data := map[string]interface{}{
+		"message": "Command queued, the device receives it on its next request",
+	}
+	if request.GroupID == 0 {
+		data["command"] = commands[0]
+	} else {
+		data["commands"] = commands
+	}
+	c.JSON(http.StatusOK, successResponse(data))
+}
+
+func handleAdminDeviceCommandListRequest(c *gin.Context, db *gorm.DB) {
+	// Commands of a device newest first, only open ones unless state=all
+	if _, ok := requireAdmin(c, db, roleViewer); !ok {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	query := db.Where("device_id = ?", c.Param("id")).Order("id DESC").Limit(limit)
+	switch c.DefaultQuery("state", "open") {
+	case "open":
+		query = query.Where("status IN ?", []string{commandPending, commandDelivered})
+	case "all":
+	default:
+		c.JSON(http.StatusBadRequest, errorResponse("state must be open or all"))
+		return
+	}
+	var commands []DeviceCommand
+	if err := query.Find(&commands).Error; err != nil {
+		requestLogger(c).Error("Error fetching commands", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"commands": commands,
+	}))
+}
+
+func handleAdminDeviceCommandCancelRequest(c *gin.Context, db *gorm.DB) {
+	// Cancel a command the device has not acknowledged yet
+	admin, ok := requireAdmin(c, db, roleEditor)
+	if !ok {
+		return
+	}
+	var request struct {
+		ID uint `json:"id"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse("Invalid JSON"))
+		return
+	}
+	var command DeviceCommand
+	if err := db.First(&command, request.ID).Error; err != nil {
+		c.JSON(http.StatusNotFound, errorResponse("Command not found"))
+		return
+	}
+	status := command.Status
+	result := db.Model(&command).Where("status IN ?", []string{commandPending, commandDelivered}).
+		Updates(map[string]interface{}{"status": commandCancelled, "completed_at": time.Now()})
+	if result.Error != nil {
+		requestLogger(c).Error("Error cancelling command", "error", result.Error)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, errorResponse("Command is already "+status))
+		return
+	}
+	recordAudit(db, admin, "device_command_cancel", "device", command.DeviceID, fmt.Sprintf("id=%d kind=%s", command.ID, command.Kind))
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"message": "Command cancelled",
+		"id":      command.ID,
+	}))
+}
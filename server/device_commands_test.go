@@ -0,0 +1,230 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// queueCommand queues a command for a device with the admin key and returns
+// its ID.
+func queueCommand(t *testing.T, server *httptest.Server, deviceID string, kind string, fields map[string]interface{}) uint {
+	t.Helper()
+	body := map[string]interface{}{"device_id": deviceID, "kind": kind}
+	for name, value := range fields {
+		body[name] = value
+	}
+	status, response := postJSON(t, server, "/admin/device_command", testAdminKey, body)
+	if status != http.StatusOK {
+		t.Fatalf("queue %s: status %d: %+v", kind, status, response)
+	}
+	command, _ := responseData(t, response)["command"].(map[string]interface{})
+	id, _ := command["ID"].(float64)
+	if id == 0 {
+		t.Fatalf("queue %s: no command ID in %+v", kind, response)
+	}
+	return uint(id)
+}
+
+// sentCommandIDs posts body to /dev and returns the IDs of the commands sent
+// along with the response.
+func sentCommandIDs(t *testing.T, server *httptest.Server, token string, body map[string]interface{}) []uint {
+	t.Helper()
+	status, response := postJSON(t, server, "/dev", token, body)
+	if status != http.StatusOK {
+		t.Fatalf("%v: status %d: %+v", body["action"], status, response)
+	}
+	entries, _ := responseData(t, response)["commands"].([]interface{})
+	ids := make([]uint, 0, len(entries))
+	for _, entry := range entries {
+		fields, _ := entry.(map[string]interface{})
+		id, _ := fields["id"].(float64)
+		ids = append(ids, uint(id))
+	}
+	return ids
+}
+
+// fetchCommand reads a command from the database
+func fetchCommand(t *testing.T, db *gorm.DB, id uint) DeviceCommand {
+	t.Helper()
+	var command DeviceCommand
+	if err := db.First(&command, id).Error; err != nil {
+		t.Fatalf("fetch command %d: %v", id, err)
+	}
+	return command
+}
+
+func TestCommandDeliveriesPerWake(t *testing.T) {
+	useTestConfig(t, nil)
+	db := newTestDB(t)
+	_, token := newTestDeviceWithSettings(t, db, "frame1")
+	server := newTestServer(t, db)
+	id := queueCommand(t, server, "frame1", commandReboot, nil)
+	getSettings := map[string]interface{}{"action": "get_settings"}
+	// Moves the last delivery back, as if the device slept past the window
+	nextWake := func() {
+		t.Helper()
+		delivered := time.Now().Add(-commandDeliveryWindow)
+		if err := db.Model(&DeviceCommand{}).Where("id = ?", id).Update("delivered_at", delivered).Error; err != nil {
+			t.Fatalf("move delivery back: %v", err)
+		}
+	}
+
+	for wake := 1; wake <= maxCommandDeliveries; wake++ {
+		if wake > 1 {
+			nextWake()
+		}
+		// Every request of a wake gets the command, only the first counts
+		for request := 0; request < 2; request++ {
+			if ids := sentCommandIDs(t, server, token, getSettings); len(ids) != 1 || ids[0] != id {
+				t.Fatalf("wake %d request %d: commands %v, want [%d]", wake, request+1, ids, id)
+			}
+		}
+		command := fetchCommand(t, db, id)
+		if command.Status != commandDelivered || command.Deliveries != wake {
+			t.Fatalf("wake %d: status %s after %d deliveries, want delivered after %d", wake, command.Status, command.Deliveries, wake)
+		}
+	}
+
+	nextWake()
+	if ids := sentCommandIDs(t, server, token, getSettings); len(ids) != 0 {
+		t.Errorf("after %d deliveries: commands %v, want none", maxCommandDeliveries, ids)
+	}
+	command := fetchCommand(t, db, id)
+	if command.Status != commandFailed || command.CompletedAt == nil {
+		t.Errorf("after %d deliveries: status %s, want failed", maxCommandDeliveries, command.Status)
+	}
+}
+
+func TestCommandAcks(t *testing.T) {
+	useTestConfig(t, nil)
+	db := newTestDB(t)
+	_, token := newTestDeviceWithSettings(t, db, "frame1")
+	newTestDevice(t, db, "frame2")
+	server := newTestServer(t, db)
+	reboot := queueCommand(t, server, "frame1", commandReboot, nil)
+	clearScreen := queueCommand(t, server, "frame1", commandClearScreen, nil)
+	other := queueCommand(t, server, "frame2", commandRefresh, nil)
+	if ids := sentCommandIDs(t, server, token, map[string]interface{}{"action": "get_settings"}); len(ids) != 2 {
+		t.Fatalf("get_settings: commands %v, want %d and %d", ids, reboot, clearScreen)
+	}
+	// A command queued after the delivery is pending and can not be acked yet
+	refresh := queueCommand(t, server, "frame1", commandRefresh, nil)
+
+	status, response := postJSON(t, server, "/dev", token, map[string]interface{}{
+		"action": "ack_commands",
+		"commands": []map[string]interface{}{
+			{"id": reboot},
+			{"id": clearScreen, "status": commandFailed, "result": "panel busy"},
+			{"id": other},
+			{"id": refresh},
+		},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("ack_commands: status %d: %+v", status, response)
+	}
+	data := responseData(t, response)
+	if data["acknowledged"] != float64(2) {
+		t.Errorf("ack_commands: acknowledged %v, want 2", data["acknowledged"])
+	}
+
+	wantStatus := map[uint]string{reboot: commandAcknowledged, clearScreen: commandFailed, other: commandPending, refresh: commandPending}
+	for id, want := range wantStatus {
+		if command := fetchCommand(t, db, id); command.Status != want {
+			t.Errorf("command %d: status %s, want %s", id, command.Status, want)
+		}
+	}
+	if command := fetchCommand(t, db, clearScreen); command.Result != "panel busy" {
+		t.Errorf("failed command: result %q, want the device's", command.Result)
+	}
+
+	// Acking again changes nothing
+	status, response = postJSON(t, server, "/dev", token, map[string]interface{}{
+		"action":   "ack_commands",
+		"commands": []map[string]interface{}{{"id": reboot, "status": commandFailed}},
+	})
+	if status != http.StatusOK || responseData(t, response)["acknowledged"] != float64(0) {
+		t.Errorf("repeated ack: status %d: %+v, want nothing acknowledged", status, response)
+	}
+
+	for _, commands := range []interface{}{
+		"reboot",
+		[]map[string]interface{}{{"status": commandAcknowledged}},
+		[]map[string]interface{}{{"id": reboot, "status": commandDelivered}},
+	} {
+		status, _ := postJSON(t, server, "/dev", token, map[string]interface{}{"action": "ack_commands", "commands": commands})
+		if status != http.StatusBadRequest {
+			t.Errorf("ack %v: status %d, want 400", commands, status)
+		}
+	}
+}
+
+func TestSetIntervalCommandIsAppliedByServer(t *testing.T) {
+	useTestConfig(t, nil)
+	db := newTestDB(t)
+	_, token := newTestDeviceWithSettings(t, db, "frame1")
+	group := DeviceGroup{Name: "hall", Settings: `{"img_update_interval":300,"rotation":90}`}
+	if err := db.Create(&group).Error; err != nil {
+		t.Fatalf("create group: %v", err)
+	}
+	if err := db.Model(&DeviceSetting{}).Where("device_id = ?", "frame1").Update("group_id", group.ID).Error; err != nil {
+		t.Fatalf("join group: %v", err)
+	}
+	server := newTestServer(t, db)
+	id := queueCommand(t, server, "frame1", commandSetInterval, map[string]interface{}{"seconds": 1200})
+
+	status, response := postJSON(t, server, "/dev", token, map[string]interface{}{"action": "get_settings"})
+	if status != http.StatusOK {
+		t.Fatalf("get_settings: status %d: %+v", status, response)
+	}
+	data := responseData(t, response)
+	if _, ok := data["commands"]; ok {
+		t.Errorf("get_settings: commands %v, want set_interval not sent to the device", data["commands"])
+	}
+	// Applied before the request is handled, so already in this response
+	settings, _ := data["settings"].(map[string]interface{})
+	if settings["ImgUpdateInterval"] != float64(1200) || settings["Rotation"] != float64(90) {
+		t.Errorf("get_settings: interval %v rotation %v, want 1200 and the group's 90", settings["ImgUpdateInterval"], settings["Rotation"])
+	}
+
+	command := fetchCommand(t, db, id)
+	if command.Status != commandAcknowledged || command.Deliveries != 0 {
+		t.Errorf("set_interval: status %s after %d deliveries, want acknowledged without delivery", command.Status, command.Deliveries)
+	}
+	var stored DeviceSetting
+	if err := db.Where("device_id = ?", "frame1").First(&stored).Error; err != nil {
+		t.Fatalf("fetch settings: %v", err)
+	}
+	if stored.ImgUpdateInterval != 1200 || stored.Overrides != "img_update_interval" {
+		t.Errorf("stored settings: interval %d overrides %q, want 1200 overriding the group", stored.ImgUpdateInterval, stored.Overrides)
+	}
+}
+
+func TestReRegisterCommandRevokesTokenOnAck(t *testing.T) {
+	useTestConfig(t, nil)
+	db := newTestDB(t)
+	_, token := newTestDeviceWithSettings(t, db, "frame1")
+	server := newTestServer(t, db)
+	id := queueCommand(t, server, "frame1", commandReRegister, nil)
+	getSettings := map[string]interface{}{"action": "get_settings"}
+
+	if ids := sentCommandIDs(t, server, token, getSettings); len(ids) != 1 || ids[0] != id {
+		t.Fatalf("get_settings: commands %v, want [%d]", ids, id)
+	}
+	// Delivered but not acknowledged, the token still works
+	sentCommandIDs(t, server, token, getSettings)
+
+	status, response := postJSON(t, server, "/dev", token, map[string]interface{}{
+		"action":   "ack_commands",
+		"commands": []map[string]interface{}{{"id": id}},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("ack_commands: status %d: %+v", status, response)
+	}
+	if status, _ := postJSON(t, server, "/dev", token, getSettings); status != http.StatusUnauthorized {
+		t.Errorf("token after the acknowledged re_register: status %d, want 401", status)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	// Time zones are embedded so schedules work without system tzdata
+	_ "time/tzdata"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Day names accepted in schedule windows, indexed by time.Weekday
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Most windows a device can have
+const maxScheduleWindows = 32
+
+// scheduleWindow is a parsed DeviceSchedule
+type scheduleWindow struct {
+	DeviceSchedule
+	days                   [7]bool
+	startHour, startMinute int
+	endHour, endMinute     int
+}
+
+// parseClock reads a time of day written as HH:MM
+func parseClock(value string) (hour int, minute int, err error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%q is not a time of day as HH:MM", value)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+func parseScheduleWindow(schedule DeviceSchedule) (scheduleWindow, error) {
+	window := scheduleWindow{DeviceSchedule: schedule}
+	var err error
+	if window.startHour, window.startMinute, err = parseClock(schedule.Start); err != nil {
+		return window, fmt.Errorf("start: %w", err)
+	}
+	if window.endHour, window.endMinute, err = parseClock(schedule.End); err != nil {
+		return window, fmt.Errorf("end: %w", err)
+	}
+	if schedule.Weekdays == "" {
+		window.days = [7]bool{true, true, true, true, true, true, true}
+		return window, nil
+	}
+	for _, day := range strings.Split(schedule.Weekdays, ",") {
+		index := slices.Index(weekdayNames, day)
+		if index < 0 {
+			return window, fmt.Errorf("weekdays: unknown day %q, use %s", day, strings.Join(weekdayNames, ", "))
+		}
+		window.days[index] = true
+	}
+	return window, nil
+}
+
+// occurrence returns the window starting on the day of t. It ends the next
+// day if End is not after Start.
+func (w scheduleWindow) occurrence(t time.Time) (start time.Time, end time.Time) {
+	year, month, day := t.Date()
+	start = time.Date(year, month, day, w.startHour, w.startMinute, 0, 0, t.Location())
+	end = time.Date(year, month, day, w.endHour, w.endMinute, 0, 0, t.Location())
+	if !end.After(start) {
+		end = time.Date(year, month, day+1, w.endHour, w.endMinute, 0, 0, t.Location())
+	}
+	return start, end
+}
+
+// deviceSchedule holds the windows of a device in its time zone
+type deviceSchedule struct {
+	location *time.Location
+	windows  []scheduleWindow
+}
+
+// loadDeviceSchedule reads the windows of the device settings belong to
+func loadDeviceSchedule(db *gorm.DB, settings DeviceSetting) (deviceSchedule, error) {
+	schedule := deviceSchedule{location: time.Local}
+	if settings.Timezone != "" {
+		location, err := time.LoadLocation(settings.Timezone)
+		if err != nil {
+			return schedule, fmt.Errorf("device %s: invalid timezone: %w", settings.DeviceID, err)
+		}
+		schedule.location = location
+	}
+	var rows []DeviceSchedule
+	if err := db.Where("device_id = ?", settings.DeviceID).Order("position").Find(&rows).Error; err != nil {
+		return schedule, fmt.Errorf("failed to fetch schedule of device %s: %w", settings.DeviceID, err)
+	}
+	for _, row := range rows {
+		window, err := parseScheduleWindow(row)
+		if err != nil {
+			return schedule, fmt.Errorf("device %s: schedule window %d: %w", settings.DeviceID, row.ID, err)
+		}
+		schedule.windows = append(schedule.windows, window)
+	}
+	return schedule, nil
+}
+
+// windowAt returns the window t falls into and when it started, nil if none
+func (s deviceSchedule) windowAt(t time.Time) (*scheduleWindow, time.Time) {
+	t = t.In(s.location)
+	for i := range s.windows {
+		window := &s.windows[i]
+		// A window matching t started today or, past midnight, yesterday
+		for _, offset := range []int{0, -1} {
+			day := t.AddDate(0, 0, offset)
+			if !window.days[day.Weekday()] {
+				continue
+			}
+			start, end := window.occurrence(day)
+			if !t.Before(start) && t.Before(end) {
+				return window, start
+			}
+		}
+	}
+	return nil, time.Time{}
+}
+
+// nextBoundary returns the first start or end of a window after t
+func (s deviceSchedule) nextBoundary(t time.Time) (time.Time, bool) {
+	t = t.In(s.location)
+	var next time.Time
+	for _, window := range s.windows {
+		for offset := -1; offset <= 7; offset++ {
+			day := t.AddDate(0, 0, offset)
+			if !window.days[day.Weekday()] {
+				continue
+			}
+			start, end := window.occurrence(day)
+			for _, boundary := range []time.Time{start, end} {
+				if boundary.After(t) && (next.IsZero() || boundary.Before(next)) {
+					next = boundary
+				}
+			}
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// skipQuiet moves t to the end of the quiet windows it falls into. Gives up
+// after a week of back to back windows, the device then checks again.
+func (s deviceSchedule) skipQuiet(t time.Time) time.Time {
+	limit := t.AddDate(0, 0, 7)
+	for t.Before(limit) {
+		window, start := s.windowAt(t)
+		if window == nil || !window.Quiet {
+			return t
+		}
+		_, t = window.occurrence(start)
+	}
+	return t
+}
+
+// playlistAt returns the playlist shown at t, nil for the whole library
+func (s deviceSchedule) playlistAt(settings DeviceSetting, t time.Time) *uint {
+	if window, _ := s.windowAt(t); window != nil && window.PlaylistID != nil {
+		return window.PlaylistID
+	}
+	return settings.PlaylistID
+}
+
+// quietAt reports whether t falls into a quiet window
+func (s deviceSchedule) quietAt(t time.Time) bool {
+	window, _ := s.windowAt(t)
+	return window != nil && window.Quiet
+}
+
+// scheduleWindowRequest is a window as sent by the admin API
+type scheduleWindowRequest struct {
+	Weekdays   []string `json:"weekdays"`
+	Start      string   `json:"start"`
+	End        string   `json:"end"`
+	Quiet      bool     `json:"quiet"`
+	PlaylistID *uint    `json:"playlist_id"`
+}
+
+// toSchedule validates a requested window and converts it to a row
+func (r scheduleWindowRequest) toSchedule(db *gorm.DB, deviceID string, position int) (DeviceSchedule, error) {
+	schedule := DeviceSchedule{
+		DeviceID:   deviceID,
+		Position:   position,
+		Weekdays:   strings.ToLower(strings.Join(r.Weekdays, ",")),
+		Start:      r.Start,
+		End:        r.End,
+		Quiet:      r.Quiet,
+		PlaylistID: r.PlaylistID,
+	}
+	if _, err := parseScheduleWindow(schedule); err != nil {
+		return schedule, err
+	}
+	if schedule.Quiet == (schedule.PlaylistID != nil) {
+		return schedule, fmt.Errorf("a window is either quiet or selects a playlist_id")
+	}
+	if err := playlistExists(db, schedule.PlaylistID); err != nil {
+		return schedule, err
+	}
+	return schedule, nil
+}
+
+func handleAdminDeviceScheduleRequest(c *gin.Context, db *gorm.DB) {
+	// Schedule windows of a device and what applies now
+	if _, ok := requireAdmin(c, db, roleViewer); !ok {
+		return
+	}
+	var settings DeviceSetting
+	result := db.Where(&DeviceSetting{DeviceID: c.Param("id")}).Limit(1).Find(&settings)
+	if result.Error != nil {
+		requestLogger(c).Error("Error fetching settings", "error", result.Error)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, errorResponse("Settings not found"))
+		return
+	}
+	settings, err := effectiveSettings(db, settings)
+	if err != nil {
+		requestLogger(c).Error("Error resolving settings", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	schedule, err := loadDeviceSchedule(db, settings)
+	if err != nil {
+		requestLogger(c).Error("Error loading schedule", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	now := time.Now()
+	windows := make([]DeviceSchedule, 0, len(schedule.windows))
+	for _, window := range schedule.windows {
+		windows = append(windows, window.DeviceSchedule)
+	}
+	var activeID *uint
+	if window, _ := schedule.windowAt(now); window != nil {
+		activeID = &window.ID
+	}
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"timezone":         schedule.location.String(),
+		"windows":          windows,
+		"active_window_id": activeID,
+		"quiet":            schedule.quietAt(now),
+		"playlist_id":      schedule.playlistAt(settings, now),
+	}))
+}
+
+func handleAdminDeviceScheduleUpdateRequest(c *gin.Context, db *gorm.DB) {
+	// Replace the schedule windows of a device, the first matching window
+	// applies
+	admin, ok := requireAdmin(c, db, roleEditor)
+	if !ok {
+		return
+	}
+	var request struct {
+		DeviceID string                  `json:"device_id"`
+		Windows  []scheduleWindowRequest `json:"windows"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse("Invalid JSON"))
+		return
+	}
+	if request.DeviceID == "" {
+		c.JSON(http.StatusBadRequest, errorResponse("device_id is required"))
+		return
+	}
+	if len(request.Windows) > maxScheduleWindows {
+		c.JSON(http.StatusBadRequest, errorResponse(fmt.Sprintf("at most %d windows are allowed", maxScheduleWindows)))
+		return
+	}
+	var count int64
+	if err := db.Model(&Device{}).Where("device_id = ?", request.DeviceID).Count(&count).Error; err != nil {
+		requestLogger(c).Error("Error checking device", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	if count == 0 {
+		c.JSON(http.StatusNotFound, errorResponse("Device not found"))
+		return
+	}
+	schedules := make([]DeviceSchedule, 0, len(request.Windows))
+	for i, window := range request.Windows {
+		schedule, err := window.toSchedule(db, request.DeviceID, i)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse(fmt.Sprintf("windows[%d]: %v", i, err)))
+			return
+		}
+		schedules = append(schedules, schedule)
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("device_id = ?", request.DeviceID).Delete(&DeviceSchedule{}).Error; err != nil {
+			return err
+		}
+		if len(schedules) == 0 {
+			return nil
+		}
+		return tx.Create(&schedules).Error
+	})
+	if err != nil {
+		requestLogger(c).Error("Error saving schedule", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	recordAudit(db, admin, "device_schedule", "device", request.DeviceID, fmt.Sprintf("windows=%d", len(schedules)))
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"message": "Schedule updated",
+		"windows": schedules,
+	}))
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// testLocation loads an IANA time zone
+func testLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("load %s: %v", name, err)
+	}
+	return location
+}
+
+// at returns the wall clock time value (2006-01-02 15:04) in location
+func at(t *testing.T, location *time.Location, value string) time.Time {
+	t.Helper()
+	parsed, err := time.ParseInLocation("2006-01-02 15:04", value, location)
+	if err != nil {
+		t.Fatalf("parse %q: %v", value, err)
+	}
+	return parsed
+}
+
+// testSchedule parses windows into a schedule in location, numbering their
+// IDs from 1 in order
+func testSchedule(t *testing.T, location *time.Location, windows ...DeviceSchedule) deviceSchedule {
+	t.Helper()
+	schedule := deviceSchedule{location: location}
+	for i, row := range windows {
+		row.ID = uint(i + 1)
+		row.Position = i
+		window, err := parseScheduleWindow(row)
+		if err != nil {
+			t.Fatalf("window %d: %v", i+1, err)
+		}
+		schedule.windows = append(schedule.windows, window)
+	}
+	return schedule
+}
+
+// windowID returns the ID of window, 0 for none
+func windowID(window *scheduleWindow) uint {
+	if window == nil {
+		return 0
+	}
+	return window.ID
+}
+
+func TestScheduleWindowOccurrence(t *testing.T) {
+	berlin := testLocation(t, "Europe/Berlin")
+	newYork := testLocation(t, "America/New_York")
+	tests := []struct {
+		name      string
+		window    DeviceSchedule
+		day       time.Time
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{
+			name:      "same day",
+			window:    DeviceSchedule{Start: "09:00", End: "17:00"},
+			day:       at(t, berlin, "2026-06-05 13:20"),
+			wantStart: at(t, berlin, "2026-06-05 09:00"),
+			wantEnd:   at(t, berlin, "2026-06-05 17:00"),
+		},
+		{
+			name:      "crosses midnight",
+			window:    DeviceSchedule{Start: "22:00", End: "06:00"},
+			day:       at(t, berlin, "2026-06-05 00:10"),
+			wantStart: at(t, berlin, "2026-06-05 22:00"),
+			wantEnd:   at(t, berlin, "2026-06-06 06:00"),
+		},
+		{
+			name:      "whole day",
+			window:    DeviceSchedule{Start: "08:00", End: "08:00"},
+			day:       at(t, newYork, "2026-06-05 20:00"),
+			wantStart: at(t, newYork, "2026-06-05 08:00"),
+			wantEnd:   at(t, newYork, "2026-06-06 08:00"),
+		},
+		{
+			name:      "spring forward",
+			window:    DeviceSchedule{Start: "01:00", End: "04:00"},
+			day:       at(t, berlin, "2026-03-29 12:00"),
+			wantStart: at(t, berlin, "2026-03-29 01:00"),
+			wantEnd:   at(t, berlin, "2026-03-29 04:00"),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule := testSchedule(t, test.day.Location(), test.window)
+			start, end := schedule.windows[0].occurrence(test.day)
+			if !start.Equal(test.wantStart) || !end.Equal(test.wantEnd) {
+				t.Errorf("occurrence = %v to %v, want %v to %v", start, end, test.wantStart, test.wantEnd)
+			}
+		})
+	}
+
+	// The hour skipped by daylight saving time is not part of the window
+	schedule := testSchedule(t, berlin, DeviceSchedule{Start: "01:00", End: "04:00"})
+	start, end := schedule.windows[0].occurrence(at(t, berlin, "2026-03-29 12:00"))
+	if end.Sub(start) != 2*time.Hour {
+		t.Errorf("window on the spring forward day lasts %v, want 2h", end.Sub(start))
+	}
+}
+
+func TestDeviceScheduleWindowAt(t *testing.T) {
+	berlin := testLocation(t, "Europe/Berlin")
+	// A quiet Friday night and a playlist every morning
+	schedule := testSchedule(t, berlin,
+		DeviceSchedule{Weekdays: "fri", Start: "22:00", End: "06:00", Quiet: true},
+		DeviceSchedule{Start: "09:00", End: "12:00", PlaylistID: new(uint)},
+	)
+	tests := []struct {
+		name      string
+		t         time.Time
+		wantID    uint
+		wantStart time.Time
+	}{
+		{"friday night", at(t, berlin, "2026-06-05 23:00"), 1, at(t, berlin, "2026-06-05 22:00")},
+		{"after midnight started the day before", at(t, berlin, "2026-06-06 03:00"), 1, at(t, berlin, "2026-06-05 22:00")},
+		{"after midnight not started the day before", at(t, berlin, "2026-06-05 03:00"), 0, time.Time{}},
+		{"saturday night", at(t, berlin, "2026-06-06 23:00"), 0, time.Time{}},
+		{"end is exclusive", at(t, berlin, "2026-06-06 06:00"), 0, time.Time{}},
+		{"morning", at(t, berlin, "2026-06-06 09:00"), 2, at(t, berlin, "2026-06-06 09:00")},
+		{"other time zone", time.Date(2026, 6, 5, 21, 30, 0, 0, time.UTC), 1, at(t, berlin, "2026-06-05 22:00")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			window, start := schedule.windowAt(test.t)
+			if windowID(window) != test.wantID || !start.Equal(test.wantStart) {
+				t.Errorf("windowAt = window %d from %v, want window %d from %v", windowID(window), start, test.wantID, test.wantStart)
+			}
+		})
+	}
+}
+
+func TestDeviceScheduleNextBoundary(t *testing.T) {
+	berlin := testLocation(t, "Europe/Berlin")
+	newYork := testLocation(t, "America/New_York")
+	schedule := testSchedule(t, berlin,
+		DeviceSchedule{Weekdays: "fri", Start: "22:00", End: "06:00", Quiet: true},
+		DeviceSchedule{Start: "09:00", End: "12:00", PlaylistID: new(uint)},
+	)
+	earlyMorning := testSchedule(t, newYork, DeviceSchedule{Start: "01:30", End: "03:30", Quiet: true})
+	tests := []struct {
+		name     string
+		schedule deviceSchedule
+		t        time.Time
+		want     time.Time
+	}{
+		{"next start", schedule, at(t, berlin, "2026-06-05 20:00"), at(t, berlin, "2026-06-05 22:00")},
+		{"end of a window started the day before", schedule, at(t, berlin, "2026-06-06 03:00"), at(t, berlin, "2026-06-06 06:00")},
+		{"start after an end", schedule, at(t, berlin, "2026-06-06 07:00"), at(t, berlin, "2026-06-06 09:00")},
+		{"next day", schedule, at(t, berlin, "2026-06-06 12:30"), at(t, berlin, "2026-06-07 09:00")},
+		{"on a boundary", schedule, at(t, berlin, "2026-06-06 09:00"), at(t, berlin, "2026-06-06 12:00")},
+		{"spring forward", earlyMorning, at(t, newYork, "2026-03-08 01:45"), at(t, newYork, "2026-03-08 03:30")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next, ok := test.schedule.nextBoundary(test.t)
+			if !ok || !next.Equal(test.want) {
+				t.Errorf("nextBoundary = %v, %t, want %v", next, ok, test.want)
+			}
+		})
+	}
+
+	// 01:45 EST to 03:30 EDT is 45 minutes
+	next, _ := earlyMorning.nextBoundary(at(t, newYork, "2026-03-08 01:45"))
+	if wait := next.Sub(at(t, newYork, "2026-03-08 01:45")); wait != 45*time.Minute {
+		t.Errorf("wait over spring forward = %v, want 45m", wait)
+	}
+	if next, ok := testSchedule(t, berlin).nextBoundary(at(t, berlin, "2026-06-05 20:00")); ok {
+		t.Errorf("nextBoundary without windows = %v, want none", next)
+	}
+}
+
+func TestDeviceScheduleSkipQuiet(t *testing.T) {
+	berlin := testLocation(t, "Europe/Berlin")
+	tests := []struct {
+		name    string
+		windows []DeviceSchedule
+		t       time.Time
+		want    time.Time
+	}{
+		{
+			name:    "outside windows",
+			windows: []DeviceSchedule{{Start: "22:00", End: "06:00", Quiet: true}},
+			t:       at(t, berlin, "2026-06-05 12:00"),
+			want:    at(t, berlin, "2026-06-05 12:00"),
+		},
+		{
+			name:    "playlist window",
+			windows: []DeviceSchedule{{Start: "09:00", End: "17:00", PlaylistID: new(uint)}},
+			t:       at(t, berlin, "2026-06-05 12:00"),
+			want:    at(t, berlin, "2026-06-05 12:00"),
+		},
+		{
+			name:    "crosses midnight",
+			windows: []DeviceSchedule{{Start: "22:00", End: "06:00", Quiet: true}},
+			t:       at(t, berlin, "2026-06-05 23:00"),
+			want:    at(t, berlin, "2026-06-06 06:00"),
+		},
+		{
+			name: "back to back",
+			windows: []DeviceSchedule{
+				{Start: "22:00", End: "06:00", Quiet: true},
+				{Start: "06:00", End: "07:30", Quiet: true},
+			},
+			t:    at(t, berlin, "2026-06-06 03:00"),
+			want: at(t, berlin, "2026-06-06 07:30"),
+		},
+		{
+			name:    "spring forward",
+			windows: []DeviceSchedule{{Start: "01:00", End: "05:00", Quiet: true}},
+			t:       at(t, berlin, "2026-03-29 01:30"),
+			want:    at(t, berlin, "2026-03-29 05:00"),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule := testSchedule(t, berlin, test.windows...)
+			if got := schedule.skipQuiet(test.t); !got.Equal(test.want) {
+				t.Errorf("skipQuiet = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	// Quiet all the time, skipQuiet gives up after a week
+	always := testSchedule(t, berlin, DeviceSchedule{Start: "00:00", End: "00:00", Quiet: true})
+	start := at(t, berlin, "2026-06-05 12:00")
+	got := always.skipQuiet(start)
+	if got.Before(start.AddDate(0, 0, 7)) || got.After(start.AddDate(0, 0, 8)) {
+		t.Errorf("skipQuiet of an always quiet schedule = %v, want a week after %v", got, start)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// deviceOverview is a device with the settings in effect and latest
+// telemetry, as shown on the dashboard
+type deviceOverview struct {
+	Device       Device         `json:"device"`
+	Settings     *DeviceSetting `json:"settings"`
+	Group        string         `json:"group,omitempty"`
+	LastSeen     *time.Time     `json:"last_seen"`
+	BatteryLevel *int           `json:"battery_level"`
+}
+
+func handleAdminDeviceListRequest(c *gin.Context, db *gorm.DB) {
+	if _, ok := requireAdmin(c, db, roleViewer); !ok {
+		return
+	}
+	var devices []Device
+	if err := db.Order("device_name").Find(&devices).Error; err != nil {
+		requestLogger(c).Error("Error fetching devices", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	settingsByDevice, err := effectiveSettingsByDevice(db)
+	if err != nil {
+		requestLogger(c).Error("Error fetching device settings", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	var groups []DeviceGroup
+	if err := db.Find(&groups).Error; err != nil {
+		requestLogger(c).Error("Error fetching groups", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	batteries, err := latestTelemetryByDevice(db, "battery_level")
+	if err != nil {
+		requestLogger(c).Error("Error fetching telemetry", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	groupNames := make(map[uint]string, len(groups))
+	for _, group := range groups {
+		groupNames[group.ID] = group.Name
+	}
+
+	overviews := make([]deviceOverview, 0, len(devices))
+	for _, device := range devices {
+		overview := deviceOverview{Device: device, LastSeen: device.LastSeenAt}
+		if s, ok := settingsByDevice[device.DeviceID]; ok {
+			overview.Settings = &s
+			if s.GroupID != nil {
+				overview.Group = groupNames[*s.GroupID]
+			}
+		}
+		if telemetry, ok := batteries[device.DeviceID]; ok {
+			overview.BatteryLevel = telemetry.BatteryLevel
+		}
+		overviews = append(overviews, overview)
+	}
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"devices": overviews,
+	}))
+}
+
+// deviceSettingsUpdate holds the settings an admin changes, fields left out
+// of the request keep their value
+type deviceSettingsUpdate struct {
+	DeviceID          string   `json:"device_id"`
+	ImgUpdateInterval *int     `json:"img_update_interval"`
+	Height            *int     `json:"height"`
+	Width             *int     `json:"width"`
+	Rotation          *int     `json:"rotation"`
+	Palette           *string  `json:"palette"`
+	DitherAlgorithm   *string  `json:"dither_algorithm"`
+	DitherStrength    *float32 `json:"dither_strength"`
+	ResizeMethod      *string  `json:"resize_method"`
+	OverlayCorner     *string  `json:"overlay_corner"`
+	OverlayBattery    *string  `json:"overlay_battery"`
+	OverlayTime       *bool    `json:"overlay_time"`
+	OverlayText       *string  `json:"overlay_text"`
+	Timezone          *string  `json:"timezone"`
+	// 0 shows the whole library
+	PlaylistID *uint `json:"playlist_id"`
+}
+
+// deviceSettingsUpdateFromRequest reads the settings a device changes in an
+// update_settings request. Its device_id is that of the token.
+func deviceSettingsUpdateFromRequest(requestData map[string]interface{}) (deviceSettingsUpdate, error) {
+	var update deviceSettingsUpdate
+	data, err := json.Marshal(requestData)
+	if err != nil {
+		return update, err
+	}
+	if err := json.Unmarshal(data, &update); err != nil {
+		return update, fmt.Errorf("invalid settings: %w", err)
+	}
+	update.DeviceID = ""
+	return update, nil
+}
+
+// apply copies the set fields to settings and validates the result. Returns
+// the names of the changed fields.
+func (u deviceSettingsUpdate) apply(settings *DeviceSetting) ([]string, error) {
+	var changed []string
+	if u.ImgUpdateInterval != nil {
+		settings.ImgUpdateInterval = *u.ImgUpdateInterval
+		changed = append(changed, "img_update_interval")
+	}
+	if u.Height != nil {
+		settings.Height = *u.Height
+		changed = append(changed, "height")
+	}
+	if u.Width != nil {
+		settings.Width = *u.Width
+		changed = append(changed, "width")
+	}
+	if u.Rotation != nil {
+		settings.Rotation = *u.Rotation
+		changed = append(changed, "rotation")
+	}
+	if u.Palette != nil {
+		settings.Palette = *u.Palette
+		changed = append(changed, "palette")
+	}
+	if u.DitherAlgorithm != nil {
+		settings.DitherAlgorithm = *u.DitherAlgorithm
+		changed = append(changed, "dither_algorithm")
+	}
+	if u.DitherStrength != nil {
+		settings.DitherStrength = *u.DitherStrength
+		changed = append(changed, "dither_strength")
+	}
+	if u.ResizeMethod != nil {
+		settings.ResizeMethod = *u.ResizeMethod
+		changed = append(changed, "resize_method")
+	}
+	if u.OverlayCorner != nil {
+		settings.OverlayCorner = *u.OverlayCorner
+		changed = append(changed, "overlay_corner")
+	}
+	if u.OverlayBattery != nil {
+		settings.OverlayBattery = *u.OverlayBattery
+		changed = append(changed, "overlay_battery")
+	}
+	if u.OverlayTime != nil {
+		settings.OverlayTime = *u.OverlayTime
+		changed = append(changed, "overlay_time")
+	}
+	if u.OverlayText != nil {
+		settings.OverlayText = *u.OverlayText
+		changed = append(changed, "overlay_text")
+	}
+	if u.Timezone != nil {
+		settings.Timezone = *u.Timezone
+		changed = append(changed, "timezone")
+	}
+	if u.PlaylistID != nil {
+		settings.PlaylistID = u.PlaylistID
+		if *u.PlaylistID == 0 {
+			settings.PlaylistID = nil
+		}
+		changed = append(changed, "playlist_id")
+	}
+
+	if settings.ImgUpdateInterval <= 0 {
+		return nil, fmt.Errorf("img_update_interval must be positive")
+	}
+	if settings.Width <= 0 || settings.Height <= 0 || (settings.Width*settings.Height)%8 != 0 {
+		return nil, fmt.Errorf("width and height must be positive and their product a multiple of 8")
+	}
+	if settings.Rotation < 0 {
+		return nil, fmt.Errorf("rotation must not be negative")
+	}
+	if settings.DitherStrength < 0 {
+		return nil, fmt.Errorf("dither_strength must not be negative")
+	}
+	if err := validateRenderSettings(settings.Palette, settings.DitherAlgorithm, settings.ResizeMethod); err != nil {
+		return nil, err
+	}
+	if err := validateOverlaySettings(settings.OverlayCorner, settings.OverlayBattery, settings.OverlayText); err != nil {
+		return nil, err
+	}
+	if _, err := time.LoadLocation(settings.Timezone); err != nil {
+		return nil, fmt.Errorf("timezone: %q is not an IANA time zone", settings.Timezone)
+	}
+	return changed, nil
+}
+
+func handleAdminDeviceSettingsRequest(c *gin.Context, db *gorm.DB) {
+	// Change the settings of a device, applied the next time it fetches an image
+	admin, ok := requireAdmin(c, db, roleEditor)
+	if !ok {
+		return
+	}
+	var update deviceSettingsUpdate
+	if err := c.ShouldBindJSON(&update); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse("Invalid JSON"))
+		return
+	}
+	if update.DeviceID == "" {
+		c.JSON(http.StatusBadRequest, errorResponse("device_id is required"))
+		return
+	}
+	var count int64
+	if err := db.Model(&Device{}).Where("device_id = ?", update.DeviceID).Count(&count).Error; err != nil {
+		requestLogger(c).Error("Error checking device", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	if count == 0 {
+		c.JSON(http.StatusNotFound, errorResponse("Device not found"))
+		return
+	}
+
+	var settings DeviceSetting
+	result := db.Where(&DeviceSetting{DeviceID: update.DeviceID}).Limit(1).Find(&settings)
+	if result.Error != nil {
+		requestLogger(c).Error("Error fetching settings", "error", result.Error)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	if result.RowsAffected == 0 {
+		// Start from the column defaults
+		settings = DeviceSetting{DeviceID: update.DeviceID}
+		if err := db.Create(&settings).Error; err != nil {
+			requestLogger(c).Error("Error creating settings", "error", err)
+			c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+			return
+		}
+	}
+	changed, err := update.apply(&settings)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(err.Error()))
+		return
+	}
+	if err := playlistExists(db, settings.PlaylistID); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(err.Error()))
+		return
+	}
+	if err := trackOverrides(db, &settings, update); err != nil {
+		requestLogger(c).Error("Error reading group", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	effective, err := effectiveSettings(db, settings)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(err.Error()))
+		return
+	}
+	settings.UpdatedAt = time.Now()
+	if err := db.Save(&settings).Error; err != nil {
+		requestLogger(c).Error("Error saving settings", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	recordAudit(db, admin, "device_settings", "device", update.DeviceID, strings.Join(changed, ","))
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"message":  "Settings updated successfully",
+		"settings": settings,
+		// What the device uses, with the defaults of its group applied
+		"effective_settings": effective,
+	}))
+	requestLogger(c).Info("Device settings updated", "device_id", update.DeviceID, "admin", admin.Username, "changed", strings.Join(changed, ","))
+}
+
+func handleAdminRenderOptionsRequest(c *gin.Context, db *gorm.DB) {
+	// Values accepted for palette, dither_algorithm, resize_method and the
+	// overlay settings
+	if _, ok := requireAdmin(c, db, roleViewer); !ok {
+		return
+	}
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"palettes":                  slices.Sorted(maps.Keys(palettes)),
+		"error_dither_algorithms":   slices.Sorted(maps.Keys(error_dither_algo)),
+		"ordered_dither_algorithms": slices.Sorted(maps.Keys(ordered_dither_algo)),
+		"resize_methods":            resizeMethods,
+		"overlay_corners":           overlayCorners,
+		"overlay_battery_modes":     overlayBatteryModes,
+	}))
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// What made a device show a new image
+const (
+	triggerTimer  = "timer"  // scheduled wake up
+	triggerTouch  = "touch"  // touch button on the frame
+	triggerManual = "manual" // requested by an admin
+)
+
+// displayTrigger returns the trigger a device reported in its request, or
+// fallback if it sent none or an unknown one.
+func displayTrigger(requestData map[string]interface{}, fallback string) string {
+	switch trigger, _ := requestData["trigger"].(string); trigger {
+	case triggerTimer, triggerTouch, triggerManual:
+		return trigger
+	}
+	return fallback
+}
+
+// recordDisplayEvent remembers that a device was sent an image.
+func recordDisplayEvent(db *gorm.DB, device Device, dithered DitheredImage, settings DeviceSetting, trigger string) error {
+	event := DisplayEvent{
+		DeviceID:     device.DeviceID,
+		ImageUUID:    dithered.DBImageUUID,
+		DitheredUUID: dithered.UUID,
+		Palette:      settings.Palette,
+		Width:        settings.Width,
+		Height:       settings.Height,
+		Trigger:      trigger,
+		ShownAt:      time.Now(),
+	}
+	if err := db.Create(&event).Error; err != nil {
+		return fmt.Errorf("failed to record display event of device %s: %w", device.DeviceID, err)
+	}
+	return nil
+}
+
+// recentScreenPayloads returns the dithered image UUIDs of the last
+// screenHistoryLength screens of every device.
+func recentScreenPayloads(db *gorm.DB) ([]string, error) {
+	var uuids []string
+	err := db.Raw(`SELECT dithered_uuid FROM (
+		SELECT dithered_uuid, ROW_NUMBER() OVER (PARTITION BY device_id ORDER BY id DESC) AS position
+		FROM display_events) AS recent
+		WHERE position <= ?`, screenHistoryLength).Scan(&uuids).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch recent screens: %w", err)
+	}
+	return uuids, nil
+}
+
+// queryDisplayEvents applies the limit and since query parameters shared by
+// the display event endpoints and writes the response.
+func queryDisplayEvents(c *gin.Context, query *gorm.DB) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	if since := c.Query("since"); since != "" {
+		sinceTime, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse("since must be an RFC 3339 time"))
+			return
+		}
+		query = query.Where("shown_at >= ?", sinceTime)
+	}
+	var events []DisplayEvent
+	if err := query.Order("id DESC").Limit(limit).Find(&events).Error; err != nil {
+		requestLogger(c).Error("Error fetching display events", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"events": events,
+	}))
+}
+
+func handleAdminDeviceDisplayEventsRequest(c *gin.Context, db *gorm.DB) {
+	// Images shown by a device, newest first
+	if _, ok := requireAdmin(c, db, roleViewer); !ok {
+		return
+	}
+	queryDisplayEvents(c, db.Where("device_id = ?", c.Param("id")))
+}
+
+func handleAdminImageDisplayEventsRequest(c *gin.Context, db *gorm.DB) {
+	// Where and when an image was shown, newest first
+	if _, ok := requireAdmin(c, db, roleViewer); !ok {
+		return
+	}
+	queryDisplayEvents(c, db.Where("image_uuid = ?", c.Param("uuid")))
+}
+
+// imageStats is how often and when a library image was last shown
+type imageStats struct {
+	UUID        string     `json:"uuid"`
+	Path        string     `json:"path"`
+	ShowCount   int64      `json:"show_count"`
+	LastEventID uint       `json:"-"`
+	LastShownAt *time.Time `json:"last_shown_at"`
+}
+
+// libraryImageStats returns show statistics of library images, optionally
+// for one device. order is "least_recent" (never shown images first, then
+// the longest ago) or "most_shown".
+func libraryImageStats(db *gorm.DB, deviceID string, order string, limit int, offset int) ([]imageStats, error) {
+	join := "LEFT JOIN display_events ON display_events.image_uuid = db_images.uuid"
+	var args []interface{}
+	if deviceID != "" {
+		join += " AND display_events.device_id = ?"
+		args = append(args, deviceID)
+	}
+	// Event IDs grow with time, comparing them avoids aggregating timestamps
+	// which SQLite returns as text
+	orderBy := "MAX(display_events.id) IS NOT NULL, MAX(display_events.id), db_images.path"
+	if order == "most_shown" {
+		orderBy = "COUNT(display_events.id) DESC, db_images.path"
+	}
+	var stats []imageStats
+	err := db.Table("db_images").
+		Select("db_images.uuid AS uuid, db_images.path AS path, COUNT(display_events.id) AS show_count, MAX(display_events.id) AS last_event_id").
+		Joins(join, args...).
+		Group("db_images.uuid, db_images.path").
+		Order(orderBy).
+		Limit(limit).Offset(offset).
+		Scan(&stats).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute image statistics: %w", err)
+	}
+
+	var eventIDs []uint
+	for _, s := range stats {
+		if s.LastEventID != 0 {
+			eventIDs = append(eventIDs, s.LastEventID)
+		}
+	}
+	if len(eventIDs) == 0 {
+		return stats, nil
+	}
+	var events []DisplayEvent
+	if err := db.Select("id", "shown_at").Where("id IN ?", eventIDs).Find(&events).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch display events: %w", err)
+	}
+	shownAt := make(map[uint]time.Time, len(events))
+	for _, event := range events {
+		shownAt[event.ID] = event.ShownAt
+	}
+	for i := range stats {
+		if t, ok := shownAt[stats[i].LastEventID]; ok {
+			stats[i].LastShownAt = &t
+		}
+	}
+	return stats, nil
+}
+
+func handleAdminImageStatsRequest(c *gin.Context, db *gorm.DB) {
+	// Show counts of library images, least recently shown first by default
+	if _, ok := requireAdmin(c, db, roleViewer); !ok {
+		return
+	}
+	order := c.DefaultQuery("order", "least_recent")
+	if order != "least_recent" && order != "most_shown" {
+		c.JSON(http.StatusBadRequest, errorResponse("order must be least_recent or most_shown"))
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	stats, err := libraryImageStats(db, c.Query("device_id"), order, limit, offset)
+	if err != nil {
+		requestLogger(c).Error("Error computing image statistics", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"images": stats,
+		"order":  order,
+	}))
+}
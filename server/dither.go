@@ -1,9 +1,10 @@
 package main
 
 import (
+	"context"
 	"image"
 	"image/color"
-	"log"
+	"time"
 
 	"github.com/makeworld-the-better-one/dither/v2"
 )
@@ -64,7 +65,30 @@ var ordered_dither_algo = map[string]dither.OrderedDitherMatrix{
     "Vertical5x3": dither.Vertical5x3,
 }
 
-func fetchAndDither(file string,selectedPalette string,selectedDitherAlgorithm string,ditherStrength float32,targetWidth int, targetHeight int,resizeMethod string)image.Image{
+// fetchAndDither loads and dithers an image file, logging through the logger
+// of ctx
+func fetchAndDither(ctx context.Context,file string,selectedPalette string,selectedDitherAlgorithm string,ditherStrength float32,targetWidth int, targetHeight int,resizeMethod string)image.Image{
+    logger := loggerFrom(ctx)
+    logger.Debug("Processing file", "path", file)
+    defer observeRender(time.Now(), false)
+    img, err := loadImage(file)
+    if err != nil {
+        logger.Error("Error loading image", "path", file, "error", err)
+        return nil
+    }
+    return ditherImage(img, selectedPalette, selectedDitherAlgorithm, ditherStrength, targetWidth, targetHeight, resizeMethod)
+}
+
+// ditherImage resizes an already loaded image and dithers it, so one source
+// can be rendered with several settings
+func ditherImage(img image.Image,selectedPalette string,selectedDitherAlgorithm string,ditherStrength float32,targetWidth int, targetHeight int,resizeMethod string)image.Image{
+    //resize the image to 800x480
+    img = resizeImage(img, targetWidth,targetHeight,"Lanczos", resizeMethod)
+    return ditherResized(img, selectedPalette, selectedDitherAlgorithm, ditherStrength)
+}
+
+// ditherResized dithers an image that already has the panel size
+func ditherResized(img image.Image,selectedPalette string,selectedDitherAlgorithm string,ditherStrength float32)image.Image{
 
     // Define default options
     if selectedPalette == "" {
@@ -87,15 +111,6 @@ func fetchAndDither(file string,selectedPalette string,selectedDitherAlgorithm s
         d.Mapper = dither.PixelMapperFromMatrix(ordered_dither_algo[selectedDitherAlgorithm],strength)
     }
 
-    log.Println("Processing file:", file)
-    img, err := loadImage(file)
-    if err != nil {
-        log.Println("Error loading image:", err)
-        return nil
-    }
-    //resize the image to 800x480
-    img = resizeImage(img, targetWidth,targetHeight,"Lanczos", resizeMethod)
-
     img = d.Dither(img)
     return img
 }
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Version of the export file format
+const exportVersion = 1
+
+// exportFile is the document written by "export" and read by "import". It
+// holds devices and their settings; tokens are not exported, so imported
+// frames register again.
+type exportFile struct {
+	Version    int              `json:"version"`
+	ExportedAt time.Time        `json:"exported_at"`
+	Devices    []exportedDevice `json:"devices"`
+}
+
+type exportedDevice struct {
+	DeviceID   string          `json:"device_id"`
+	DeviceName string          `json:"device_name"`
+	Settings   *exportSettings `json:"settings,omitempty"`
+}
+
+type exportSettings struct {
+	ImgUpdateInterval int     `json:"img_update_interval"`
+	Height            int     `json:"height"`
+	Width             int     `json:"width"`
+	Rotation          int     `json:"rotation"`
+	Palette           string  `json:"palette"`
+	DitherAlgorithm   string  `json:"dither_algorithm"`
+	DitherStrength    float32 `json:"dither_strength"`
+	ResizeMethod      string  `json:"resize_method"`
+	// Missing in files exported before overlays existed
+	OverlayCorner  string `json:"overlay_corner,omitempty"`
+	OverlayBattery string `json:"overlay_battery,omitempty"`
+	OverlayTime    bool   `json:"overlay_time,omitempty"`
+	OverlayText    string `json:"overlay_text,omitempty"`
+	// Playlists and schedules are not exported, they refer to library images
+	// of this server
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// runExportCommand writes all devices and their settings as JSON.
+func runExportCommand(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	output := fs.String("o", "", "output file, defaults to stdout")
+	if positional, err := parseFlags(fs, args); err != nil || len(positional) != 0 {
+		return commandUsage("export")
+	}
+
+	db, err := openCommandDB()
+	if err != nil {
+		slog.Error("Failed to open database", "error", err)
+		return 1
+	}
+	defer dbClose(db)
+
+	export, err := exportDevices(db)
+	if err != nil {
+		slog.Error("Export failed", "error", err)
+		return 1
+	}
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		slog.Error("Export failed", "error", err)
+		return 1
+	}
+	data = append(data, '\n')
+	if *output == "" {
+		os.Stdout.Write(data)
+		return 0
+	}
+	if err := os.WriteFile(*output, data, 0o600); err != nil {
+		slog.Error("Failed to write export file", "path", *output, "error", err)
+		return 1
+	}
+	slog.Info("Exported devices", "devices", len(export.Devices), "path", *output)
+	return 0
+}
+
+func exportDevices(db *gorm.DB) (exportFile, error) {
+	export := exportFile{Version: exportVersion, ExportedAt: time.Now()}
+	var devices []Device
+	if err := db.Order("device_id").Find(&devices).Error; err != nil {
+		return export, fmt.Errorf("failed to fetch devices: %w", err)
+	}
+	var settings []DeviceSetting
+	if err := db.Find(&settings).Error; err != nil {
+		return export, fmt.Errorf("failed to fetch device settings: %w", err)
+	}
+	settingsByDevice := make(map[string]DeviceSetting, len(settings))
+	for _, s := range settings {
+		settingsByDevice[s.DeviceID] = s
+	}
+	export.Devices = make([]exportedDevice, 0, len(devices))
+	for _, device := range devices {
+		entry := exportedDevice{DeviceID: device.DeviceID, DeviceName: device.DeviceName}
+		if s, ok := settingsByDevice[device.DeviceID]; ok {
+			entry.Settings = &exportSettings{
+				ImgUpdateInterval: s.ImgUpdateInterval,
+				Height:            s.Height,
+				Width:             s.Width,
+				Rotation:          s.Rotation,
+				Palette:           s.Palette,
+				DitherAlgorithm:   s.DitherAlgorithm,
+				DitherStrength:    s.DitherStrength,
+				ResizeMethod:      s.ResizeMethod,
+				OverlayCorner:     s.OverlayCorner,
+				OverlayBattery:    s.OverlayBattery,
+				OverlayTime:       s.OverlayTime,
+				OverlayText:       s.OverlayText,
+				Timezone:          s.Timezone,
+			}
+		}
+		export.Devices = append(export.Devices, entry)
+	}
+	return export, nil
+}
+
+// runImportCommand reads a file written by export. Missing devices are
+// created, existing ones get the exported name and settings.
+func runImportCommand(args []string) int {
+	if len(args) != 1 {
+		return commandUsage("import")
+	}
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		slog.Error("Failed to read export file", "error", err)
+		return 1
+	}
+	var export exportFile
+	if err := json.Unmarshal(data, &export); err != nil {
+		slog.Error("Invalid export file", "path", args[0], "error", err)
+		return 1
+	}
+	if export.Version != exportVersion {
+		slog.Error("Unsupported export file version", "version", export.Version)
+		return 1
+	}
+
+	db, err := openCommandDB()
+	if err != nil {
+		slog.Error("Failed to open database", "error", err)
+		return 1
+	}
+	defer dbClose(db)
+
+	created, updated, err := importDevices(db, export.Devices)
+	if err != nil {
+		slog.Error("Import failed, nothing was changed", "error", err)
+		return 1
+	}
+	recordAudit(db, commandActor(), "device_import", "device", "", fmt.Sprintf("file=%s created=%d updated=%d", args[0], created, updated))
+	fmt.Printf("Imported %d devices (%d created, %d updated)\n", created+updated, created, updated)
+	return 0
+}
+
+func importDevices(db *gorm.DB, devices []exportedDevice) (created int, updated int, err error) {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, entry := range devices {
+			if entry.DeviceID == "" || entry.DeviceName == "" {
+				return fmt.Errorf("device_id and device_name are required")
+			}
+			var device Device
+			result := tx.Where("device_id = ?", entry.DeviceID).Limit(1).Find(&device)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				device = Device{DeviceID: entry.DeviceID, DeviceName: entry.DeviceName, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+				if err := tx.Create(&device).Error; err != nil {
+					return err
+				}
+				created++
+			} else {
+				// UpdateColumn keeps UpdatedAt, which drives the image update timer
+				if err := tx.Model(&device).UpdateColumn("device_name", entry.DeviceName).Error; err != nil {
+					return err
+				}
+				updated++
+			}
+
+			var settings DeviceSetting
+			if err := tx.Where(&DeviceSetting{DeviceID: entry.DeviceID}).Limit(1).Find(&settings).Error; err != nil {
+				return err
+			}
+			settings.DeviceID = entry.DeviceID
+			if s := entry.Settings; s != nil {
+				if s.OverlayCorner == "" {
+					s.OverlayCorner = "off"
+				}
+				if s.OverlayBattery == "" {
+					s.OverlayBattery = "low"
+				}
+				if err := validateRenderSettings(s.Palette, s.DitherAlgorithm, s.ResizeMethod); err != nil {
+					return fmt.Errorf("device %s: %w", entry.DeviceID, err)
+				}
+				if err := validateOverlaySettings(s.OverlayCorner, s.OverlayBattery, s.OverlayText); err != nil {
+					return fmt.Errorf("device %s: %w", entry.DeviceID, err)
+				}
+				if _, err := time.LoadLocation(s.Timezone); err != nil {
+					return fmt.Errorf("device %s: timezone: %w", entry.DeviceID, err)
+				}
+				settings.ImgUpdateInterval = s.ImgUpdateInterval
+				settings.Height = s.Height
+				settings.Width = s.Width
+				settings.Rotation = s.Rotation
+				settings.Palette = s.Palette
+				settings.DitherAlgorithm = s.DitherAlgorithm
+				settings.DitherStrength = s.DitherStrength
+				settings.ResizeMethod = s.ResizeMethod
+				settings.OverlayCorner = s.OverlayCorner
+				settings.OverlayBattery = s.OverlayBattery
+				settings.OverlayTime = s.OverlayTime
+				settings.OverlayText = s.OverlayText
+				settings.Timezone = s.Timezone
+			}
+			if err := tx.Save(&settings).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return created, updated, err
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// groupSettings are the defaults of a group by setting name, as accepted by
+// device_settings. Values are decoded from JSON, so numbers are float64.
+type groupSettings map[string]interface{}
+
+// parseGroupSettings reads settings in the format of device_settings and
+// checks their types
+func parseGroupSettings(data []byte) (groupSettings, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var update deviceSettingsUpdate
+	if err := decoder.Decode(&update); err != nil {
+		return nil, fmt.Errorf("invalid settings: %w", err)
+	}
+	return update.values()
+}
+
+// values returns the settings an update sets, by name
+func (u deviceSettingsUpdate) values() (groupSettings, error) {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return nil, err
+	}
+	var values groupSettings
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	delete(values, "device_id")
+	maps.DeleteFunc(values, func(_ string, value interface{}) bool { return value == nil })
+	return values, nil
+}
+
+// settings returns the defaults of a group
+func (g DeviceGroup) settings() (groupSettings, error) {
+	values, err := parseGroupSettings([]byte(g.Settings))
+	if err != nil {
+		return nil, fmt.Errorf("group %d: %w", g.ID, err)
+	}
+	return values, nil
+}
+
+// settingOverrides returns the settings a device overrides in its group
+func settingOverrides(settings DeviceSetting) map[string]bool {
+	overrides := make(map[string]bool)
+	for _, name := range strings.Split(settings.Overrides, ",") {
+		if name != "" {
+			overrides[name] = true
+		}
+	}
+	return overrides
+}
+
+func setSettingOverrides(settings *DeviceSetting, overrides map[string]bool) {
+	var names []string
+	for name, set := range overrides {
+		if set {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	settings.Overrides = strings.Join(names, ",")
+}
+
+// resolveSettings returns the settings in effect for a device: its own,
+// with the defaults of its group for settings it does not override. The
+// result must not be saved.
+func resolveSettings(settings DeviceSetting, group *DeviceGroup) (DeviceSetting, error) {
+	if group == nil {
+		return settings, nil
+	}
+	defaults, err := group.settings()
+	if err != nil {
+		return settings, err
+	}
+	for name := range settingOverrides(settings) {
+		delete(defaults, name)
+	}
+	data, err := json.Marshal(defaults)
+	if err != nil {
+		return settings, err
+	}
+	var update deviceSettingsUpdate
+	if err := json.Unmarshal(data, &update); err != nil {
+		return settings, err
+	}
+	if _, err := update.apply(&settings); err != nil {
+		return settings, fmt.Errorf("group %s: %w", group.Name, err)
+	}
+	return settings, nil
+}
+
+// loadGroup returns the group of a device, nil if it has none
+func loadGroup(db *gorm.DB, settings DeviceSetting) (*DeviceGroup, error) {
+	if settings.GroupID == nil {
+		return nil, nil
+	}
+	var group DeviceGroup
+	if err := db.First(&group, *settings.GroupID).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch group of device %s: %w", settings.DeviceID, err)
+	}
+	return &group, nil
+}
+
+// effectiveSettings resolves the settings of a device against its group
+func effectiveSettings(db *gorm.DB, settings DeviceSetting) (DeviceSetting, error) {
+	group, err := loadGroup(db, settings)
+	if err != nil {
+		return settings, err
+	}
+	return resolveSettings(settings, group)
+}
+
+// effectiveSettingsByDevice resolves the settings of every device. A device
+// whose group cannot be applied keeps its own settings.
+func effectiveSettingsByDevice(db *gorm.DB) (map[string]DeviceSetting, error) {
+	var settings []DeviceSetting
+	if err := db.Find(&settings).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch device settings: %w", err)
+	}
+	var groups []DeviceGroup
+	if err := db.Find(&groups).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch groups: %w", err)
+	}
+	groupsByID := make(map[uint]*DeviceGroup, len(groups))
+	for i := range groups {
+		groupsByID[groups[i].ID] = &groups[i]
+	}
+	settingsByDevice := make(map[string]DeviceSetting, len(settings))
+	for _, s := range settings {
+		var group *DeviceGroup
+		if s.GroupID != nil {
+			group = groupsByID[*s.GroupID]
+		}
+		effective, err := resolveSettings(s, group)
+		if err != nil {
+			slog.Error("Error resolving settings", "device_id", s.DeviceID, "error", err)
+			effective = s
+		}
+		settingsByDevice[s.DeviceID] = effective
+	}
+	return settingsByDevice, nil
+}
+
+// trackOverrides records which settings an admin set on a device in a
+// group: those set to a value other than the group's. Settings set to the
+// group's value follow the group again, settings the group has no value
+// for are left as they are.
+func trackOverrides(db *gorm.DB, settings *DeviceSetting, update deviceSettingsUpdate) error {
+	group, err := loadGroup(db, *settings)
+	if err != nil || group == nil {
+		return err
+	}
+	defaults, err := group.settings()
+	if err != nil {
+		return err
+	}
+	values, err := update.values()
+	if err != nil {
+		return err
+	}
+	overrides := settingOverrides(*settings)
+	for name, value := range values {
+		if groupValue, ok := defaults[name]; ok {
+			overrides[name] = !reflect.DeepEqual(value, groupValue)
+		}
+	}
+	setSettingOverrides(settings, overrides)
+	return nil
+}
+
+// groupMemberIDs returns the devices of a group
+func groupMemberIDs(db *gorm.DB, groupID uint) ([]string, error) {
+	var deviceIDs []string
+	err := db.Model(&DeviceSetting{}).Where("group_id = ?", groupID).Order("device_id").Pluck("device_id", &deviceIDs).Error
+	return deviceIDs, err
+}
+
+// newDeviceSettings are the column defaults of DeviceSetting, the settings
+// a device starts with
+var newDeviceSettings = DeviceSetting{
+	ImgUpdateInterval: 600,
+	Height:            480,
+	Width:             800,
+	Palette:           "7Standard",
+	DitherAlgorithm:   "StevenPigeon",
+	DitherStrength:    1.0,
+	ResizeMethod:      "cut",
+	OverlayCorner:     "off",
+	OverlayBattery:    "low",
+}
+
+// checkGroupMembers validates the settings the devices of a group end up
+// with, members are the settings of the devices. A new device is checked
+// too, so the defaults of a group without devices are validated.
+func checkGroupMembers(group DeviceGroup, members []DeviceSetting) error {
+	if _, err := resolveSettings(newDeviceSettings, &group); err != nil {
+		return err
+	}
+	for _, member := range members {
+		member.GroupID = &group.ID
+		if _, err := resolveSettings(member, &group); err != nil {
+			return fmt.Errorf("device %s: %w", member.DeviceID, err)
+		}
+	}
+	return nil
+}
+
+// dropGroupPlaylist removes a deleted playlist from the group defaults
+func dropGroupPlaylist(tx *gorm.DB, playlistID uint) error {
+	var groups []DeviceGroup
+	if err := tx.Find(&groups).Error; err != nil {
+		return err
+	}
+	for _, group := range groups {
+		defaults, err := group.settings()
+		if err != nil {
+			return err
+		}
+		if defaults["playlist_id"] != float64(playlistID) {
+			continue
+		}
+		delete(defaults, "playlist_id")
+		data, err := json.Marshal(defaults)
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(&group).Update("settings", string(data)).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupSummary is a group as shown by the admin API
+type groupSummary struct {
+	ID        uint          `json:"id"`
+	Name      string        `json:"name"`
+	Settings  groupSettings `json:"settings"`
+	DeviceIDs []string      `json:"device_ids"`
+	UpdatedAt time.Time     `json:"updated_at"`
+}
+
+func newGroupSummary(db *gorm.DB, group DeviceGroup) (groupSummary, error) {
+	settings, err := group.settings()
+	if err != nil {
+		return groupSummary{}, err
+	}
+	deviceIDs, err := groupMemberIDs(db, group.ID)
+	if err != nil {
+		return groupSummary{}, err
+	}
+	return groupSummary{
+		ID:        group.ID,
+		Name:      group.Name,
+		Settings:  settings,
+		DeviceIDs: deviceIDs,
+		UpdatedAt: group.UpdatedAt,
+	}, nil
+}
+
+func handleAdminGroupListRequest(c *gin.Context, db *gorm.DB) {
+	// All groups with their defaults and devices
+	if _, ok := requireAdmin(c, db, roleViewer); !ok {
+		return
+	}
+	var groups []DeviceGroup
+	if err := db.Order("name").Find(&groups).Error; err != nil {
+		requestLogger(c).Error("Error fetching groups", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	summaries := make([]groupSummary, 0, len(groups))
+	for _, group := range groups {
+		summary, err := newGroupSummary(db, group)
+		if err != nil {
+			requestLogger(c).Error("Error reading group", "error", err)
+			c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+			return
+		}
+		summaries = append(summaries, summary)
+	}
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"groups": summaries,
+	}))
+}
+
+func handleAdminGroupRequest(c *gin.Context, db *gorm.DB) {
+	// One group with its defaults and devices
+	if _, ok := requireAdmin(c, db, roleViewer); !ok {
+		return
+	}
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse("Invalid group id"))
+		return
+	}
+	var group DeviceGroup
+	if err := db.First(&group, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, errorResponse("Group not found"))
+		return
+	}
+	summary, err := newGroupSummary(db, group)
+	if err != nil {
+		requestLogger(c).Error("Error reading group", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"group": summary,
+	}))
+}
+
+// groupRequest is the body of group_create and group_update, fields left
+// out keep their value on update
+type groupRequest struct {
+	ID   uint    `json:"id"`
+	Name *string `json:"name"`
+	// Defaults to set, in the format of device_settings
+	Settings json.RawMessage `json:"settings"`
+	// Defaults to remove, devices then use their own value
+	Clear []string `json:"clear"`
+	// Make every device of the group follow all its defaults again
+	ResetOverrides bool `json:"reset_overrides"`
+}
+
+func handleAdminGroupSaveRequest(c *gin.Context, db *gorm.DB, create bool) {
+	// Create a group, or rename it and change its defaults
+	admin, ok := requireAdmin(c, db, roleEditor)
+	if !ok {
+		return
+	}
+	var request groupRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse("Invalid JSON"))
+		return
+	}
+	group := DeviceGroup{Settings: "{}"}
+	if create {
+		if request.Name == nil || *request.Name == "" {
+			c.JSON(http.StatusBadRequest, errorResponse("name is required"))
+			return
+		}
+	} else if err := db.First(&group, request.ID).Error; err != nil {
+		c.JSON(http.StatusNotFound, errorResponse("Group not found"))
+		return
+	}
+	if request.Name != nil {
+		if *request.Name == "" {
+			c.JSON(http.StatusBadRequest, errorResponse("name must not be empty"))
+			return
+		}
+		var count int64
+		db.Model(&DeviceGroup{}).Where("name = ? AND id <> ?", *request.Name, group.ID).Count(&count)
+		if count > 0 {
+			c.JSON(http.StatusConflict, errorResponse("Group already exists"))
+			return
+		}
+		group.Name = *request.Name
+	}
+
+	defaults, err := group.settings()
+	if err != nil {
+		requestLogger(c).Error("Error reading group", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	var changed []string
+	if len(request.Settings) > 0 {
+		values, err := parseGroupSettings(request.Settings)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse(err.Error()))
+			return
+		}
+		for name, value := range values {
+			defaults[name] = value
+			changed = append(changed, name)
+		}
+	}
+	for _, name := range request.Clear {
+		delete(defaults, name)
+		changed = append(changed, name)
+	}
+	if playlistID, ok := defaults["playlist_id"].(float64); ok {
+		// 0 would always show the whole library, leave that to the devices
+		id := uint(playlistID)
+		if id == 0 {
+			delete(defaults, "playlist_id")
+		} else if err := playlistExists(db, &id); err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse(err.Error()))
+			return
+		}
+	}
+	data, err := json.Marshal(defaults)
+	if err != nil {
+		requestLogger(c).Error("Error encoding group settings", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	group.Settings = string(data)
+
+	var members []DeviceSetting
+	if !create {
+		if err := db.Where("group_id = ?", group.ID).Find(&members).Error; err != nil {
+			requestLogger(c).Error("Error fetching group members", "error", err)
+			c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+			return
+		}
+	}
+	if request.ResetOverrides {
+		for i := range members {
+			members[i].Overrides = ""
+		}
+	}
+	if err := checkGroupMembers(group, members); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(err.Error()))
+		return
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&group).Error; err != nil {
+			return err
+		}
+		if request.ResetOverrides {
+			return tx.Model(&DeviceSetting{}).Where("group_id = ?", group.ID).
+				Updates(map[string]interface{}{"overrides": "", "updated_at": time.Now()}).Error
+		}
+		return nil
+	})
+	if err != nil {
+		requestLogger(c).Error("Error saving group", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+
+	action := "group_update"
+	if create {
+		action = "group_create"
+	}
+	slices.Sort(changed)
+	details := "name=" + group.Name
+	if len(changed) > 0 {
+		details += " settings=" + strings.Join(slices.Compact(changed), ",")
+	}
+	if request.ResetOverrides {
+		details += " reset_overrides"
+	}
+	recordAudit(db, admin, action, "group", strconv.FormatUint(uint64(group.ID), 10), details)
+	summary, err := newGroupSummary(db, group)
+	if err != nil {
+		requestLogger(c).Error("Error reading group", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"message": "Group saved, its devices apply it on their next image update",
+		"group":   summary,
+	}))
+}
+
+func handleAdminGroupDeleteRequest(c *gin.Context, db *gorm.DB) {
+	// Delete a group, its devices keep only their own settings
+	admin, ok := requireAdmin(c, db, roleEditor)
+	if !ok {
+		return
+	}
+	var request groupRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse("Invalid JSON"))
+		return
+	}
+	var group DeviceGroup
+	if err := db.First(&group, request.ID).Error; err != nil {
+		c.JSON(http.StatusNotFound, errorResponse("Group not found"))
+		return
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&DeviceSetting{}).Where("group_id = ?", group.ID).
+			Updates(map[string]interface{}{"group_id": nil, "overrides": "", "updated_at": time.Now()}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(&group).Error
+	})
+	if err != nil {
+		requestLogger(c).Error("Error deleting group", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	recordAudit(db, admin, "group_delete", "group", strconv.FormatUint(uint64(group.ID), 10), "name="+group.Name)
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"message": "Group deleted",
+		"id":      group.ID,
+	}))
+}
+
+func handleAdminGroupMembersRequest(c *gin.Context, db *gorm.DB) {
+	// Add devices to a group or remove them. A device is in one group at a
+	// time and follows all its defaults when it joins.
+	admin, ok := requireAdmin(c, db, roleEditor)
+	if !ok {
+		return
+	}
+	var request struct {
+		ID     uint     `json:"id"`
+		Add    []string `json:"add"`
+		Remove []string `json:"remove"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse("Invalid JSON"))
+		return
+	}
+	var group DeviceGroup
+	if err := db.First(&group, request.ID).Error; err != nil {
+		c.JSON(http.StatusNotFound, errorResponse("Group not found"))
+		return
+	}
+	if _, err := findDevices(db, slices.Concat(request.Add, request.Remove)); err != nil {
+		c.JSON(http.StatusNotFound, errorResponse(err.Error()))
+		return
+	}
+	var joining []DeviceSetting
+	if err := db.Where("device_id IN ?", request.Add).Find(&joining).Error; err != nil {
+		requestLogger(c).Error("Error fetching settings", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	if len(joining) != len(slices.Compact(slices.Sorted(slices.Values(request.Add)))) {
+		c.JSON(http.StatusBadRequest, errorResponse("Every device to add needs settings"))
+		return
+	}
+	for i := range joining {
+		joining[i].Overrides = ""
+	}
+	if err := checkGroupMembers(group, joining); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(err.Error()))
+		return
+	}
+	now := time.Now()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if len(request.Remove) > 0 {
+			err := tx.Model(&DeviceSetting{}).Where("device_id IN ? AND group_id = ?", request.Remove, group.ID).
+				Updates(map[string]interface{}{"group_id": nil, "overrides": "", "updated_at": now}).Error
+			if err != nil {
+				return err
+			}
+		}
+		if len(request.Add) > 0 {
+			return tx.Model(&DeviceSetting{}).Where("device_id IN ?", request.Add).
+				Updates(map[string]interface{}{"group_id": group.ID, "overrides": "", "updated_at": now}).Error
+		}
+		return nil
+	})
+	if err != nil {
+		requestLogger(c).Error("Error saving group members", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	for _, deviceID := range request.Add {
+		recordAudit(db, admin, "group_join", "device", deviceID, "group="+group.Name)
+	}
+	for _, deviceID := range request.Remove {
+		recordAudit(db, admin, "group_leave", "device", deviceID, "group="+group.Name)
+	}
+	deviceIDs, err := groupMemberIDs(db, group.ID)
+	if err != nil {
+		requestLogger(c).Error("Error fetching group members", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"message":    "Group members updated",
+		"device_ids": deviceIDs,
+	}))
+}
+
+// targetDeviceIDs returns the devices a bulk request is for: the devices of
+// the group if groupID is set, otherwise deviceIDs
+func targetDeviceIDs(db *gorm.DB, deviceIDs []string, groupID uint) ([]string, error) {
+	if groupID == 0 {
+		return deviceIDs, nil
+	}
+	var group DeviceGroup
+	if err := db.First(&group, groupID).Error; err != nil {
+		return nil, fmt.Errorf("group %d not found", groupID)
+	}
+	members, err := groupMemberIDs(db, group.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf("group %s has no devices", group.Name)
+	}
+	return members, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func uintPtr(v uint) *uint {
+	return &v
+}
+
+func TestResolveSettings(t *testing.T) {
+	group := &DeviceGroup{ID: 1, Name: "hall", Settings: `{"img_update_interval":300,"palette":"7Eink","playlist_id":5}`}
+	own := newDeviceSettings
+	own.DeviceID = "frame1"
+	own.ImgUpdateInterval = 1200
+	own.PlaylistID = uintPtr(7)
+	tests := []struct {
+		name         string
+		overrides    string
+		group        *DeviceGroup
+		wantInterval int
+		wantPalette  string
+		wantPlaylist *uint
+	}{
+		{"no group", "", nil, 1200, "7Standard", uintPtr(7)},
+		{"group values", "", group, 300, "7Eink", uintPtr(5)},
+		{"device value overrides the group", "img_update_interval", group, 1200, "7Eink", uintPtr(5)},
+		{"device playlist overrides the group", "img_update_interval,playlist_id", group, 1200, "7Eink", uintPtr(7)},
+		{"empty names are ignored", ",palette,", group, 300, "7Standard", uintPtr(5)},
+		{"override without a group value", "rotation", group, 300, "7Eink", uintPtr(5)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings := own
+			settings.Overrides = test.overrides
+			got, err := resolveSettings(settings, test.group)
+			if err != nil {
+				t.Fatalf("resolveSettings: %v", err)
+			}
+			if got.ImgUpdateInterval != test.wantInterval || got.Palette != test.wantPalette || *got.PlaylistID != *test.wantPlaylist {
+				t.Errorf("resolveSettings = interval %d palette %s playlist %d, want %d %s %d",
+					got.ImgUpdateInterval, got.Palette, *got.PlaylistID, test.wantInterval, test.wantPalette, *test.wantPlaylist)
+			}
+		})
+	}
+
+	// The device's own settings are left alone
+	if own.ImgUpdateInterval != 1200 || *own.PlaylistID != 7 {
+		t.Errorf("resolveSettings changed the device settings to %+v", own)
+	}
+	invalid := &DeviceGroup{ID: 2, Name: "broken", Settings: `{"img_update_interval":-1}`}
+	if _, err := resolveSettings(own, invalid); err == nil {
+		t.Errorf("resolveSettings with an invalid group value: no error")
+	}
+}
+
+func TestTrackOverrides(t *testing.T) {
+	useTestConfig(t, nil)
+	db := newTestDB(t)
+	group := DeviceGroup{Name: "hall", Settings: `{"img_update_interval":300,"dither_strength":0.1,"rotation":0}`}
+	if err := db.Create(&group).Error; err != nil {
+		t.Fatalf("create group: %v", err)
+	}
+	interval := func(v int) *int { return &v }
+	strength := func(v float32) *float32 { return &v }
+	palette := "7Eink"
+	tests := []struct {
+		name      string
+		groupID   *uint
+		overrides string
+		update    deviceSettingsUpdate
+		want      string
+	}{
+		{"different value overrides", &group.ID, "", deviceSettingsUpdate{ImgUpdateInterval: interval(1200)}, "img_update_interval"},
+		{"group value follows the group again", &group.ID, "img_update_interval,rotation", deviceSettingsUpdate{ImgUpdateInterval: interval(300)}, "rotation"},
+		{"float compared as JSON", &group.ID, "dither_strength", deviceSettingsUpdate{DitherStrength: strength(0.1)}, ""},
+		{"zero compared as JSON", &group.ID, "rotation", deviceSettingsUpdate{Rotation: intPtr(0)}, ""},
+		{"no group value", &group.ID, "", deviceSettingsUpdate{Palette: &palette}, ""},
+		{"names are sorted", &group.ID, "rotation", deviceSettingsUpdate{ImgUpdateInterval: interval(60), DitherStrength: strength(1)}, "dither_strength,img_update_interval,rotation"},
+		{"no group", nil, "", deviceSettingsUpdate{ImgUpdateInterval: interval(1200)}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings := DeviceSetting{DeviceID: "frame1", GroupID: test.groupID, Overrides: test.overrides}
+			if err := trackOverrides(db, &settings, test.update); err != nil {
+				t.Fatalf("trackOverrides: %v", err)
+			}
+			if settings.Overrides != test.want {
+				t.Errorf("overrides = %q, want %q", settings.Overrides, test.want)
+			}
+		})
+	}
+}
+
+// deviceSettings returns the stored and the effective settings of a device
+func deviceSettings(t *testing.T, db *gorm.DB, deviceID string) (DeviceSetting, DeviceSetting) {
+	t.Helper()
+	var settings DeviceSetting
+	if err := db.Where("device_id = ?", deviceID).First(&settings).Error; err != nil {
+		t.Fatalf("fetch settings: %v", err)
+	}
+	effective, err := effectiveSettings(db, settings)
+	if err != nil {
+		t.Fatalf("effectiveSettings: %v", err)
+	}
+	return settings, effective
+}
+
+func TestGroupOverridesAndMembership(t *testing.T) {
+	useTestConfig(t, nil)
+	db := newTestDB(t)
+	newTestDeviceWithSettings(t, db, "frame1")
+	server := newTestServer(t, db)
+	admin := func(path string, body map[string]interface{}) map[string]interface{} {
+		t.Helper()
+		status, response := postJSON(t, server, path, testAdminKey, body)
+		if status != http.StatusOK {
+			t.Fatalf("%s: status %d: %+v", path, status, response)
+		}
+		return responseData(t, response)
+	}
+	// An override set before joining is dropped, the device follows the group
+	admin("/admin/device_settings", map[string]interface{}{"device_id": "frame1", "rotation": 90})
+	if err := db.Model(&DeviceSetting{}).Where("device_id = ?", "frame1").Update("overrides", "rotation").Error; err != nil {
+		t.Fatalf("set overrides: %v", err)
+	}
+	data := admin("/admin/group_create", map[string]interface{}{
+		"name":     "hall",
+		"settings": map[string]interface{}{"img_update_interval": 300, "rotation": 180},
+	})
+	groupID := data["group"].(map[string]interface{})["id"]
+	admin("/admin/group_members", map[string]interface{}{"id": groupID, "add": []string{"frame1"}})
+	settings, effective := deviceSettings(t, db, "frame1")
+	if settings.Overrides != "" || effective.ImgUpdateInterval != 300 || effective.Rotation != 180 {
+		t.Errorf("after joining: overrides %q interval %d rotation %d, want the group's 300 and 180", settings.Overrides, effective.ImgUpdateInterval, effective.Rotation)
+	}
+
+	// A device value overrides the group, also when the group changes
+	admin("/admin/device_settings", map[string]interface{}{"device_id": "frame1", "img_update_interval": 1200})
+	admin("/admin/group_update", map[string]interface{}{"id": groupID, "settings": map[string]interface{}{"img_update_interval": 900}})
+	settings, effective = deviceSettings(t, db, "frame1")
+	if settings.Overrides != "img_update_interval" || effective.ImgUpdateInterval != 1200 {
+		t.Errorf("after overriding: overrides %q interval %d, want the device's 1200", settings.Overrides, effective.ImgUpdateInterval)
+	}
+
+	// Setting the group's value clears the override, the device inherits
+	// later changes of the group
+	admin("/admin/device_settings", map[string]interface{}{"device_id": "frame1", "img_update_interval": 900})
+	admin("/admin/group_update", map[string]interface{}{"id": groupID, "settings": map[string]interface{}{"img_update_interval": 450}})
+	settings, effective = deviceSettings(t, db, "frame1")
+	if settings.Overrides != "" || effective.ImgUpdateInterval != 450 {
+		t.Errorf("after clearing the override: overrides %q interval %d, want the group's 450", settings.Overrides, effective.ImgUpdateInterval)
+	}
+
+	// Leaving the group keeps the device's own values
+	admin("/admin/group_members", map[string]interface{}{"id": groupID, "remove": []string{"frame1"}})
+	settings, effective = deviceSettings(t, db, "frame1")
+	if settings.GroupID != nil || settings.Overrides != "" || effective.ImgUpdateInterval != 900 || effective.Rotation != 90 {
+		t.Errorf("after leaving: group %v overrides %q interval %d rotation %d, want the device's 900 and 90",
+			settings.GroupID, settings.Overrides, effective.ImgUpdateInterval, effective.Rotation)
+	}
+}
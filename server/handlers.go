@@ -2,8 +2,8 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"net/http"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -42,20 +42,41 @@ func handleRegisterRequest(c *gin.Context, db *gorm.DB) error {
 	if !ok || deviceName == "" {
 		deviceName = deviceID // Use device_id as default name if not provided
 	}
-	// Check if device already exists
+	pairingSecret, _ := requestData["pairing_secret"].(string)
+	logger := requestLogger(c).With("device_id", deviceID)
+	setRequestLogger(c, logger)
+	// Devices enrolled through a pairing code must present their pairing secret,
+	// which stays valid until an admin rotates the token
+	_, paired, err := findApprovedPairing(db, deviceID, pairingSecret)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, errorResponse("Unauthorized device registration"))
+		logger.Warn("Unauthorized device registration attempt", "error", err)
+		return err
+	}
+	// Check if device already exists, the admin may have renamed a paired device
 	var existingDevice Device
-	result := db.Where(&Device{DeviceID: deviceID, DeviceName: deviceName}).First(&existingDevice)
+	query := db.Where(&Device{DeviceID: deviceID, DeviceName: deviceName})
+	if paired {
+		query = db.Where(&Device{DeviceID: deviceID})
+	}
+	result := query.First(&existingDevice)
 	if result.Error != nil && result.Error != gorm.ErrRecordNotFound {
-		log.Printf("Error checking existing device: %v", result.Error)
+		logger.Error("Error checking existing device", "error", result.Error)
 		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
 		return result.Error
 	}
+	if result.RowsAffected > 0 && existingDevice.ReapprovalRequired && !paired {
+		// The token was rotated by an admin, device_id and name are not enough
+		// to get a new one. The frame has to be paired again.
+		logger.Warn("Registration after token rotation, pairing required")
+		return handlePairingRequest(c, db, deviceID, deviceName, pairingSecret)
+	}
 	if result.RowsAffected > 0 {
 		// Device already exists, check if has settings, if not create default settings
 		var settings DeviceSetting
 		result = db.Where(&DeviceSetting{DeviceID: deviceID}).First(&settings)
 		if result.Error != nil && result.Error != gorm.ErrRecordNotFound {
-			log.Printf("Error checking device settings: %v", result.Error)
+			logger.Error("Error checking device settings", "error", result.Error)
 			c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
 			return result.Error
 		}
@@ -67,59 +88,78 @@ func handleRegisterRequest(c *gin.Context, db *gorm.DB) error {
 			}
 			result = db.Create(&settings)
 			if result.Error != nil {
-				log.Printf("Error creating default settings: %v", result.Error)
+				logger.Error("Error creating default settings", "error", result.Error)
 				c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
 				return result.Error
 			}
-			log.Printf("Created default settings for device: %s", deviceID)
-		}
-		//create bearer token
-		tokenString := generateUUID()
-		//save to device table
-		existingDevice.DeviceToken = tokenString
-		existingDevice.UpdatedAt = time.Now()
-		result = db.Save(&existingDevice)
-		if result.Error != nil {
-			log.Printf("Error saving device: %v", result.Error)
+			logger.Info("Created default settings")
+		}
+		//create bearer token, only its hash is saved to the device table
+		tokenString, err := issueDeviceToken(c.Request.Context(), db, &existingDevice, "register")
+		if err != nil {
+			logger.Error("Error saving device", "error", err)
 			c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
-			return result.Error
+			return err
+		}
+
+		if existingDevice.ReapprovalRequired {
+			if err := db.Model(&existingDevice).UpdateColumn("reapproval_required", false).Error; err != nil {
+				logger.Error("Error saving device", "error", err)
+				c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+				return err
+			}
+			// An admin approved the device again, the entry completes the
+			// rotation an admin started
+			recordAudit(db, AdminUser{Username: "device:" + deviceID}, "device_token_reissue", "device", deviceID,
+				"expires_at="+existingDevice.TokenExpiresAt.UTC().Format(time.RFC3339))
 		}
 
 		c.JSON(http.StatusOK, successResponse(map[string]interface{}{
-			"message": "Device registered",
-			"token":   tokenString,
+			"message":    "Device registered",
+			"token":      tokenString,
+			"expires_at": existingDevice.TokenExpiresAt,
 		}))
-		log.Printf("Device registered: %s (%s)", existingDevice.DeviceID, existingDevice.DeviceName)
+		logger.Info("Device registered", "device_name", existingDevice.DeviceName)
 		return nil
 	}
-	// Device does not exist, deny registration
+	// Unknown device_id, start pairing so an admin can approve the frame
+	var count int64
+	if err := db.Model(&Device{}).Where("device_id = ?", deviceID).Count(&count).Error; err != nil {
+		logger.Error("Error checking existing device", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return err
+	}
+	if count == 0 {
+		return handlePairingRequest(c, db, deviceID, deviceName, pairingSecret)
+	}
+	// device_id is known but the name does not match, deny registration
 	c.JSON(http.StatusUnauthorized, errorResponse("Unauthorized device registration"))
-	log.Printf("Unauthorized device registration attempt: %s", deviceID)
+	logger.Warn("Unauthorized device registration attempt", "device_name", deviceName)
 	return fmt.Errorf("unauthorized device registration")
 }
-func checkAdminKey(c *gin.Context) bool {
-	// Check if the request has a valid admin key
-	tokenString := c.GetHeader("Authorization")
-	if tokenString == "" {
-		return false
-	}
-	tokenString = tokenString[len("Bearer "):] // Remove "Bearer " prefix
-	return tokenString == adminKey
-}
 
-func updateLastSeen(device Device, db *gorm.DB) error {
-	// Update the last seen timestamp for the device
-	deviceTelemetry := DeviceTelemetry{
-		DeviceID: device.DeviceID,
-		LastSeen: time.Now(),
+// storeShownImage records the image sent to the device. Only the columns
+// owned by the image update are written, a token rotation or a pin made
+// while the image was rendering must not be undone by the stale device.
+func storeShownImage(db *gorm.DB, device *Device, imageUUID string, now time.Time) error {
+	// UpdateColumns keeps gorm from setting UpdatedAt itself, it is set to now
+	err := db.Model(device).UpdateColumns(map[string]interface{}{
+		"current_image": imageUUID,
+		"updated_at":    now,
+	}).Error
+	if err != nil {
+		return err
 	}
-	result := db.Save(&deviceTelemetry)
-	if result.Error != nil {
-		log.Printf("Error updating last seen for device %s: %v", device.DeviceID, result.Error)
-		return result.Error
+	device.CurrentImage = imageUUID
+	device.UpdatedAt = now
+	expired := device.PinnedImage
+	clearExpiredPin(device, now)
+	if expired == device.PinnedImage {
+		return nil
 	}
-	log.Printf("Last seen updated for device %s at %v", device.DeviceID, deviceTelemetry.LastSeen)
-	return nil
+	// Unless the pin was replaced in the meantime
+	return db.Model(&Device{}).Where("id = ? AND pinned_image = ?", device.ID, expired).
+		UpdateColumns(map[string]interface{}{"pinned_image": "", "pinned_until": nil}).Error
 }
 
 func getBearerToken(c *gin.Context) (string, error) {
@@ -136,36 +176,104 @@ func getBearerToken(c *gin.Context) (string, error) {
 
 func authDevice(c *gin.Context, db *gorm.DB) (Device, error) {
 	// Check if the request has a valid device token, returns device details
+	logger := requestLogger(c)
 	deviceToken, err := getBearerToken(c)
 	if err != nil {
-		log.Printf("Error getting Bearer token: %v", err)
+		logger.Warn("Error getting Bearer token", "error", err)
 		return Device{}, err
 	}
 
-	// Fetch device details from the database
+	// Fetch device details from the database, tokens are stored hashed
 	var device Device
-	result := db.Where(&Device{DeviceToken: deviceToken}).First(&device)
+	result := db.Where("device_token_hash = ?", hashToken(deviceToken)).First(&device)
 	if result.Error != nil {
-		log.Printf("Error fetching device: %v", result.Error)
+		logger.Warn("Error fetching device", "error", result.Error)
 		return Device{}, result.Error
 	}
 	if device.DeviceID == "" {
 		return Device{}, fmt.Errorf("device not found")
 	}
-	log.Printf("Device authenticated: %s (%s)", device.DeviceID, device.DeviceName)
+	if !device.TokenExpiresAt.IsZero() && device.TokenExpiresAt.Before(time.Now()) {
+		logger.Warn("Expired token used", "device_id", device.DeviceID, "device_name", device.DeviceName)
+		return Device{}, fmt.Errorf("device token expired")
+	}
+	// Later log lines of the request name the device
+	logger = logger.With("device_id", device.DeviceID)
+	setRequestLogger(c, logger)
+	logger.Debug("Device authenticated", "device_name", device.DeviceName)
 	// Update last seen timestamp for the device
-	err = updateLastSeen(device, db)
+	err = updateLastSeen(&device, db)
 	if err != nil {
-		log.Printf("Error updating last seen for device %s: %v", device.DeviceID, err)
+		logger.Error("Error updating last seen", "error", err)
 		return Device{}, err
 	}
 	// Return device details and claims
 	return device, nil
 }
+func handleTokenRefreshRequest(c *gin.Context, db *gorm.DB) {
+	// Exchange a valid device token for a new one, the old token stops working
+	device, err := authDevice(c, db)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, errorResponse("Unauthorized device"))
+		return
+	}
+	tokenString, err := issueDeviceToken(c.Request.Context(), db, &device, "refresh")
+	if err != nil {
+		requestLogger(c).Error("Error refreshing token", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"message":    "Token refreshed",
+		"token":      tokenString,
+		"expires_at": device.TokenExpiresAt,
+	}))
+}
+
+func handleAdminRotateTokenRequest(c *gin.Context, db *gorm.DB) {
+	// Revoke the token of a device, it has to register again to get a new one
+	admin, ok := requireAdmin(c, db, roleEditor)
+	if !ok {
+		return
+	}
+	var requestData map[string]interface{}
+	if err := c.BindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse("Invalid JSON"))
+		return
+	}
+	deviceID, ok := requestData["device_id"].(string)
+	if !ok || deviceID == "" {
+		c.JSON(http.StatusBadRequest, errorResponse("device_id is required"))
+		return
+	}
+	var device Device
+	result := db.Where("device_id = ?", deviceID).First(&device)
+	if result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, errorResponse("Device not found"))
+		} else {
+			requestLogger(c).Error("Error fetching device", "error", result.Error)
+			c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		}
+		return
+	}
+	ctx := withLogger(c.Request.Context(), requestLogger(c).With("device_id", device.DeviceID))
+	if err := rotateDeviceToken(ctx, db, &device); err != nil {
+		requestLogger(c).Error("Error rotating token", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	recordAudit(db, admin, "device_rotate_token", "device", device.DeviceID, "reapproval_required")
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"message":   "Device token revoked, device must be approved again through a new pairing code",
+		"device_id": device.DeviceID,
+	}))
+}
+
 func handleAdminDeviceRegisterRequest(c *gin.Context, db *gorm.DB) {
-	// Check if the request has a valid admin key
-	if !checkAdminKey(c) {
-		c.JSON(http.StatusUnauthorized, errorResponse("Unauthorized access"))
+	// Check if the request comes from an admin allowed to make changes
+	admin, ok := requireAdmin(c, db, roleEditor)
+	if !ok {
 		return // Unauthorized access
 	}
 	var requestData map[string]interface{}
@@ -190,7 +298,7 @@ func handleAdminDeviceRegisterRequest(c *gin.Context, db *gorm.DB) {
 		return
 	} else if result.Error != gorm.ErrRecordNotFound {
 		// Some other database error occurred
-		log.Printf("Error checking existing device: %v", result.Error)
+		requestLogger(c).Error("Error checking existing device", "error", result.Error)
 		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
 		return
 	}
@@ -204,16 +312,17 @@ func handleAdminDeviceRegisterRequest(c *gin.Context, db *gorm.DB) {
 	}
 	result = db.Create(&device)
 	if result.Error != nil {
-		log.Printf("Error inserting device: %v", result.Error)
+		requestLogger(c).Error("Error inserting device", "error", result.Error)
 		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
 		return
 	}
+	recordAudit(db, admin, "device_register", "device", device.DeviceID, "name="+device.DeviceName)
 	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
 		"message":     "Device registered successfully",
 		"device_id":   device.DeviceID,
 		"device_name": device.DeviceName,
 	}))
-	log.Printf("Device registered: %s (%s)", device.DeviceID, device.DeviceName)
+	requestLogger(c).Info("Device registered", "device_id", device.DeviceID, "device_name", device.DeviceName)
 }
 
 func handleDeviceRequest(c *gin.Context, db *gorm.DB) {
@@ -222,12 +331,52 @@ func handleDeviceRequest(c *gin.Context, db *gorm.DB) {
 		c.JSON(http.StatusUnauthorized, errorResponse("Unauthorized device"))
 		return
 	}
+	logger := requestLogger(c)
 	//get json body
 	var requestData map[string]interface{}
 	if err := c.BindJSON(&requestData); err != nil {
 		c.JSON(http.StatusBadRequest, errorResponse("Invalid JSON"))
 		return
 	}
+	if action, ok := requestData["action"].(string); ok {
+		c.Set(metricsActionKey, action)
+	}
+	// Queued commands go out with every successful response and count as
+	// delivered once it is written. Acks are recorded first so acknowledged
+	// commands are not sent again.
+	var commands []deliveredCommand
+	respond := func(data map[string]interface{}) {
+		if len(commands) > 0 {
+			data["commands"] = commands
+		}
+		c.JSON(http.StatusOK, successResponse(data))
+		if len(commands) > 0 {
+			if err := markCommandsDelivered(db, device, commands); err != nil {
+				logger.Error("Error marking commands delivered", "error", err)
+			}
+		}
+	}
+	if requestData["action"] == "ack_commands" {
+		acks, err := parseCommandAcks(requestData)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse(err.Error()))
+			return
+		}
+		updated, err := acknowledgeCommands(c.Request.Context(), db, &device, acks)
+		if err != nil {
+			logger.Error("Error acknowledging commands", "error", err)
+			c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+			return
+		}
+		respond(map[string]interface{}{
+			"message":      "Commands acknowledged",
+			"acknowledged": updated,
+		})
+		return
+	}
+	if commands, err = pendingCommands(db, device); err != nil {
+		logger.Error("Error fetching commands", "error", err)
+	}
 	if requestData["action"] == "get_settings" {
 		// Get device settings
 		var settings DeviceSetting
@@ -236,109 +385,99 @@ func handleDeviceRequest(c *gin.Context, db *gorm.DB) {
 			if result.Error == gorm.ErrRecordNotFound {
 				c.JSON(http.StatusNotFound, errorResponse("Settings not found"))
 			} else {
-				log.Printf("Error fetching settings: %v", result.Error)
+				logger.Error("Error fetching settings", "error", result.Error)
 				c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
 			}
 			return
 		}
-		c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		if settings, err = effectiveSettings(db, settings); err != nil {
+			logger.Error("Error resolving settings", "error", err)
+			c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+			return
+		}
+		respond(map[string]interface{}{
 			"settings": settings,
-		}))
+		})
 		return
 	}
 	if requestData["action"] == "update_settings" {
-		// Update device settings
+		// Update device settings, validated and tracked against the group
+		// like device_settings of the admin API
+		update, err := deviceSettingsUpdateFromRequest(requestData)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse(err.Error()))
+			return
+		}
 		var settings DeviceSetting
-		result := db.Where(&DeviceSetting{DeviceID: device.DeviceID}).First(&settings)
+		result := db.Where(&DeviceSetting{DeviceID: device.DeviceID}).Limit(1).Find(&settings)
 		if result.Error != nil {
-			if result.Error == gorm.ErrRecordNotFound {
-				// Create new settings if not found
-				settings = DeviceSetting{
-					DeviceID:  device.DeviceID,
-					CreatedAt: time.Now(),
-				}
-			} else {
-				log.Printf("Error fetching settings: %v", result.Error)
+			logger.Error("Error fetching settings", "error", result.Error)
+			c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+			return
+		}
+		if result.RowsAffected == 0 {
+			// Start from the column defaults
+			settings = DeviceSetting{DeviceID: device.DeviceID}
+			if err := db.Create(&settings).Error; err != nil {
+				logger.Error("Error creating settings", "error", err)
 				c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
 				return
 			}
 		}
-		// Update settings with request data
-		if imgUpdateInterval, ok := requestData["img_update_interval"].(int); ok {
-			settings.ImgUpdateInterval = imgUpdateInterval
-		}
-		if height, ok := requestData["height"].(int); ok {
-			settings.Height = height
-		}
-		if width, ok := requestData["width"].(int); ok {
-			settings.Width = width
-		}
-		if rotation, ok := requestData["rotation"].(int); ok {
-			settings.Rotation = rotation
-		}
-		if palette, ok := requestData["palette"].(string); ok {
-			settings.Palette = palette
+		changed, err := update.apply(&settings)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse(err.Error()))
+			return
 		}
-		if ditherAlgorithm, ok := requestData["dither_algorithm"].(string); ok {
-			settings.DitherAlgorithm = ditherAlgorithm
+		if err := playlistExists(db, settings.PlaylistID); err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse(err.Error()))
+			return
 		}
-		if ditherStrength, ok := requestData["dither_strength"].(float32); ok {
-			settings.DitherStrength = ditherStrength
+		if err := trackOverrides(db, &settings, update); err != nil {
+			logger.Error("Error reading group", "error", err)
+			c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+			return
 		}
-		if resizeMethod, ok := requestData["resize_method"].(string); ok {
-			settings.ResizeMethod = resizeMethod
+		effective, err := effectiveSettings(db, settings)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse(err.Error()))
+			return
 		}
 
 		// Save updated settings to database
 		settings.UpdatedAt = time.Now()
 		result = db.Save(&settings)
 		if result.Error != nil {
-			log.Printf("Error saving settings: %v", result.Error)
+			logger.Error("Error saving settings", "error", result.Error)
 			c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
 			return
 		}
 
-		c.JSON(http.StatusOK, successResponse(map[string]interface{}{
-			"message":  "Settings updated successfully",
-			"settings": settings,
-		}))
+		respond(map[string]interface{}{
+			"message":            "Settings updated successfully",
+			"settings":           settings,
+			"effective_settings": effective,
+		})
+		logger.Info("Device settings updated by the device", "changed", strings.Join(changed, ","))
 		return
 	}
 	if requestData["action"] == "update_telemetry" {
-		// Update device telemetry
-		var telemetry DeviceTelemetry
-		result := db.Where(&DeviceTelemetry{DeviceID: device.DeviceID}).First(&telemetry)
-		if result.Error != nil {
-			if result.Error == gorm.ErrRecordNotFound {
-				// Create new telemetry if not found
-				telemetry = DeviceTelemetry{
-					DeviceID: device.DeviceID,
-					LastSeen: time.Now(),
-				}
-			} else {
-				log.Printf("Error fetching telemetry: %v", result.Error)
-				c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
-				return
-			}
-		}
-		// Update telemetry with request data
-		if batteryLevel, ok := requestData["battery_level"].(int); ok {
-			telemetry.BatteryLevel = batteryLevel
+		// Every report is kept as a new sample
+		telemetry, err := telemetryFromRequest(device.DeviceID, requestData)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse(err.Error()))
+			return
 		}
-		telemetry.LastSeen = time.Now()
-
-		// Save updated telemetry to database
-		result = db.Save(&telemetry)
-		if result.Error != nil {
-			log.Printf("Error saving telemetry: %v", result.Error)
+		if err := db.Create(&telemetry).Error; err != nil {
+			logger.Error("Error saving telemetry", "error", err)
 			c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
 			return
 		}
 
-		c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		respond(map[string]interface{}{
 			"message":   "Telemetry updated successfully",
 			"telemetry": telemetry,
-		}))
+		})
 		return
 	}
 	if requestData["action"] == "get_image" {
@@ -350,62 +489,81 @@ func handleDeviceRequest(c *gin.Context, db *gorm.DB) {
 			if result.Error == gorm.ErrRecordNotFound {
 				c.JSON(http.StatusNotFound, errorResponse("Settings not found"))
 			} else {
-				log.Printf("Error fetching settings: %v", result.Error)
+				logger.Error("Error fetching settings", "error", result.Error)
 				c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
 			}
 			return
 		}
-		if device.UpdatedAt.Add(time.Duration(settings.ImgUpdateInterval)*time.Second).After(time.Now()) && device.CurrentImage != "" {
-			// If the last update time plus interval is less than current time, return no update message
-			c.JSON(http.StatusOK, successResponse(map[string]interface{}{
-				"message": "No image update needed",
-			}))
+		if settings, err = effectiveSettings(db, settings); err != nil {
+			logger.Error("Error resolving settings", "error", err)
+			c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
 			return
 		}
-		nextImage, err := getNextRandom(db, device)
+		schedule, err := loadDeviceSchedule(db, settings)
 		if err != nil {
-			log.Printf("Error finding next random image:%v", err)
+			logger.Error("Error loading schedule", "error", err)
 			c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
 			return
 		}
-		ditheredImage, err := getDithered(db, nextImage, settings.Palette, settings.DitherAlgorithm, settings.DitherStrength, settings.Width, settings.Height, settings.ResizeMethod)
+		now := time.Now()
+		if !imageDue(device, settings, schedule, now) {
+			// Not due yet or in a quiet window, tell the device to sleep until
+			// it is due
+			respond(map[string]interface{}{
+				"message":           "No image update needed",
+				"next_wake_seconds": nextWakeSeconds(device, settings, schedule, now),
+			})
+			return
+		}
+		nextImage, pinned, err := scheduledImage(c.Request.Context(), db, device, settings, schedule, now)
 		if err != nil {
-			log.Printf("Error getting dithered image: %v", err)
+			logger.Error("Error finding next image", "error", err)
 			c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
 			return
 		}
-		ditheredImg, err := loadImage(ditheredImage.Path)
+		ditheredImage, ditheredImg, err := renderDeviceImage(c.Request.Context(), db, nextImage, settings)
 		if err != nil {
-			log.Printf("Error loading dithered image: %v", err)
+			logger.Error("Error rendering image", "error", err)
 			c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
 			return
 		}
 		ditheredImgBit := imgToBitmap(ditheredImg, settings.Palette, settings.Width, settings.Height)
 		//save dithered image to cache
-		print(len(ditheredImgBit))
 		filepaths := make([]string, len(ditheredImgBit))
 		for i := 0; i < len(ditheredImgBit); i++ {
 			bytes_data := BitsToBytes(ditheredImgBit[i])
-			filePath := fmt.Sprintf("%s/%s_%d.bin", cacheDir, ditheredImage.UUID, i)
+			filePath := fmt.Sprintf("%s/%s_%d.bin", config().CacheDir, ditheredImage.UUID, i)
 			err = saveBytesToFile(filePath, bytes_data)
 			if err != nil {
-				log.Printf("Error saving dithered image to file: %v", err)
+				logger.Error("Error saving dithered image to file", "error", err)
 				c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
 				return
 			}
-			filepaths[i] = strings.Replace(filePath, cacheDir, "assets", 1)
+			filepaths[i], err = signAssetURL(device, ditheredImage.UUID, filepath.Base(filePath))
+			if err != nil {
+				logger.Error("Error signing asset URL", "error", err)
+				c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+				return
+			}
+		}
+		if err := storeShownImage(db, &device, nextImage.UUID, time.Now()); err != nil {
+			logger.Error("Error storing current image", "error", err)
+		}
+		trigger := displayTrigger(requestData, triggerTimer)
+		if pinned {
+			trigger = triggerManual
+		}
+		if err := recordDisplayEvent(db, device, ditheredImage, settings, trigger); err != nil {
+			logger.Error("Error recording display event", "error", err)
 		}
-		// Update device's current image
-		device.CurrentImage = nextImage.UUID
-		device.UpdatedAt = time.Now()
-		db.Save(&device)
 
 		// Return the processed image or image data
-		c.JSON(http.StatusOK, successResponse(map[string]interface{}{
-			"message":    "Image updated",
-			"image_uuid": nextImage.UUID,
-			"image":      filepaths,
-		}))
+		respond(map[string]interface{}{
+			"message":           "Image updated",
+			"image_uuid":        nextImage.UUID,
+			"image":             filepaths,
+			"next_wake_seconds": nextWakeSeconds(device, settings, schedule, time.Now()),
+		})
 		return
 	}
 	if requestData["action"] == "update_image" {
@@ -416,59 +574,78 @@ func handleDeviceRequest(c *gin.Context, db *gorm.DB) {
 			if result.Error == gorm.ErrRecordNotFound {
 				c.JSON(http.StatusNotFound, errorResponse("Settings not found"))
 			} else {
-				log.Printf("Error fetching settings: %v", result.Error)
+				logger.Error("Error fetching settings", "error", result.Error)
 				c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
 			}
 			return
 		}
-
-		nextImage, err := getNextRandom(db, device)
-		if err != nil {
-			log.Printf("Error finding next random image: %v", err)
+		if settings, err = effectiveSettings(db, settings); err != nil {
+			logger.Error("Error resolving settings", "error", err)
 			c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
 			return
 		}
 
-		ditheredImage, err := getDithered(db, nextImage, settings.Palette, settings.DitherAlgorithm,
-			settings.DitherStrength, settings.Width, settings.Height, settings.ResizeMethod)
+		// A touch shows the next image even in a quiet window
+		schedule, err := loadDeviceSchedule(db, settings)
 		if err != nil {
-			log.Printf("Error getting dithered image: %v", err)
+			logger.Error("Error loading schedule", "error", err)
+			c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+			return
+		}
+		var nextImage DBImage
+		if commandID, ok := requestData["command_id"].(float64); ok {
+			// A show_image command names the image
+			nextImage, err = commandImage(db, device, uint(commandID))
+			if err != nil {
+				logger.Warn("Error finding command image", "error", err)
+				c.JSON(http.StatusNotFound, errorResponse("Command not found"))
+				return
+			}
+		} else if nextImage, err = getNextImage(c.Request.Context(), db, device, schedule.playlistAt(settings, time.Now())); err != nil {
+			logger.Error("Error finding next random image", "error", err)
 			c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
 			return
 		}
 
-		ditheredImg, err := loadImage(ditheredImage.Path)
+		ditheredImage, ditheredImg, err := renderDeviceImage(c.Request.Context(), db, nextImage, settings)
 		if err != nil {
-			log.Printf("Error loading dithered image: %v", err)
+			logger.Error("Error rendering image", "error", err)
 			c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
 			return
 		}
 
 		ditheredImgBit := imgToBitmap(ditheredImg, settings.Palette, settings.Width, settings.Height)
 		//save dithered image to cache
-		print(len(ditheredImgBit))
 		filepaths := make([]string, len(ditheredImgBit))
 		for i := 0; i < len(ditheredImgBit); i++ {
 			bytes_data := BitsToBytes(ditheredImgBit[i])
-			filePath := fmt.Sprintf("%s/%s_%d.bin", cacheDir, ditheredImage.UUID, i)
+			filePath := fmt.Sprintf("%s/%s_%d.bin", config().CacheDir, ditheredImage.UUID, i)
 			err = saveBytesToFile(filePath, bytes_data)
 			if err != nil {
-				log.Printf("Error saving dithered image to file: %v", err)
+				logger.Error("Error saving dithered image to file", "error", err)
+				c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+				return
+			}
+			filepaths[i], err = signAssetURL(device, ditheredImage.UUID, filepath.Base(filePath))
+			if err != nil {
+				logger.Error("Error signing asset URL", "error", err)
 				c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
 				return
 			}
-			filepaths[i] = strings.Replace(filePath, cacheDir, "assets", 1)
 		}
-		// Update device's current image
-		device.CurrentImage = nextImage.UUID
-		device.UpdatedAt = time.Now()
-		db.Save(&device)
+		if err := storeShownImage(db, &device, nextImage.UUID, time.Now()); err != nil {
+			logger.Error("Error storing current image", "error", err)
+		}
+		if err := recordDisplayEvent(db, device, ditheredImage, settings, displayTrigger(requestData, triggerTouch)); err != nil {
+			logger.Error("Error recording display event", "error", err)
+		}
 
-		c.JSON(http.StatusOK, successResponse(map[string]interface{}{
-			"message":    "Image updated",
-			"image_uuid": nextImage.UUID,
-			"image":      filepaths,
-		}))
+		respond(map[string]interface{}{
+			"message":           "Image updated",
+			"image_uuid":        nextImage.UUID,
+			"image":             filepaths,
+			"next_wake_seconds": nextWakeSeconds(device, settings, schedule, time.Now()),
+		})
 		return
 	}
 
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func TestImageUpdateKeepsConcurrentRotationAndPin(t *testing.T) {
+	useTestConfig(t, nil)
+	db := newTestDB(t)
+	images := addTestImages(t, db, 2)
+	device, token := newTestDeviceWithSettings(t, db, "frame1")
+	server := newTestServer(t, db)
+
+	// Rotate the token and pin an image while the payload is being rendered,
+	// after the handler loaded the device
+	err := db.Callback().Create().After("gorm:create").Register("test:rotate_mid_render", func(tx *gorm.DB) {
+		if tx.Statement.Table != "dithered_images" {
+			return
+		}
+		session := tx.Session(&gorm.Session{NewDB: true})
+		rotating := device
+		if err := rotateDeviceToken(context.Background(), session, &rotating); err != nil {
+			t.Errorf("rotateDeviceToken: %v", err)
+		}
+		if err := session.Model(&rotating).UpdateColumn("pinned_image", images[1]).Error; err != nil {
+			t.Errorf("pin image: %v", err)
+		}
+	})
+	if err != nil {
+		t.Fatalf("register callback: %v", err)
+	}
+
+	status, response := postJSON(t, server, "/dev", token, map[string]interface{}{"action": "update_image"})
+	if status != http.StatusOK {
+		t.Fatalf("update_image: status %d: %+v", status, response)
+	}
+	data := responseData(t, response)
+
+	var stored Device
+	if err := db.First(&stored, device.ID).Error; err != nil {
+		t.Fatalf("fetch device: %v", err)
+	}
+	if stored.CurrentImage != data["image_uuid"] {
+		t.Errorf("current_image %q, want the image sent %v", stored.CurrentImage, data["image_uuid"])
+	}
+	if stored.DeviceTokenHash != "" || !stored.ReapprovalRequired {
+		t.Errorf("rotation undone: token hash %q, reapproval_required %v", stored.DeviceTokenHash, stored.ReapprovalRequired)
+	}
+	if stored.PinnedImage != images[1] {
+		t.Errorf("pinned_image %q, want the pin made during the request", stored.PinnedImage)
+	}
+
+	status, _ = postJSON(t, server, "/dev", token, map[string]interface{}{"action": "get_settings"})
+	if status != http.StatusUnauthorized {
+		t.Errorf("old token after rotation: status %d, want 401", status)
+	}
+}
+
+func TestDeviceUpdateSettingsTracksGroupOverrides(t *testing.T) {
+	useTestConfig(t, nil)
+	db := newTestDB(t)
+	_, token := newTestDeviceWithSettings(t, db, "frame1")
+	group := DeviceGroup{Name: "hall", Settings: `{"img_update_interval":300,"dither_strength":0.5}`}
+	if err := db.Create(&group).Error; err != nil {
+		t.Fatalf("create group: %v", err)
+	}
+	if err := db.Model(&DeviceSetting{}).Where("device_id = ?", "frame1").Update("group_id", group.ID).Error; err != nil {
+		t.Fatalf("join group: %v", err)
+	}
+	server := newTestServer(t, db)
+
+	status, response := postJSON(t, server, "/dev", token, map[string]interface{}{
+		"action":              "update_settings",
+		"img_update_interval": 1200,
+		"dither_strength":     0.5,
+		"rotation":            90,
+	})
+	if status != http.StatusOK {
+		t.Fatalf("update_settings: status %d: %+v", status, response)
+	}
+	effective, _ := responseData(t, response)["effective_settings"].(map[string]interface{})
+	if effective["ImgUpdateInterval"] != float64(1200) || effective["Rotation"] != float64(90) {
+		t.Errorf("update_settings: effective %v, want interval 1200 and rotation 90", effective)
+	}
+	var settings DeviceSetting
+	if err := db.Where("device_id = ?", "frame1").First(&settings).Error; err != nil {
+		t.Fatalf("fetch settings: %v", err)
+	}
+	if settings.ImgUpdateInterval != 1200 || settings.Overrides != "img_update_interval" {
+		t.Errorf("stored settings: interval %d overrides %q, want 1200 overriding the group", settings.ImgUpdateInterval, settings.Overrides)
+	}
+
+	for _, invalid := range []map[string]interface{}{
+		{"action": "update_settings", "img_update_interval": "often"},
+		{"action": "update_settings", "width": 7, "height": 7},
+		{"action": "update_settings", "palette": "unknown"},
+	} {
+		if status, _ := postJSON(t, server, "/dev", token, invalid); status != http.StatusBadRequest {
+			t.Errorf("update_settings %v: status %d, want 400", invalid, status)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Bootstrap admin key of the test configuration
+const testAdminKey = "test-admin-key"
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// useTestConfig installs a default configuration with a throwaway cache
+// directory and signing key, restoring the previous one after the test.
+func useTestConfig(t *testing.T, modify func(*Config)) *Config {
+	t.Helper()
+	previous := currentConfig.Load()
+	t.Cleanup(func() { currentConfig.Store(previous) })
+
+	cfg := defaultConfig()
+	cfg.CacheDir = t.TempDir()
+	cfg.ImageDir = t.TempDir()
+	cfg.JWTMasterKey = "test-master-key"
+	cfg.AdminKey = testAdminKey
+	if modify != nil {
+		modify(&cfg)
+	}
+	currentConfig.Store(&cfg)
+	return &cfg
+}
+
+// newTestDB opens a migrated sqlite database in a temporary directory.
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	cfg := DatabaseConfig{
+		Driver:      dbDriverSQLite,
+		DSN:         filepath.Join(t.TempDir(), "test.db"),
+		AutoMigrate: true,
+	}
+	db, err := dbInit(cfg)
+	if err != nil {
+		t.Fatalf("dbInit: %v", err)
+	}
+	t.Cleanup(func() { dbClose(db) })
+	return db
+}
+
+// newTestDevice creates a device and returns it with its bearer token.
+func newTestDevice(t *testing.T, db *gorm.DB, deviceID string) (Device, string) {
+	t.Helper()
+	device := Device{DeviceID: deviceID, DeviceName: deviceID, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	if err := db.Create(&device).Error; err != nil {
+		t.Fatalf("create device: %v", err)
+	}
+	token, err := issueDeviceToken(context.Background(), db, &device, "test")
+	if err != nil {
+		t.Fatalf("issue token: %v", err)
+	}
+	return device, token
+}
+
+// newTestDeviceWithSettings creates a device with settings for a small panel,
+// so rendering in tests is quick.
+func newTestDeviceWithSettings(t *testing.T, db *gorm.DB, deviceID string) (Device, string) {
+	t.Helper()
+	device, token := newTestDevice(t, db, deviceID)
+	settings := DeviceSetting{DeviceID: deviceID, ImgUpdateInterval: 600, Width: 80, Height: 48}
+	if err := db.Create(&settings).Error; err != nil {
+		t.Fatalf("create settings: %v", err)
+	}
+	return device, token
+}
+
+// addTestImages writes count small images to the image directory and adds
+// them to the library, returning their UUIDs in library order.
+func addTestImages(t *testing.T, db *gorm.DB, count int) []string {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		img := image.NewRGBA(image.Rect(0, 0, 32, 20))
+		for x := 0; x < 32; x++ {
+			for y := 0; y < 20; y++ {
+				img.Set(x, y, color.RGBA{R: uint8(x * 8), G: uint8(y * 12), B: uint8(i * 60), A: 255})
+			}
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatalf("encode image: %v", err)
+		}
+		path := filepath.Join(config().ImageDir, fmt.Sprintf("image%d.png", i))
+		if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+			t.Fatalf("write image: %v", err)
+		}
+	}
+	if err := refreshImages(db); err != nil {
+		t.Fatalf("refreshImages: %v", err)
+	}
+	if err := updateRandomList(db); err != nil {
+		t.Fatalf("updateRandomList: %v", err)
+	}
+	var list []RandomImage
+	if err := db.Order("id").Find(&list).Error; err != nil {
+		t.Fatalf("fetch library: %v", err)
+	}
+	uuids := make([]string, len(list))
+	for i, entry := range list {
+		uuids[i] = entry.UUID
+	}
+	return uuids
+}
+
+// newTestServer serves the full API router.
+func newTestServer(t *testing.T, db *gorm.DB) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(newRouter(db))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// postJSON sends body to path with the bearer token and decodes the
+// response envelope.
+func postJSON(t *testing.T, server *httptest.Server, path string, token string, body interface{}) (int, APIResponse) {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("encode request: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, server.URL+path, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	var response APIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatalf("POST %s: decode response: %v", path, err)
+	}
+	return resp.StatusCode, response
+}
+
+// responseData returns the data object of a successful response.
+func responseData(t *testing.T, response APIResponse) map[string]interface{} {
+	t.Helper()
+	data, ok := response.Data.(map[string]interface{})
+	if !response.Success || !ok {
+		t.Fatalf("unsuccessful response: %+v", response)
+	}
+	return data
+}
+
+// registerDevice calls /register for deviceID with an optional pairing
+// secret.
+func registerDevice(t *testing.T, server *httptest.Server, deviceID string, secret string) (int, APIResponse) {
+	t.Helper()
+	body := map[string]interface{}{"device_id": deviceID, "device_name": deviceID}
+	if secret != "" {
+		body["pairing_secret"] = secret
+	}
+	return postJSON(t, server, "/register", "", body)
+}
+
+// pairTestDevice enrolls deviceID through a pairing code approved with the
+// admin key and returns its pairing secret and bearer token.
+func pairTestDevice(t *testing.T, server *httptest.Server, deviceID string) (secret string, token string) {
+	t.Helper()
+	status, response := registerDevice(t, server, deviceID, "")
+	if status != http.StatusAccepted {
+		t.Fatalf("pairing request: status %d: %+v", status, response)
+	}
+	data := responseData(t, response)
+	secret, _ = data["pairing_secret"].(string)
+	approvePairing(t, server, data["pairing_code"].(string))
+	return secret, registerWithSecret(t, server, deviceID, secret)
+}
+
+// approvePairing approves a pairing code with the admin key.
+func approvePairing(t *testing.T, server *httptest.Server, code string) {
+	t.Helper()
+	status, response := postJSON(t, server, "/admin/pairing_approve", testAdminKey, map[string]interface{}{"code": code})
+	if status != http.StatusOK {
+		t.Fatalf("approve pairing: status %d: %+v", status, response)
+	}
+}
+
+// registerWithSecret registers an approved device and returns its token.
+func registerWithSecret(t *testing.T, server *httptest.Server, deviceID string, secret string) string {
+	t.Helper()
+	status, response := registerDevice(t, server, deviceID, secret)
+	if status != http.StatusOK {
+		t.Fatalf("register: status %d: %+v", status, response)
+	}
+	token, _ := responseData(t, response)["token"].(string)
+	return token
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"image"
+	"image/jpeg"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/anthonynsimon/bild/transform"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Longest edge of library thumbnails in pixels, unless requested otherwise
+const defaultThumbnailSize = 240
+
+// libraryImage is a library entry as listed to admins
+type libraryImage struct {
+	UUID      string    `json:"uuid"`
+	Name      string    `json:"name"`
+	Path      string    `json:"path"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func handleAdminImageListRequest(c *gin.Context, db *gorm.DB) {
+	if _, ok := requireAdmin(c, db, roleViewer); !ok {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	var total int64
+	if err := db.Model(&DBImage{}).Count(&total).Error; err != nil {
+		requestLogger(c).Error("Error counting images", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	var images []DBImage
+	if err := db.Order("path").Limit(limit).Offset(offset).Find(&images).Error; err != nil {
+		requestLogger(c).Error("Error fetching images", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	entries := make([]libraryImage, 0, len(images))
+	for _, img := range images {
+		entries = append(entries, libraryImage{
+			UUID:      img.UUID,
+			Name:      filepath.Base(img.Path),
+			Path:      img.Path,
+			CreatedAt: img.CreatedAt,
+		})
+	}
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"images": entries,
+		"total":  total,
+		"limit":  limit,
+		"offset": offset,
+	}))
+}
+
+// thumbnail scales img down so its longest edge is at most size pixels
+func thumbnail(img image.Image, size int) image.Image {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if width <= size && height <= size {
+		return img
+	}
+	if width >= height {
+		height = max(1, height*size/width)
+		width = size
+	} else {
+		width = max(1, width*size/height)
+		height = size
+	}
+	return transform.Resize(img, width, height, transform.Linear)
+}
+
+func handleAdminImageThumbnailRequest(c *gin.Context, db *gorm.DB) {
+	// Scaled down JPEG of a library image for the dashboard
+	if _, ok := requireAdmin(c, db, roleViewer); !ok {
+		return
+	}
+	size, err := strconv.Atoi(c.DefaultQuery("size", strconv.Itoa(defaultThumbnailSize)))
+	if err != nil || size <= 0 || size > 1024 {
+		size = defaultThumbnailSize
+	}
+	var source DBImage
+	result := db.Where(&DBImage{UUID: c.Query("uuid")}).First(&source)
+	if c.Query("uuid") == "" || result.Error != nil {
+		c.JSON(http.StatusNotFound, errorResponse("Image not found"))
+		return
+	}
+	img, err := loadImage(source.Path)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse("Failed to load image"))
+		return
+	}
+	// Kept short, a file replaced under the same name keeps its UUID
+	c.Header("Cache-Control", "private, max-age=3600")
+	c.Header("Content-Type", "image/jpeg")
+	c.Status(http.StatusOK)
+	if err := jpeg.Encode(c.Writer, thumbnail(img, size), &jpeg.Options{Quality: 80}); err != nil {
+		requestLogger(c).Error("Error encoding thumbnail", "path", source.Path, "error", err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Supported log formats
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// Shared by every handler so a reload can change the level in place
+var logLevel slog.LevelVar
+
+// configureLogging makes a slog logger for cfg the default. The standard log
+// package writes through it too, at info level.
+func configureLogging(cfg LogConfig) {
+	logLevel.Set(logLevels[cfg.Level])
+	options := &slog.HandlerOptions{Level: &logLevel}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if cfg.Format == logFormatJSON {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// Header carrying the request ID, taken from the client or a proxy if valid
+const requestIDHeader = "X-Request-ID"
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+type loggerKey struct{}
+
+// withLogger returns a copy of ctx carrying logger
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFrom returns the logger stored in ctx, or the default logger
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// requestLogger returns the logger of a request, it carries the request ID
+// and, once authenticated, the device ID.
+func requestLogger(c *gin.Context) *slog.Logger {
+	return loggerFrom(c.Request.Context())
+}
+
+// setRequestLogger replaces the logger of a request, e.g. to add fields
+func setRequestLogger(c *gin.Context, logger *slog.Logger) {
+	c.Request = c.Request.WithContext(withLogger(c.Request.Context(), logger))
+}
+
+// requestLogging assigns every request an ID, returned in X-Request-ID, and
+// logs it once it is answered. It replaces gin's own request logger.
+func requestLogging() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		requestID := c.GetHeader(requestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = generateUUID()
+		}
+		c.Header(requestIDHeader, requestID)
+		setRequestLogger(c, slog.Default().With("request_id", requestID))
+
+		c.Next()
+
+		level := slog.LevelInfo
+		if c.Writer.Status() >= 500 {
+			level = slog.LevelError
+		}
+		requestLogger(c).Log(c.Request.Context(), level, "Request",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"duration_ms", time.Since(start).Milliseconds(),
+			"client_ip", c.ClientIP(),
+		)
+	}
+}
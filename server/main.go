@@ -1,78 +1,47 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/joho/godotenv"
 	"gorm.io/gorm"
 )
 
-var jwtMasterKey []byte
-var adminKey string
-var imageDir string
-var imageDirRefresh int
-var cacheDir string
+// How long in-flight requests, and the renders they started, may take to
+// finish on shutdown
+const shutdownTimeout = 30 * time.Second
 
-func init() {
-	err := godotenv.Load()
-	if err != nil {
-		log.Println("Warning: Error loading .env file:", err)
-	}
-	// Get admin key from environment
-	adminKey = os.Getenv("ADMIN_KEY")
-	if adminKey == "" {
-		log.Println("Warning: ADMIN_TOKEN not set in .env, using default (not secure for production)")
-		adminKey = "default_admin_token"
-	}
-	log.Println("Using admin token:", adminKey)
-	imageDir = os.Getenv("IMAGE_DIR")
-	if imageDir == "" {
-		log.Println("Warning: IMAGE_DIR not set in .env, using default")
-		imageDir = "./images"
-	}
-	log.Println("Using image directory:", imageDir)
-	imageDirRefresh, err = strconv.Atoi(os.Getenv("IMAGE_DIR_REFRESH"))
-	if err != nil {
-		log.Println("Warning: IMAGE_DIR_REFRESH not set in .env, using default")
-		imageDirRefresh = 86400
-	}
-	cacheDir = os.Getenv("CACHE_DIR")
-	if cacheDir == "" {
-		log.Println("Warning: CACHE_DIR not set in .env, using default")
-		cacheDir, _ = os.UserCacheDir()
-	}
-}
-
-func startAPIServer(db *gorm.DB) {
-	router := gin.Default()
+func newRouter(db *gorm.DB) *gin.Engine {
+	router := gin.New()
+	router.Use(requestLogging(), gin.Recovery())
 
 	// Use closures to pass the db connection to handlers
-	// Serve static files with authentication
+	// Serve cached device payloads through signed, device-scoped URLs
 	router.GET("/assets/*filepath", func(c *gin.Context) {
-		// Check authentication first
-		device, err := authDevice(c, db)
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, errorResponse("Unauthorized access to assets"))
-			return
-		}
-
-		// If authenticated, serve the requested file
-		path := c.Param("filepath")
-		c.File(cacheDir + path)
-
-		log.Printf("Device %s (%s) accessed asset: %s", device.DeviceID, device.DeviceName, path)
+		handleAssetRequest(c, db)
 	})
 
 	router.POST("/register", func(c *gin.Context) {
 		handleRegisterRequest(c, db)
 	})
 
+	router.POST("/refresh", func(c *gin.Context) {
+		handleTokenRefreshRequest(c, db)
+	})
+
 	router.POST("/dev", func(c *gin.Context) {
+		start := time.Now()
 		handleDeviceRequest(c, db)
+		observeDeviceRequest(c, start)
 	})
 
 	router.POST("/admin/device_register", func(c *gin.Context) {
@@ -80,25 +49,293 @@ func startAPIServer(db *gorm.DB) {
 		handleAdminDeviceRegisterRequest(c, db)
 	})
 
-	log.Println("Starting API server on port 8080...")
-	log.Fatal(router.RunTLS(":8080", "cert.pem", "key.pem"))
+	router.GET("/admin/pairing_requests", func(c *gin.Context) {
+		handleAdminPairingListRequest(c, db)
+	})
+
+	router.POST("/admin/pairing_approve", func(c *gin.Context) {
+		handleAdminPairingApproveRequest(c, db)
+	})
+
+	router.POST("/admin/pairing_reject", func(c *gin.Context) {
+		handleAdminPairingRejectRequest(c, db)
+	})
+
+	router.GET("/admin/users", func(c *gin.Context) {
+		handleAdminUserListRequest(c, db)
+	})
+
+	router.POST("/admin/user_create", func(c *gin.Context) {
+		handleAdminUserCreateRequest(c, db)
+	})
+
+	router.POST("/admin/user_update", func(c *gin.Context) {
+		handleAdminUserUpdateRequest(c, db)
+	})
+
+	router.POST("/admin/user_delete", func(c *gin.Context) {
+		handleAdminUserDeleteRequest(c, db)
+	})
+
+	router.GET("/admin/audit_log", func(c *gin.Context) {
+		handleAdminAuditLogRequest(c, db)
+	})
+
+	router.POST("/admin/device_rotate_token", func(c *gin.Context) {
+		handleAdminRotateTokenRequest(c, db)
+	})
+
+	router.POST("/admin/device_forget_pairing", func(c *gin.Context) {
+		handleAdminForgetPairingRequest(c, db)
+	})
+
+	router.GET("/admin/devices", func(c *gin.Context) {
+		handleAdminDeviceListRequest(c, db)
+	})
+
+	router.POST("/admin/device_settings", func(c *gin.Context) {
+		handleAdminDeviceSettingsRequest(c, db)
+	})
+
+	router.GET("/admin/render_options", func(c *gin.Context) {
+		handleAdminRenderOptionsRequest(c, db)
+	})
+
+	router.GET("/admin/images", func(c *gin.Context) {
+		handleAdminImageListRequest(c, db)
+	})
+
+	router.GET("/admin/image_thumbnail", func(c *gin.Context) {
+		handleAdminImageThumbnailRequest(c, db)
+	})
+
+	router.GET("/admin/preview", func(c *gin.Context) {
+		handleAdminPreviewRequest(c, db)
+	})
+
+	router.GET("/admin/devices/:id/screen.png", func(c *gin.Context) {
+		handleAdminDeviceScreenRequest(c, db)
+	})
+
+	router.GET("/admin/devices/:id/screen_history", func(c *gin.Context) {
+		handleAdminDeviceScreenHistoryRequest(c, db)
+	})
+
+	router.GET("/admin/devices/:id/display_events", func(c *gin.Context) {
+		handleAdminDeviceDisplayEventsRequest(c, db)
+	})
+
+	router.GET("/admin/devices/:id/telemetry", func(c *gin.Context) {
+		handleAdminDeviceTelemetryRequest(c, db)
+	})
+
+	metrics := newMetricsHandler(db)
+	router.GET("/metrics", func(c *gin.Context) {
+		handleMetricsRequest(c, db, metrics)
+	})
+
+	router.GET("/admin/playlists", func(c *gin.Context) {
+		handleAdminPlaylistListRequest(c, db)
+	})
+
+	router.GET("/admin/playlists/:id", func(c *gin.Context) {
+		handleAdminPlaylistRequest(c, db)
+	})
+
+	router.POST("/admin/playlist_create", func(c *gin.Context) {
+		handleAdminPlaylistSaveRequest(c, db, true)
+	})
+
+	router.POST("/admin/playlist_update", func(c *gin.Context) {
+		handleAdminPlaylistSaveRequest(c, db, false)
+	})
+
+	router.POST("/admin/playlist_delete", func(c *gin.Context) {
+		handleAdminPlaylistDeleteRequest(c, db)
+	})
+
+	router.GET("/admin/devices/:id/schedule", func(c *gin.Context) {
+		handleAdminDeviceScheduleRequest(c, db)
+	})
+
+	router.POST("/admin/device_schedule", func(c *gin.Context) {
+		handleAdminDeviceScheduleUpdateRequest(c, db)
+	})
+
+	router.GET("/admin/devices/:id/commands", func(c *gin.Context) {
+		handleAdminDeviceCommandListRequest(c, db)
+	})
+
+	router.POST("/admin/device_command", func(c *gin.Context) {
+		handleAdminDeviceCommandRequest(c, db)
+	})
+
+	router.POST("/admin/device_command_cancel", func(c *gin.Context) {
+		handleAdminDeviceCommandCancelRequest(c, db)
+	})
+
+	router.POST("/admin/device_pin", func(c *gin.Context) {
+		handleAdminDevicePinRequest(c, db)
+	})
+
+	router.POST("/admin/device_unpin", func(c *gin.Context) {
+		handleAdminDeviceUnpinRequest(c, db)
+	})
+
+	router.GET("/admin/groups", func(c *gin.Context) {
+		handleAdminGroupListRequest(c, db)
+	})
+
+	router.GET("/admin/groups/:id", func(c *gin.Context) {
+		handleAdminGroupRequest(c, db)
+	})
+
+	router.POST("/admin/group_create", func(c *gin.Context) {
+		handleAdminGroupSaveRequest(c, db, true)
+	})
+
+	router.POST("/admin/group_update", func(c *gin.Context) {
+		handleAdminGroupSaveRequest(c, db, false)
+	})
+
+	router.POST("/admin/group_delete", func(c *gin.Context) {
+		handleAdminGroupDeleteRequest(c, db)
+	})
+
+	router.POST("/admin/group_members", func(c *gin.Context) {
+		handleAdminGroupMembersRequest(c, db)
+	})
+
+	router.GET("/admin/alerts", func(c *gin.Context) {
+		handleAdminAlertListRequest(c, db)
+	})
+
+	router.GET("/admin/images/:uuid/display_events", func(c *gin.Context) {
+		handleAdminImageDisplayEventsRequest(c, db)
+	})
+
+	router.GET("/admin/image_stats", func(c *gin.Context) {
+		handleAdminImageStatsRequest(c, db)
+	})
+
+	// Dashboard using the admin endpoints above
+	registerWebUI(router)
+
+	return router
 }
 
-func main() {
-	db, err := dbInit()
+// startAPIServer serves the API until ctx is cancelled, then stops accepting
+// connections and waits for in-flight requests to finish. Images are only
+// rendered within requests, so no half written image is left in the cache.
+func startAPIServer(ctx context.Context, db *gorm.DB) error {
+	serverConfig := config().Server
+	server := &http.Server{
+		Addr:    serverConfig.Listen,
+		Handler: newRouter(db),
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		switch serverConfig.TLSMode {
+		case tlsModeNone:
+			slog.Info("Starting API server (plain HTTP)", "listen", serverConfig.Listen)
+			serveErr <- server.ListenAndServe()
+		case tlsModeSelfSigned:
+			certFile, keyFile, err := ensureSelfSignedCert(serverConfig.TLSDir, serverConfig.TLSHosts)
+			if err != nil {
+				serveErr <- err
+				return
+			}
+			slog.Info("Starting API server (self-signed TLS)", "listen", serverConfig.Listen)
+			serveErr <- server.ListenAndServeTLS(certFile, keyFile)
+		default:
+			slog.Info("Starting API server", "listen", serverConfig.Listen)
+			serveErr <- server.ListenAndServeTLS(serverConfig.CertFile, serverConfig.KeyFile)
+		}
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down API server, waiting for in-flight requests")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-serveErr; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	slog.Info("API server stopped")
+	return nil
+}
+
+// runServe starts the server and blocks until it has shut down. Returns the
+// process exit code.
+func runServe(args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintln(os.Stderr, "usage: serve")
+		return 2
+	}
+
+	// Cancelled on Ctrl-C or SIGTERM, which starts the shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	path := configPath()
+	cfg, err := loadConfig(path)
+	if err != nil {
+		slog.Error("Failed to load configuration", "error", err)
+		return 1
+	}
+	applyConfig(cfg, nil)
+	watchConfigReload(ctx, path)
+
+	db, err := dbInit(config().Database)
 	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+		slog.Error("Failed to initialize database", "error", err)
+		return 1
+	}
+	defer func() {
+		if err := dbClose(db); err != nil {
+			slog.Error("Failed to close database", "error", err)
+		}
+	}()
+
+	if err := ensureAdminUser(db); err != nil {
+		slog.Error("Failed to set up admin users", "error", err)
+		return 1
 	}
-	defer dbClose(db)
 
 	if err := refreshImages(db); err != nil {
-		log.Fatalf("Failed to refresh images: %v", err)
+		slog.Error("Failed to refresh images", "error", err)
+		return 1
 	}
 
 	if err := updateRandomList(db); err != nil {
-		log.Fatalf("Failed to update random image list: %v", err)
+		slog.Error("Failed to update random image list", "error", err)
+		return 1
+	}
+
+	var schedulers sync.WaitGroup
+	startSchedulers(ctx, &schedulers, db)
+
+	// Start API server, returns once shut down
+	exitCode := 0
+	if err := startAPIServer(ctx, db); err != nil {
+		slog.Error("API server error", "error", err)
+		exitCode = 1
 	}
+	stop()
 
-	// Start API server
-	startAPIServer(db)
+	schedulers.Wait()
+	slog.Info("Shutdown complete")
+	return exitCode
+}
+
+func main() {
+	os.Exit(runCommand(os.Args[1:]))
 }
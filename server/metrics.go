@@ -0,0 +1,145 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gorm.io/gorm"
+)
+
+// Actions of the /dev endpoint, others are counted as "unknown" so devices
+// cannot create arbitrary label values
+var deviceActions = []string{"get_settings", "update_settings", "update_telemetry", "get_image", "update_image", "ack_commands"}
+
+// Context key under which handleDeviceRequest stores the requested action
+const metricsActionKey = "metrics_action"
+
+var (
+	deviceRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "eink_device_requests_total",
+		Help: "Requests to /dev by action and HTTP status.",
+	}, []string{"action", "status"})
+	deviceRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "eink_device_request_duration_seconds",
+		Help:    "Time taken to answer requests to /dev by action.",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"action"})
+	renderDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "eink_render_duration_seconds",
+		Help:    "Time taken to load, resize and dither an image, overlay renders are not cached.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2, 4, 8, 16, 32},
+	}, []string{"overlay"})
+	ditheredCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "eink_dithered_cache_lookups_total",
+		Help: "Dithered image lookups by result, a miss renders the image.",
+	}, []string{"result"})
+	assetBytesServed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "eink_asset_bytes_served_total",
+		Help: "Payload bytes sent to devices.",
+	})
+)
+
+// observeDeviceRequest records a finished /dev request that started at start
+func observeDeviceRequest(c *gin.Context, start time.Time) {
+	action := c.GetString(metricsActionKey)
+	if !slices.Contains(deviceActions, action) {
+		action = "unknown"
+	}
+	deviceRequests.WithLabelValues(action, strconv.Itoa(c.Writer.Status())).Inc()
+	deviceRequestDuration.WithLabelValues(action).Observe(time.Since(start).Seconds())
+}
+
+// observeRender records the duration of a render that started at start
+func observeRender(start time.Time, overlay bool) {
+	renderDuration.WithLabelValues(strconv.FormatBool(overlay)).Observe(time.Since(start).Seconds())
+}
+
+// databaseCollector reads gauges from the database on every scrape
+type databaseCollector struct {
+	db          *gorm.DB
+	librarySize *prometheus.Desc
+	lastSeen    *prometheus.Desc
+	battery     *prometheus.Desc
+}
+
+func newDatabaseCollector(db *gorm.DB) *databaseCollector {
+	return &databaseCollector{
+		db:          db,
+		librarySize: prometheus.NewDesc("eink_library_images", "Images in the library.", nil, nil),
+		lastSeen:    prometheus.NewDesc("eink_device_last_seen_timestamp_seconds", "Time of the last authenticated request of a device.", []string{"device_id"}, nil),
+		battery:     prometheus.NewDesc("eink_device_battery_percent", "Last battery level reported by a device.", []string{"device_id"}, nil),
+	}
+}
+
+func (dc *databaseCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dc.librarySize
+	ch <- dc.lastSeen
+	ch <- dc.battery
+}
+
+func (dc *databaseCollector) Collect(ch chan<- prometheus.Metric) {
+	var images int64
+	if err := dc.db.Model(&DBImage{}).Count(&images).Error; err != nil {
+		slog.Error("Error counting images for metrics", "error", err)
+		ch <- prometheus.NewInvalidMetric(dc.librarySize, err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(dc.librarySize, prometheus.GaugeValue, float64(images))
+	}
+
+	var devices []Device
+	if err := dc.db.Find(&devices).Error; err != nil {
+		slog.Error("Error fetching devices for metrics", "error", err)
+		ch <- prometheus.NewInvalidMetric(dc.lastSeen, err)
+		return
+	}
+	for _, device := range devices {
+		if device.LastSeenAt != nil {
+			ch <- prometheus.MustNewConstMetric(dc.lastSeen, prometheus.GaugeValue, float64(device.LastSeenAt.Unix()), device.DeviceID)
+		}
+	}
+
+	batteries, err := latestTelemetryByDevice(dc.db, "battery_level")
+	if err != nil {
+		slog.Error("Error fetching telemetry for metrics", "error", err)
+		ch <- prometheus.NewInvalidMetric(dc.battery, err)
+		return
+	}
+	for _, device := range devices {
+		if telemetry, ok := batteries[device.DeviceID]; ok {
+			ch <- prometheus.MustNewConstMetric(dc.battery, prometheus.GaugeValue, float64(*telemetry.BatteryLevel), device.DeviceID)
+		}
+	}
+}
+
+// newMetricsHandler returns the Prometheus handler serving the server's
+// metrics along with Go runtime and process metrics.
+func newMetricsHandler(db *gorm.DB) http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		deviceRequests,
+		deviceRequestDuration,
+		renderDuration,
+		ditheredCacheLookups,
+		assetBytesServed,
+		newDatabaseCollector(db),
+	)
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+func handleMetricsRequest(c *gin.Context, db *gorm.DB, metrics http.Handler) {
+	// Prometheus scrape endpoint, it lists device IDs so a viewer API key is
+	// required (Prometheus sends it with authorization: credentials)
+	if _, ok := requireAdmin(c, db, roleViewer); !ok {
+		return
+	}
+	metrics.ServeHTTP(c.Writer, c.Request)
+}
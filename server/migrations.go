@@ -0,0 +1,677 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Schema changes are applied as numbered migrations instead of AutoMigrate,
+// so existing installations are upgraded (and can be rolled back) step by
+// step. Each migration declares snapshots of the models as they were at that
+// version, named like the real models so tables and indexes get the same
+// names. Never change a released migration, add a new one instead.
+type migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// SchemaMigration records an applied migration
+type SchemaMigration struct {
+	Version   int `gorm:"primarykey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up: func(tx *gorm.DB) error {
+			// AutoMigrate only creates what is missing, so databases created
+			// before versioned migrations are adopted as they are
+			type Device struct {
+				ID           uint   `gorm:"primarykey"`
+				DeviceID     string `gorm:"uniqueIndex;not null"`
+				DeviceName   string `gorm:"not null"`
+				DeviceToken  string `gorm:"unique"`
+				CurrentImage string
+				CreatedAt    time.Time
+				UpdatedAt    time.Time
+			}
+			type DeviceSetting struct {
+				ID                uint    `gorm:"primarykey"`
+				DeviceID          string  `gorm:"not null"`
+				ImgUpdateInterval int     `gorm:"not null;default:600"`
+				Height            int     `gorm:"not null;default:480"`
+				Width             int     `gorm:"not null;default:800"`
+				Rotation          int     `gorm:"not null;default:0"`
+				Palette           string  `gorm:"not null;default:'7Standard'"`
+				DitherAlgorithm   string  `gorm:"not null;default:'StevenPigeon'"`
+				DitherStrength    float32 `gorm:"not null;default:1.0"`
+				ResizeMethod      string  `gorm:"not null;default:'cut'"`
+				CreatedAt         time.Time
+				UpdatedAt         time.Time
+			}
+			type DeviceTelemetry struct {
+				ID           uint      `gorm:"primarykey"`
+				DeviceID     string    `gorm:"not null"`
+				BatteryLevel int       `gorm:"not null;default:100"`
+				LastSeen     time.Time `gorm:"not null;default:CURRENT_TIMESTAMP"`
+			}
+			type DBImage struct {
+				ID        uint   `gorm:"primarykey"`
+				Path      string `gorm:"uniqueIndex;not null"`
+				UUID      string `gorm:"uniqueIndex;not null"`
+				CreatedAt time.Time
+				UpdatedAt time.Time
+			}
+			type DitheredImage struct {
+				ID              uint    `gorm:"primarykey"`
+				UUID            string  `gorm:"not null"`
+				DBImageUUID     string  `gorm:"not null"`
+				Palette         string  `gorm:"not null"`
+				DitherAlgorithm string  `gorm:"not null"`
+				DitherStrength  float32 `gorm:"not null;default:1.0"`
+				Height          int     `gorm:"not null;default:480"`
+				Width           int     `gorm:"not null;default:800"`
+				ResizeMethod    string  `gorm:"not null;default:'cut'"`
+				Path            string  `gorm:"uniqueIndex;not null"`
+				CreatedAt       time.Time
+				UpdatedAt       time.Time
+			}
+			type RandomImage struct {
+				ID   uint   `gorm:"primarykey"`
+				UUID string `gorm:"uniqueIndex;not null"`
+			}
+			return tx.AutoMigrate(&Device{}, &DeviceSetting{}, &DeviceTelemetry{}, &DBImage{}, &DitheredImage{}, &RandomImage{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("random_images", "dithered_images", "db_images", "device_telemetries", "device_settings", "devices")
+		},
+	},
+	{
+		Version: 2,
+		Name:    "hashed device tokens with expiry",
+		Up: func(tx *gorm.DB) error {
+			type Device struct {
+				DeviceID        string `gorm:"uniqueIndex;not null"`
+				DeviceTokenHash string `gorm:"index"`
+				TokenIssuedAt   time.Time
+				TokenExpiresAt  time.Time
+			}
+			// Plaintext tokens are no longer used, devices need to register again
+			if tx.Migrator().HasColumn(&Device{}, "device_token") {
+				slog.Warn("Dropping plaintext device tokens, devices need to register again")
+				if tx.Migrator().HasConstraint(&Device{}, "uni_devices_device_token") {
+					if err := tx.Migrator().DropConstraint(&Device{}, "uni_devices_device_token"); err != nil {
+						return err
+					}
+				}
+				if err := tx.Migrator().DropColumn(&Device{}, "device_token"); err != nil {
+					return err
+				}
+			}
+			for _, column := range []string{"DeviceTokenHash", "TokenIssuedAt", "TokenExpiresAt"} {
+				if !tx.Migrator().HasColumn(&Device{}, column) {
+					if err := tx.Migrator().AddColumn(&Device{}, column); err != nil {
+						return err
+					}
+				}
+			}
+			// SQLite rebuilds the table to drop a column, which loses its indexes
+			return createMissingIndexes(tx, &Device{}, "DeviceID", "DeviceTokenHash")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Device struct {
+				DeviceID    string `gorm:"uniqueIndex;not null"`
+				DeviceToken string
+			}
+			for _, column := range []string{"device_token_hash", "token_issued_at", "token_expires_at"} {
+				if err := tx.Migrator().DropColumn(&Device{}, column); err != nil {
+					return err
+				}
+			}
+			if err := tx.Migrator().AddColumn(&Device{}, "DeviceToken"); err != nil {
+				return err
+			}
+			return createMissingIndexes(tx, &Device{}, "DeviceID")
+		},
+	},
+	{
+		Version: 3,
+		Name:    "pairing requests",
+		Up: func(tx *gorm.DB) error {
+			type PairingRequest struct {
+				ID         uint   `gorm:"primarykey"`
+				DeviceID   string `gorm:"uniqueIndex;not null"`
+				DeviceName string `gorm:"not null"`
+				Code       string `gorm:"index;not null"`
+				SecretHash string `gorm:"not null"`
+				Approved   bool   `gorm:"not null;default:false"`
+				ExpiresAt  time.Time
+				CreatedAt  time.Time
+				UpdatedAt  time.Time
+			}
+			return tx.AutoMigrate(&PairingRequest{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("pairing_requests")
+		},
+	},
+	{
+		Version: 4,
+		Name:    "admin users and audit log",
+		Up: func(tx *gorm.DB) error {
+			type AdminUser struct {
+				ID           uint   `gorm:"primarykey"`
+				Username     string `gorm:"uniqueIndex;not null"`
+				PasswordHash string
+				APIKeyHash   string `gorm:"index"`
+				Role         string `gorm:"not null;default:'viewer'"`
+				CreatedAt    time.Time
+				UpdatedAt    time.Time
+			}
+			type AuditLog struct {
+				ID         uint   `gorm:"primarykey"`
+				Actor      string `gorm:"index;not null"`
+				Action     string `gorm:"not null"`
+				TargetType string `gorm:"index"`
+				TargetID   string `gorm:"index"`
+				Details    string
+				CreatedAt  time.Time `gorm:"index"`
+			}
+			return tx.AutoMigrate(&AdminUser{}, &AuditLog{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("audit_logs", "admin_users")
+		},
+	},
+	{
+		Version: 5,
+		Name:    "screen history",
+		Up: func(tx *gorm.DB) error {
+			type ScreenHistory struct {
+				ID           uint      `gorm:"primarykey"`
+				DeviceID     string    `gorm:"index;not null"`
+				ImageUUID    string    `gorm:"not null"`
+				DitheredUUID string    `gorm:"not null"`
+				Palette      string    `gorm:"not null"`
+				Width        int       `gorm:"not null"`
+				Height       int       `gorm:"not null"`
+				ShownAt      time.Time `gorm:"not null"`
+			}
+			return tx.AutoMigrate(&ScreenHistory{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("screen_histories")
+		},
+	},
+	{
+		Version: 6,
+		Name:    "display events",
+		Up: func(tx *gorm.DB) error {
+			type DisplayEvent struct {
+				ID           uint      `gorm:"primarykey"`
+				DeviceID     string    `gorm:"index;not null"`
+				ImageUUID    string    `gorm:"index;not null"`
+				DitheredUUID string    `gorm:"not null"`
+				Palette      string    `gorm:"not null"`
+				Width        int       `gorm:"not null"`
+				Height       int       `gorm:"not null"`
+				Trigger      string    `gorm:"not null;default:'timer'"`
+				ShownAt      time.Time `gorm:"index;not null"`
+			}
+			// The screen history becomes the full display history
+			if err := tx.Migrator().RenameTable("screen_histories", "display_events"); err != nil {
+				return err
+			}
+			if err := tx.Migrator().RenameIndex(&DisplayEvent{}, "idx_screen_histories_device_id", "idx_display_events_device_id"); err != nil {
+				return err
+			}
+			if err := tx.Migrator().AddColumn(&DisplayEvent{}, "Trigger"); err != nil {
+				return err
+			}
+			return createMissingIndexes(tx, &DisplayEvent{}, "ImageUUID", "ShownAt")
+		},
+		Down: func(tx *gorm.DB) error {
+			type DisplayEvent struct {
+				DeviceID  string `gorm:"index"`
+				ImageUUID string `gorm:"index"`
+				Trigger   string
+				ShownAt   time.Time `gorm:"index"`
+			}
+			type ScreenHistory struct {
+				DeviceID string `gorm:"index"`
+			}
+			// SQLite rebuilds the table to drop a column, so the indexes are
+			// dropped first and the remaining one created again afterwards
+			for _, field := range []string{"DeviceID", "ImageUUID", "ShownAt"} {
+				if tx.Migrator().HasIndex(&DisplayEvent{}, field) {
+					if err := tx.Migrator().DropIndex(&DisplayEvent{}, field); err != nil {
+						return err
+					}
+				}
+			}
+			if err := tx.Migrator().DropColumn(&DisplayEvent{}, "Trigger"); err != nil {
+				return err
+			}
+			if err := tx.Migrator().RenameTable("display_events", "screen_histories"); err != nil {
+				return err
+			}
+			return createMissingIndexes(tx, &ScreenHistory{}, "DeviceID")
+		},
+	},
+	{
+		Version: 7,
+		Name:    "telemetry time series",
+		Up: func(tx *gorm.DB) error {
+			type Device struct {
+				LastSeenAt *time.Time
+			}
+			type DeviceTelemetry struct {
+				ID              uint      `gorm:"primarykey"`
+				DeviceID        string    `gorm:"index:idx_device_telemetries_device_reported;not null"`
+				ReportedAt      time.Time `gorm:"index:idx_device_telemetries_device_reported;not null"`
+				Downsampled     bool      `gorm:"not null;default:false"`
+				Samples         int       `gorm:"not null;default:1"`
+				BatteryVoltage  *float64
+				BatteryLevel    *int
+				RSSI            *int
+				WifiConnectMs   *int
+				DownloadMs      *int
+				WakeReason      string
+				FreeHeap        *int64
+				FreePSRAM       *int64
+				FirmwareVersion string
+				Temperature     *float64
+			}
+			if err := tx.Migrator().AddColumn(&Device{}, "LastSeenAt"); err != nil {
+				return err
+			}
+			err := tx.Exec(`UPDATE devices SET last_seen_at = (
+				SELECT MAX(last_seen) FROM device_telemetries
+				WHERE device_telemetries.device_id = devices.device_id)`).Error
+			if err != nil {
+				return err
+			}
+			// The old rows are last seen markers, reported battery levels were
+			// never parsed and all hold the default, so there is nothing to keep
+			slog.Warn("Replacing device telemetry, last seen times are kept on the devices")
+			if err := tx.Migrator().DropTable("device_telemetries"); err != nil {
+				return err
+			}
+			return tx.AutoMigrate(&DeviceTelemetry{})
+		},
+		Down: func(tx *gorm.DB) error {
+			type Device struct {
+				DeviceID        string `gorm:"uniqueIndex;not null"`
+				DeviceTokenHash string `gorm:"index"`
+			}
+			type DeviceTelemetry struct {
+				ID           uint      `gorm:"primarykey"`
+				DeviceID     string    `gorm:"not null"`
+				BatteryLevel int       `gorm:"not null;default:100"`
+				LastSeen     time.Time `gorm:"not null;default:CURRENT_TIMESTAMP"`
+			}
+			if err := tx.Migrator().DropTable("device_telemetries"); err != nil {
+				return err
+			}
+			if err := tx.AutoMigrate(&DeviceTelemetry{}); err != nil {
+				return err
+			}
+			err := tx.Exec(`INSERT INTO device_telemetries (device_id, battery_level, last_seen)
+				SELECT device_id, 100, last_seen_at FROM devices WHERE last_seen_at IS NOT NULL`).Error
+			if err != nil {
+				return err
+			}
+			if err := tx.Migrator().DropColumn(&Device{}, "last_seen_at"); err != nil {
+				return err
+			}
+			return createMissingIndexes(tx, &Device{}, "DeviceID", "DeviceTokenHash")
+		},
+	},
+	{
+		Version: 8,
+		Name:    "alerts",
+		Up: func(tx *gorm.DB) error {
+			type DeviceTelemetry struct {
+				DownloadFailures *int
+			}
+			type Alert struct {
+				ID         uint      `gorm:"primarykey"`
+				DeviceID   string    `gorm:"index;not null"`
+				Kind       string    `gorm:"not null"`
+				Message    string    `gorm:"not null"`
+				FiredAt    time.Time `gorm:"index;not null"`
+				ResolvedAt *time.Time
+			}
+			if err := tx.Migrator().AddColumn(&DeviceTelemetry{}, "DownloadFailures"); err != nil {
+				return err
+			}
+			return tx.AutoMigrate(&Alert{})
+		},
+		Down: func(tx *gorm.DB) error {
+			type DeviceTelemetry struct {
+				DeviceID   string    `gorm:"index:idx_device_telemetries_device_reported"`
+				ReportedAt time.Time `gorm:"index:idx_device_telemetries_device_reported"`
+			}
+			if err := tx.Migrator().DropTable("alerts"); err != nil {
+				return err
+			}
+			if err := tx.Migrator().DropColumn(&DeviceTelemetry{}, "download_failures"); err != nil {
+				return err
+			}
+			return createMissingIndexes(tx, &DeviceTelemetry{}, "idx_device_telemetries_device_reported")
+		},
+	},
+	{
+		Version: 9,
+		Name:    "status overlay settings",
+		Up: func(tx *gorm.DB) error {
+			type DeviceSetting struct {
+				OverlayCorner  string `gorm:"not null;default:'off'"`
+				OverlayBattery string `gorm:"not null;default:'low'"`
+				OverlayTime    bool   `gorm:"not null;default:false"`
+				OverlayText    string `gorm:"not null;default:''"`
+			}
+			for _, column := range []string{"OverlayCorner", "OverlayBattery", "OverlayTime", "OverlayText"} {
+				if err := tx.Migrator().AddColumn(&DeviceSetting{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			type DeviceSetting struct{}
+			for _, column := range []string{"overlay_corner", "overlay_battery", "overlay_time", "overlay_text"} {
+				if err := tx.Migrator().DropColumn(&DeviceSetting{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 10,
+		Name:    "playlists and schedules",
+		Up: func(tx *gorm.DB) error {
+			type DeviceSetting struct {
+				Timezone   string `gorm:"not null;default:''"`
+				PlaylistID *uint
+			}
+			type Playlist struct {
+				ID        uint   `gorm:"primarykey"`
+				Name      string `gorm:"uniqueIndex;not null"`
+				CreatedAt time.Time
+				UpdatedAt time.Time
+			}
+			type PlaylistImage struct {
+				ID         uint   `gorm:"primarykey"`
+				PlaylistID uint   `gorm:"uniqueIndex:idx_playlist_images_playlist_image;not null"`
+				ImageUUID  string `gorm:"uniqueIndex:idx_playlist_images_playlist_image;index;not null"`
+			}
+			type DeviceSchedule struct {
+				ID         uint   `gorm:"primarykey"`
+				DeviceID   string `gorm:"index;not null"`
+				Position   int    `gorm:"not null"`
+				Weekdays   string `gorm:"not null;default:''"`
+				Start      string `gorm:"not null"`
+				End        string `gorm:"not null"`
+				Quiet      bool   `gorm:"not null;default:false"`
+				PlaylistID *uint
+			}
+			for _, column := range []string{"Timezone", "PlaylistID"} {
+				if err := tx.Migrator().AddColumn(&DeviceSetting{}, column); err != nil {
+					return err
+				}
+			}
+			return tx.AutoMigrate(&Playlist{}, &PlaylistImage{}, &DeviceSchedule{})
+		},
+		Down: func(tx *gorm.DB) error {
+			type DeviceSetting struct{}
+			for _, table := range []string{"device_schedules", "playlist_images", "playlists"} {
+				if err := tx.Migrator().DropTable(table); err != nil {
+					return err
+				}
+			}
+			for _, column := range []string{"timezone", "playlist_id"} {
+				if err := tx.Migrator().DropColumn(&DeviceSetting{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 11,
+		Name:    "device commands",
+		Up: func(tx *gorm.DB) error {
+			type DeviceCommand struct {
+				ID          uint   `gorm:"primarykey"`
+				DeviceID    string `gorm:"index;not null"`
+				Kind        string `gorm:"not null"`
+				ImageUUID   string `gorm:"not null;default:''"`
+				Seconds     int    `gorm:"not null;default:0"`
+				Status      string `gorm:"index;not null;default:'pending'"`
+				Deliveries  int    `gorm:"not null;default:0"`
+				Result      string `gorm:"not null;default:''"`
+				CreatedBy   string `gorm:"not null;default:''"`
+				CreatedAt   time.Time
+				DeliveredAt *time.Time
+				CompletedAt *time.Time
+			}
+			return tx.AutoMigrate(&DeviceCommand{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("device_commands")
+		},
+	},
+	{
+		Version: 12,
+		Name:    "pinned images",
+		Up: func(tx *gorm.DB) error {
+			type Device struct {
+				PinnedImage string `gorm:"not null;default:''"`
+				PinnedUntil *time.Time
+			}
+			for _, column := range []string{"PinnedImage", "PinnedUntil"} {
+				if err := tx.Migrator().AddColumn(&Device{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			type Device struct{}
+			for _, column := range []string{"pinned_image", "pinned_until"} {
+				if err := tx.Migrator().DropColumn(&Device{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 13,
+		Name:    "device groups",
+		Up: func(tx *gorm.DB) error {
+			type DeviceSetting struct {
+				GroupID   *uint  `gorm:"index"`
+				Overrides string `gorm:"not null;default:''"`
+			}
+			type DeviceGroup struct {
+				ID        uint   `gorm:"primarykey"`
+				Name      string `gorm:"uniqueIndex;not null"`
+				Settings  string `gorm:"not null;default:'{}'"`
+				CreatedAt time.Time
+				UpdatedAt time.Time
+			}
+			for _, column := range []string{"GroupID", "Overrides"} {
+				if err := tx.Migrator().AddColumn(&DeviceSetting{}, column); err != nil {
+					return err
+				}
+			}
+			if err := createMissingIndexes(tx, &DeviceSetting{}, "GroupID"); err != nil {
+				return err
+			}
+			return tx.AutoMigrate(&DeviceGroup{})
+		},
+		Down: func(tx *gorm.DB) error {
+			type DeviceSetting struct {
+				GroupID *uint `gorm:"index"`
+			}
+			if err := tx.Migrator().DropTable("device_groups"); err != nil {
+				return err
+			}
+			if tx.Migrator().HasIndex(&DeviceSetting{}, "GroupID") {
+				if err := tx.Migrator().DropIndex(&DeviceSetting{}, "GroupID"); err != nil {
+					return err
+				}
+			}
+			for _, column := range []string{"group_id", "overrides"} {
+				if err := tx.Migrator().DropColumn(&DeviceSetting{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 14,
+		Name:    "token rotation re-approval",
+		Up: func(tx *gorm.DB) error {
+			type Device struct {
+				ReapprovalRequired bool `gorm:"not null;default:false"`
+			}
+			return tx.Migrator().AddColumn(&Device{}, "ReapprovalRequired")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Device struct{}
+			return tx.Migrator().DropColumn(&Device{}, "reapproval_required")
+		},
+	},
+	{
+		Version: 15,
+		Name:    "pairing code issues",
+		Up: func(tx *gorm.DB) error {
+			type PairingCodeIssue struct {
+				ID       uint      `gorm:"primarykey"`
+				DeviceID string    `gorm:"index;not null"`
+				IssuedAt time.Time `gorm:"index;not null"`
+			}
+			return tx.AutoMigrate(&PairingCodeIssue{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("pairing_code_issues")
+		},
+	},
+}
+
+// createMissingIndexes creates the indexes declared on the given fields of
+// model unless they already exist.
+func createMissingIndexes(tx *gorm.DB, model interface{}, fields ...string) error {
+	for _, field := range fields {
+		if !tx.Migrator().HasIndex(model, field) {
+			if err := tx.Migrator().CreateIndex(model, field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// latestSchemaVersion is the version the code expects
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+func appliedMigrations(db *gorm.DB) (map[int]SchemaMigration, error) {
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+	var applied []SchemaMigration
+	if err := db.Find(&applied).Error; err != nil {
+		return nil, fmt.Errorf("failed to read applied migrations: %w", err)
+	}
+	result := make(map[int]SchemaMigration, len(applied))
+	for _, m := range applied {
+		result[m.Version] = m
+	}
+	return result, nil
+}
+
+// migrateUp applies all pending migrations up to and including target.
+func migrateUp(db *gorm.DB, target int) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.Version > target {
+			break
+		}
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Name, err)
+		}
+		slog.Info("Applied migration", "version", m.Version, "name", m.Name)
+	}
+	return nil
+}
+
+// migrateDown rolls back applied migrations newer than target.
+func migrateDown(db *gorm.DB, target int) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version <= target {
+			break
+		}
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&SchemaMigration{}, m.Version).Error
+		})
+		if err != nil {
+			return fmt.Errorf("rollback of migration %d (%s) failed: %w", m.Version, m.Name, err)
+		}
+		slog.Info("Rolled back migration", "version", m.Version, "name", m.Name)
+	}
+	return nil
+}
+
+// printMigrationStatus lists all migrations and whether they are applied.
+func printMigrationStatus(db *gorm.DB) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if a, ok := applied[m.Version]; ok {
+			fmt.Printf("%4d  applied %s  %s\n", m.Version, a.AppliedAt.Format(time.RFC3339), m.Name)
+		} else {
+			fmt.Printf("%4d  pending                    %s\n", m.Version, m.Name)
+		}
+	}
+	return nil
+}
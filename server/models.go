@@ -14,10 +14,23 @@ type Device struct {
 	ID           uint   `gorm:"primarykey"`
 	DeviceID     string `gorm:"uniqueIndex;not null"`
 	DeviceName   string `gorm:"not null"`
-	DeviceToken  string `gorm:"unique"`
 	CurrentImage string
 	CreatedAt    time.Time
 	UpdatedAt    time.Time
+	// Only a SHA-256 hash of the bearer token is stored
+	DeviceTokenHash string `gorm:"index" json:"-"`
+	TokenIssuedAt   time.Time
+	TokenExpiresAt  time.Time
+	// Last authenticated request, kept apart from UpdatedAt which tracks
+	// image changes
+	LastSeenAt *time.Time
+	// Image shown instead of the playlist until PinnedUntil, or until
+	// unpinned if nil, see pins.go
+	PinnedImage string `gorm:"not null;default:''"`
+	PinnedUntil *time.Time
+	// Set by a forced token rotation, the frame needs its pairing secret or
+	// a new pairing approval to register again
+	ReapprovalRequired bool `gorm:"not null;default:false"`
 }
 
 type DeviceSetting struct {
@@ -31,17 +44,47 @@ type DeviceSetting struct {
 	DitherAlgorithm   string  `gorm:"not null;default:'StevenPigeon'"`
 	DitherStrength    float32 `gorm:"not null;default:1.0"`
 	ResizeMethod      string  `gorm:"not null;default:'cut'"`
-	CreatedAt         time.Time
-	UpdatedAt         time.Time
-	Device            Device `gorm:"foreignKey:DeviceID;references:DeviceID"`
+	// Status overlay, see overlay.go
+	OverlayCorner  string `gorm:"not null;default:'off'"`
+	OverlayBattery string `gorm:"not null;default:'low'"`
+	OverlayTime    bool   `gorm:"not null;default:false"`
+	OverlayText    string `gorm:"not null;default:''"`
+	// IANA time zone schedules are evaluated in, the server's if empty
+	Timezone string `gorm:"not null;default:''"`
+	// Playlist shown outside schedule windows, the whole library if nil
+	PlaylistID *uint
+	// Group whose defaults apply to the settings the device does not
+	// override, see groups.go
+	GroupID *uint `gorm:"index"`
+	// Comma separated names of the settings set on the device itself
+	Overrides string `gorm:"not null;default:''"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Device    Device `gorm:"foreignKey:DeviceID;references:DeviceID"`
 }
 
+// DeviceTelemetry is a telemetry report of a device. Fields the device did
+// not report are NULL. Reports older than telemetry_raw_days are merged into
+// one Downsampled row per device and hour, holding the averages of the
+// Samples reports it replaces.
 type DeviceTelemetry struct {
-	ID           uint      `gorm:"primarykey"`
-	DeviceID     string    `gorm:"not null"`
-	BatteryLevel int       `gorm:"not null;default:100"`
-	LastSeen     time.Time `gorm:"not null;default:CURRENT_TIMESTAMP"`
-	Device       Device    `gorm:"foreignKey:DeviceID;references:DeviceID"`
+	ID              uint      `gorm:"primarykey"`
+	DeviceID        string    `gorm:"index:idx_device_telemetries_device_reported;not null"`
+	ReportedAt      time.Time `gorm:"index:idx_device_telemetries_device_reported;not null"`
+	Downsampled     bool      `gorm:"not null;default:false"`
+	Samples         int       `gorm:"not null;default:1"`
+	BatteryVoltage  *float64  // V
+	BatteryLevel    *int      // percent
+	RSSI            *int      // dBm
+	WifiConnectMs   *int
+	DownloadMs      *int
+	WakeReason      string
+	FreeHeap        *int64 // bytes
+	FreePSRAM       *int64 // bytes
+	FirmwareVersion string
+	Temperature     *float64 // °C
+	// Failed image downloads since the last successful one
+	DownloadFailures *int
 }
 
 type DBImage struct {
@@ -72,3 +115,134 @@ type RandomImage struct {
 	ID   uint   `gorm:"primarykey"`
 	UUID string `gorm:"uniqueIndex;not null"`
 }
+
+type PairingRequest struct {
+	ID         uint   `gorm:"primarykey"`
+	DeviceID   string `gorm:"uniqueIndex;not null"`
+	DeviceName string `gorm:"not null"`
+	Code       string `gorm:"index;not null"`
+	SecretHash string `gorm:"not null" json:"-"`
+	Approved   bool   `gorm:"not null;default:false"`
+	ExpiresAt  time.Time
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// PairingCodeIssue records that a pairing code was issued to a device_id, so
+// the number of codes per device can be limited, see allowPairingCode
+type PairingCodeIssue struct {
+	ID       uint      `gorm:"primarykey"`
+	DeviceID string    `gorm:"index;not null"`
+	IssuedAt time.Time `gorm:"index;not null"`
+}
+
+type AdminUser struct {
+	ID           uint   `gorm:"primarykey"`
+	Username     string `gorm:"uniqueIndex;not null"`
+	PasswordHash string `json:"-"`
+	APIKeyHash   string `gorm:"index" json:"-"`
+	Role         string `gorm:"not null;default:'viewer'"`
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+type AuditLog struct {
+	ID         uint   `gorm:"primarykey"`
+	Actor      string `gorm:"index;not null"`
+	Action     string `gorm:"not null"`
+	TargetType string `gorm:"index"`
+	TargetID   string `gorm:"index"`
+	Details    string
+	CreatedAt  time.Time `gorm:"index"`
+}
+
+// DisplayEvent records an image sent to a device, with what triggered the
+// update. The payload files are named after DitheredUUID, so recent screens
+// can be reconstructed.
+type DisplayEvent struct {
+	ID           uint      `gorm:"primarykey"`
+	DeviceID     string    `gorm:"index;not null"`
+	ImageUUID    string    `gorm:"index;not null"`
+	DitheredUUID string    `gorm:"not null"`
+	Palette      string    `gorm:"not null"`
+	Width        int       `gorm:"not null"`
+	Height       int       `gorm:"not null"`
+	Trigger      string    `gorm:"not null;default:'timer'"`
+	ShownAt      time.Time `gorm:"index;not null"`
+}
+
+// Playlist is a named selection of library images, shown in the shuffled
+// order of the library.
+type Playlist struct {
+	ID        uint   `gorm:"primarykey"`
+	Name      string `gorm:"uniqueIndex;not null"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// DeviceGroup shares settings between devices. Settings holds defaults as a
+// JSON object in the format of the device_settings request, settings left
+// out are up to each device.
+type DeviceGroup struct {
+	ID        uint   `gorm:"primarykey"`
+	Name      string `gorm:"uniqueIndex;not null"`
+	Settings  string `gorm:"not null;default:'{}'"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+type PlaylistImage struct {
+	ID         uint   `gorm:"primarykey"`
+	PlaylistID uint   `gorm:"uniqueIndex:idx_playlist_images_playlist_image;not null"`
+	ImageUUID  string `gorm:"uniqueIndex:idx_playlist_images_playlist_image;index;not null"`
+}
+
+// DeviceSchedule is a weekly time window of a device, see device_schedules.go.
+// Windows are checked by Position and the first one matching applies.
+type DeviceSchedule struct {
+	ID       uint   `gorm:"primarykey"`
+	DeviceID string `gorm:"index;not null"`
+	Position int    `gorm:"not null"`
+	// Comma separated days the window starts on (mon to sun), every day if
+	// empty
+	Weekdays string `gorm:"not null;default:''"`
+	// HH:MM in the device's time zone, End before Start spans midnight and
+	// End equal to Start lasts a whole day
+	Start string `gorm:"not null"`
+	End   string `gorm:"not null"`
+	// No image updates, the device sleeps through the window
+	Quiet bool `gorm:"not null;default:false"`
+	// Playlist shown during the window, the device's playlist if nil
+	PlaylistID *uint
+}
+
+// Alert is a problem detected on a device. It stays open until the condition
+// clears, so every problem is notified once when it starts and once when it
+// is resolved.
+type Alert struct {
+	ID         uint      `gorm:"primarykey"`
+	DeviceID   string    `gorm:"index;not null"`
+	Kind       string    `gorm:"not null"`
+	Message    string    `gorm:"not null"`
+	FiredAt    time.Time `gorm:"index;not null"`
+	ResolvedAt *time.Time
+}
+
+// DeviceCommand is an instruction queued for a device, see device_commands.go.
+// It is sent with every response to the device until acknowledged.
+type DeviceCommand struct {
+	ID       uint   `gorm:"primarykey"`
+	DeviceID string `gorm:"index;not null"`
+	Kind     string `gorm:"not null"`
+	// Image of a show_image command
+	ImageUUID string `gorm:"not null;default:''"`
+	// Interval of a set_interval command
+	Seconds     int    `gorm:"not null;default:0"`
+	Status      string `gorm:"index;not null;default:'pending'"`
+	Deliveries  int    `gorm:"not null;default:0"`
+	Result      string `gorm:"not null;default:''"`
+	CreatedBy   string `gorm:"not null;default:''"`
+	CreatedAt   time.Time
+	DeliveredAt *time.Time
+	CompletedAt *time.Time
+}
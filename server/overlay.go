@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"slices"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"gorm.io/gorm"
+)
+
+// Corners the overlay can be drawn in, off disables it
+var overlayCorners = []string{"off", "top_left", "top_right", "bottom_left", "bottom_right"}
+
+// When the battery icon is shown: below alerts.battery_threshold, always or
+// never
+var overlayBatteryModes = []string{"low", "always", "never"}
+
+// Longest custom overlay text, it has to fit on one line
+const maxOverlayTextLength = 64
+
+func validateOverlaySettings(corner string, battery string, text string) error {
+	if !slices.Contains(overlayCorners, corner) {
+		return fmt.Errorf("unknown overlay corner %q, available: %v", corner, overlayCorners)
+	}
+	if !slices.Contains(overlayBatteryModes, battery) {
+		return fmt.Errorf("unknown overlay battery mode %q, available: %v", battery, overlayBatteryModes)
+	}
+	if len(text) > maxOverlayTextLength {
+		return fmt.Errorf("overlay text must be at most %d characters", maxOverlayTextLength)
+	}
+	for _, r := range text {
+		if r < ' ' || r > '~' {
+			return fmt.Errorf("overlay text can only use printable ASCII characters, the bundled font has no others")
+		}
+	}
+	return nil
+}
+
+// overlay is the status drawn onto the image of a device
+type overlay struct {
+	Corner string
+	// nil hides the battery icon
+	BatteryLevel *int
+	BatteryLow   bool
+	Lines        []string
+}
+
+func (o overlay) empty() bool {
+	return o.Corner == "off" || (o.BatteryLevel == nil && len(o.Lines) == 0)
+}
+
+// deviceOverlay builds the overlay of a device from its settings and latest
+// telemetry.
+func deviceOverlay(db *gorm.DB, settings DeviceSetting, now time.Time) (overlay, error) {
+	o := overlay{Corner: settings.OverlayCorner}
+	if o.Corner == "off" {
+		return o, nil
+	}
+	if settings.OverlayBattery != "never" {
+		telemetry, found, err := latestTelemetry(db, settings.DeviceID, "battery_level")
+		if err != nil {
+			return overlay{}, fmt.Errorf("failed to fetch telemetry of device %s: %w", settings.DeviceID, err)
+		}
+		if found {
+			o.BatteryLow = *telemetry.BatteryLevel < config().Alerts.BatteryThreshold
+			if o.BatteryLow || settings.OverlayBattery == "always" {
+				o.BatteryLevel = telemetry.BatteryLevel
+			}
+		}
+	}
+	if settings.OverlayTime {
+		o.Lines = append(o.Lines, "Updated "+now.Format("Mon 15:04"))
+	}
+	if settings.OverlayText != "" {
+		o.Lines = append(o.Lines, settings.OverlayText)
+	}
+	return o, nil
+}
+
+// Overlay layout in font pixels, scaled up with the image size
+const (
+	overlayPadding    = 3
+	overlayLineHeight = 15
+	overlayMargin     = 4
+	batteryWidth      = 20
+	batteryHeight     = 10
+)
+
+// drawOverlay draws o on a white box in its corner of img. Only colors of
+// palette are used (black, white and red), so they survive dithering.
+func drawOverlay(img draw.Image, palette []color.Color, o overlay) {
+	if o.empty() {
+		return
+	}
+	black, white, red := palette[0], palette[1], palette[0]
+	if len(palette) > 4 {
+		red = palette[4]
+	}
+	bounds := img.Bounds()
+	scale := max(1, min(bounds.Dx(), bounds.Dy())/240)
+	face := basicfont.Face7x13
+	maxChars := (bounds.Dx()/scale - 2*overlayMargin - 2*overlayPadding) / face.Advance
+
+	// Rows of the box: the battery, then the text lines
+	var rows []string
+	if o.BatteryLevel != nil {
+		rows = append(rows, fmt.Sprintf("%d%%", *o.BatteryLevel))
+	}
+	for _, line := range o.Lines {
+		if len(line) > maxChars {
+			line = line[:max(0, maxChars)]
+		}
+		rows = append(rows, line)
+	}
+	width := 0
+	for i, row := range rows {
+		rowWidth := len(row) * face.Advance
+		if i == 0 && o.BatteryLevel != nil {
+			rowWidth += batteryWidth + 2 + overlayPadding
+		}
+		width = max(width, rowWidth)
+	}
+	box := image.NewRGBA(image.Rect(0, 0, width+2*overlayPadding, len(rows)*overlayLineHeight+2*overlayPadding))
+	draw.Draw(box, box.Bounds(), image.NewUniform(white), image.Point{}, draw.Src)
+
+	drawer := font.Drawer{Dst: box, Src: image.NewUniform(black), Face: face}
+	for i, row := range rows {
+		x := overlayPadding
+		top := overlayPadding + i*overlayLineHeight
+		if i == 0 && o.BatteryLevel != nil {
+			batteryColor := black
+			if o.BatteryLow {
+				batteryColor = red
+			}
+			drawBattery(box, image.Pt(x, top+(overlayLineHeight-batteryHeight)/2), *o.BatteryLevel, batteryColor)
+			x += batteryWidth + 2 + overlayPadding
+		}
+		drawer.Dot = fixed.P(x, top+face.Ascent+1)
+		drawer.DrawString(row)
+	}
+
+	// Scale the box up and place it in the corner
+	size := box.Bounds().Size().Mul(scale)
+	margin := overlayMargin * scale
+	origin := image.Pt(bounds.Min.X+margin, bounds.Min.Y+margin)
+	if o.Corner == "top_right" || o.Corner == "bottom_right" {
+		origin.X = bounds.Max.X - margin - size.X
+	}
+	if o.Corner == "bottom_left" || o.Corner == "bottom_right" {
+		origin.Y = bounds.Max.Y - margin - size.Y
+	}
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			if image.Pt(origin.X+x, origin.Y+y).In(bounds) {
+				img.Set(origin.X+x, origin.Y+y, box.At(x/scale, y/scale))
+			}
+		}
+	}
+}
+
+// drawBattery draws a battery icon filled to level percent at pos
+func drawBattery(img draw.Image, pos image.Point, level int, c color.Color) {
+	fill := image.NewUniform(c)
+	outline := image.Rect(0, 0, batteryWidth, batteryHeight).Add(pos)
+	for _, edge := range []image.Rectangle{
+		{outline.Min, image.Pt(outline.Max.X, outline.Min.Y+1)},
+		{image.Pt(outline.Min.X, outline.Max.Y-1), outline.Max},
+		{outline.Min, image.Pt(outline.Min.X+1, outline.Max.Y)},
+		{image.Pt(outline.Max.X-1, outline.Min.Y), outline.Max},
+	} {
+		draw.Draw(img, edge, fill, image.Point{}, draw.Src)
+	}
+	// Terminal
+	draw.Draw(img, image.Rect(outline.Max.X, outline.Min.Y+3, outline.Max.X+2, outline.Max.Y-3), fill, image.Point{}, draw.Src)
+	inner := outline.Inset(2)
+	level = min(max(level, 0), 100)
+	filled := (inner.Dx()*level + 50) / 100
+	if level > 0 {
+		filled = max(filled, 1)
+	}
+	draw.Draw(img, image.Rect(inner.Min.X, inner.Min.Y, inner.Min.X+filled, inner.Max.Y), fill, image.Point{}, draw.Src)
+}
+
+// renderDeviceImage returns the dithered image to send to a device. Without
+// an overlay the cached rendering is used. An overlay changes with telemetry
+// and time, so the image is rendered afresh between resizing and dithering;
+// the returned record is not saved, its UUID only names the payload files.
+func renderDeviceImage(ctx context.Context, db *gorm.DB, source DBImage, settings DeviceSetting) (DitheredImage, image.Image, error) {
+	o, err := deviceOverlay(db, settings, time.Now())
+	if err != nil {
+		return DitheredImage{}, nil, err
+	}
+	if o.empty() {
+		dithered, err := getDithered(ctx, db, source, settings.Palette, settings.DitherAlgorithm, settings.DitherStrength, settings.Width, settings.Height, settings.ResizeMethod)
+		if err != nil {
+			return DitheredImage{}, nil, fmt.Errorf("failed to get dithered image: %w", err)
+		}
+		img, err := loadImage(dithered.Path)
+		if err != nil {
+			return DitheredImage{}, nil, fmt.Errorf("failed to load dithered image: %w", err)
+		}
+		return dithered, img, nil
+	}
+
+	defer observeRender(time.Now(), true)
+	img, err := loadImage(source.Path)
+	if err != nil {
+		return DitheredImage{}, nil, fmt.Errorf("failed to load image %s: %w", source.Path, err)
+	}
+	loggerFrom(ctx).Debug("Rendering image with overlay", "image_uuid", source.UUID)
+	resized := resizeImage(img, settings.Width, settings.Height, "Lanczos", settings.ResizeMethod)
+	canvas, ok := resized.(*image.RGBA)
+	if !ok {
+		canvas = image.NewRGBA(resized.Bounds())
+		draw.Draw(canvas, canvas.Bounds(), resized, resized.Bounds().Min, draw.Src)
+	}
+	palette := palettes[settings.Palette]
+	drawOverlay(canvas, palette, o)
+	dithered := ditherResized(canvas, settings.Palette, settings.DitherAlgorithm, settings.DitherStrength)
+	// Error diffused from the photo speckles the box, draw it again in exact
+	// palette colors
+	if target, ok := dithered.(draw.Image); ok {
+		drawOverlay(target, palette, o)
+	}
+	return DitheredImage{
+		UUID:            generateUUID(),
+		DBImageUUID:     source.UUID,
+		Palette:         settings.Palette,
+		DitherAlgorithm: settings.DitherAlgorithm,
+		DitherStrength:  settings.DitherStrength,
+		Width:           settings.Width,
+		Height:          settings.Height,
+		ResizeMethod:    settings.ResizeMethod,
+	}, dithered, nil
+}
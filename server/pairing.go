@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// How long a pairing code shown on an unknown frame stays valid
+const pairingCodeTTL = 15 * time.Minute
+
+// Number of digits in a pairing code
+const pairingCodeLength = 6
+
+// At most this many pairing codes are issued per device_id within
+// pairingCodeWindow, so a caller can not cycle through codes
+const (
+	pairingCodeLimit  = 3
+	pairingCodeWindow = time.Hour
+)
+
+// allowPairingCode records a new pairing code for deviceID at now, unless the
+// device_id reached pairingCodeLimit. retryAfter tells when the next code may
+// be issued if not. Issued codes are kept in the database, so the limit holds
+// across restarts and is shared by all instances.
+func allowPairingCode(db *gorm.DB, deviceID string, now time.Time) (ok bool, retryAfter time.Duration, err error) {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("issued_at <= ?", now.Add(-pairingCodeWindow)).Delete(&PairingCodeIssue{}).Error; err != nil {
+			return err
+		}
+		var issued []PairingCodeIssue
+		if err := tx.Where("device_id = ?", deviceID).Order("issued_at").Find(&issued).Error; err != nil {
+			return err
+		}
+		if len(issued) >= pairingCodeLimit {
+			retryAfter = issued[0].IssuedAt.Add(pairingCodeWindow).Sub(now)
+			return nil
+		}
+		ok = true
+		return tx.Create(&PairingCodeIssue{DeviceID: deviceID, IssuedAt: now}).Error
+	})
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to check pairing code limit: %w", err)
+	}
+	return ok, retryAfter, nil
+}
+
+func generatePairingCode() (string, error) {
+	code := make([]byte, pairingCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", fmt.Errorf("failed to generate pairing code: %w", err)
+		}
+		code[i] = byte('0' + n.Int64())
+	}
+	return string(code), nil
+}
+
+// generateUniquePairingCode returns a code that is not used by any pending
+// pairing request.
+func generateUniquePairingCode(db *gorm.DB) (string, error) {
+	for attempt := 0; attempt < 10; attempt++ {
+		code, err := generatePairingCode()
+		if err != nil {
+			return "", err
+		}
+		var count int64
+		if err := db.Model(&PairingRequest{}).Where("code = ? AND approved = ?", code, false).Count(&count).Error; err != nil {
+			return "", fmt.Errorf("failed to check pairing code: %w", err)
+		}
+		if count == 0 {
+			return code, nil
+		}
+	}
+	return "", fmt.Errorf("failed to find an unused pairing code")
+}
+
+// handlePairingRequest is called by /register for frames that are not known
+// yet. The first call returns a pairing code to show on the screen together
+// with a secret the frame keeps; later calls presenting the secret report the
+// same code until an admin approves it. Calls without the secret are turned
+// away while the code is valid, a new code is only issued once it expired.
+func handlePairingRequest(c *gin.Context, db *gorm.DB, deviceID string, deviceName string, pairingSecret string) error {
+	logger := requestLogger(c)
+	now := time.Now()
+	// Drop stale requests so unknown devices can not fill up the table
+	if err := db.Where("approved = ? AND expires_at < ?", false, now).Delete(&PairingRequest{}).Error; err != nil {
+		logger.Error("Error cleaning expired pairing requests", "error", err)
+	}
+
+	var pairing PairingRequest
+	result := db.Where("device_id = ?", deviceID).First(&pairing)
+	if result.Error != nil && result.Error != gorm.ErrRecordNotFound {
+		logger.Error("Error checking pairing request", "error", result.Error)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return result.Error
+	}
+	pending := result.Error == nil && !pairing.Approved && pairing.ExpiresAt.After(now)
+	if pending && pairingSecret != "" && hashToken(pairingSecret) == pairing.SecretHash {
+		c.JSON(http.StatusAccepted, successResponse(map[string]interface{}{
+			"message":      "Pairing pending",
+			"pairing_code": pairing.Code,
+			"expires_at":   pairing.ExpiresAt,
+		}))
+		return nil
+	}
+	if pending {
+		c.JSON(http.StatusConflict, errorResponse("Pairing already pending for this device"))
+		logger.Warn("Pairing request without the pairing secret, code kept")
+		return fmt.Errorf("pairing secret mismatch for device %s", deviceID)
+	}
+
+	// Start a new pairing, replacing any expired or approved request for this
+	// device_id
+	ok, retryAfter, err := allowPairingCode(db, deviceID, now)
+	if err != nil {
+		logger.Error("Error checking pairing code limit", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return err
+	}
+	if !ok {
+		c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		c.JSON(http.StatusTooManyRequests, errorResponse("Too many pairing requests, try again later"))
+		logger.Warn("Pairing code limit reached")
+		return fmt.Errorf("pairing code limit reached for device %s", deviceID)
+	}
+	code, err := generateUniquePairingCode(db)
+	if err != nil {
+		logger.Error("Error generating pairing code", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return err
+	}
+	secret, err := generateToken()
+	if err != nil {
+		logger.Error("Error generating pairing secret", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return err
+	}
+	pairing.DeviceID = deviceID
+	pairing.DeviceName = deviceName
+	pairing.Code = code
+	pairing.SecretHash = hashToken(secret)
+	pairing.Approved = false
+	pairing.ExpiresAt = now.Add(pairingCodeTTL)
+	if err := db.Save(&pairing).Error; err != nil {
+		logger.Error("Error saving pairing request", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return err
+	}
+
+	c.JSON(http.StatusAccepted, successResponse(map[string]interface{}{
+		"message":        "Pairing required",
+		"pairing_code":   code,
+		"pairing_secret": secret,
+		"expires_at":     pairing.ExpiresAt,
+	}))
+	logger.Info("Pairing requested", "device_name", deviceName, "code", code)
+	return nil
+}
+
+// findApprovedPairing returns the approved pairing request of a device and
+// verifies that the caller holds the pairing secret, proving it is the frame
+// that showed the code. found is false if the device was not enrolled through
+// a pairing code. Approved requests are kept as the frame's long-lived
+// credential for registering again, until a token rotation drops them.
+func findApprovedPairing(db *gorm.DB, deviceID string, pairingSecret string) (pairing PairingRequest, found bool, err error) {
+	result := db.Where("device_id = ? AND approved = ?", deviceID, true).First(&pairing)
+	if result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			return PairingRequest{}, false, nil
+		}
+		return PairingRequest{}, false, result.Error
+	}
+	if pairingSecret == "" || hashToken(pairingSecret) != pairing.SecretHash {
+		return pairing, true, fmt.Errorf("pairing secret mismatch")
+	}
+	return pairing, true, nil
+}
+
+// forgetDevicePairing drops the pairing of a device and requires a new
+// pairing approval before it can register again. A token the device still
+// holds keeps working until it expires or is rotated.
+func forgetDevicePairing(ctx context.Context, db *gorm.DB, device *Device) error {
+	if err := db.Model(device).UpdateColumn("reapproval_required", true).Error; err != nil {
+		return fmt.Errorf("failed to require re-approval: %w", err)
+	}
+	device.ReapprovalRequired = true
+	if err := db.Where("device_id = ?", device.DeviceID).Delete(&PairingRequest{}).Error; err != nil {
+		return fmt.Errorf("failed to revoke pairing: %w", err)
+	}
+	loggerFrom(ctx).Info("Revoked pairing, device needs approval again", "device_name", device.DeviceName)
+	return nil
+}
+
+func handleAdminPairingListRequest(c *gin.Context, db *gorm.DB) {
+	if _, ok := requireAdmin(c, db, roleViewer); !ok {
+		return
+	}
+	var pairings []PairingRequest
+	if err := db.Where("approved = ? AND expires_at >= ?", false, time.Now()).Order("created_at ASC").Find(&pairings).Error; err != nil {
+		requestLogger(c).Error("Error fetching pairing requests", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"pairing_requests": pairings,
+	}))
+}
+
+// findPendingPairing looks up a pending, unexpired pairing request by code and
+// writes the error response if there is none.
+func findPendingPairing(c *gin.Context, db *gorm.DB) (PairingRequest, map[string]interface{}, bool) {
+	var requestData map[string]interface{}
+	if err := c.BindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse("Invalid JSON"))
+		return PairingRequest{}, nil, false
+	}
+	code, ok := requestData["code"].(string)
+	if !ok || code == "" {
+		c.JSON(http.StatusBadRequest, errorResponse("code is required"))
+		return PairingRequest{}, nil, false
+	}
+	var pairing PairingRequest
+	result := db.Where("code = ? AND approved = ? AND expires_at >= ?", code, false, time.Now()).First(&pairing)
+	if result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, errorResponse("Pairing code not found or expired"))
+		} else {
+			requestLogger(c).Error("Error fetching pairing request", "error", result.Error)
+			c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		}
+		return PairingRequest{}, nil, false
+	}
+	return pairing, requestData, true
+}
+
+func handleAdminPairingApproveRequest(c *gin.Context, db *gorm.DB) {
+	// Approve a pairing code, creating the device unless it is pairing again
+	// after a token rotation. The frame receives its token the next time it
+	// calls /register with its pairing secret.
+	admin, ok := requireAdmin(c, db, roleEditor)
+	if !ok {
+		return
+	}
+	pairing, requestData, ok := findPendingPairing(c, db)
+	if !ok {
+		return
+	}
+	deviceName := pairing.DeviceName
+	if name, ok := requestData["device_name"].(string); ok && name != "" {
+		deviceName = name
+	}
+
+	device := Device{
+		DeviceID:   pairing.DeviceID,
+		DeviceName: deviceName,
+		CreatedAt:  time.Now(),
+		UpdatedAt:  time.Now(),
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var existing Device
+		result := tx.Where("device_id = ?", device.DeviceID).Limit(1).Find(&existing)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected > 0 {
+			if !existing.ReapprovalRequired {
+				return fmt.Errorf("device with this device_id already exists")
+			}
+			// Pairing again after a token rotation, the device and its
+			// settings stay as they are
+			device = existing
+			pairing.Approved = true
+			return tx.Save(&pairing).Error
+		}
+		if err := tx.Create(&device).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&DeviceSetting{DeviceID: device.DeviceID}).Error; err != nil {
+			return err
+		}
+		pairing.Approved = true
+		return tx.Save(&pairing).Error
+	})
+	if err != nil {
+		requestLogger(c).Error("Error approving pairing code", "code", pairing.Code, "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Failed to approve pairing"))
+		return
+	}
+
+	recordAudit(db, admin, "pairing_approve", "device", device.DeviceID, "code="+pairing.Code+" name="+device.DeviceName)
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"message":     "Pairing approved",
+		"device_id":   device.DeviceID,
+		"device_name": device.DeviceName,
+	}))
+	requestLogger(c).Info("Pairing approved", "device_id", device.DeviceID, "device_name", device.DeviceName, "code", pairing.Code)
+}
+
+func handleAdminPairingRejectRequest(c *gin.Context, db *gorm.DB) {
+	admin, ok := requireAdmin(c, db, roleEditor)
+	if !ok {
+		return
+	}
+	pairing, _, ok := findPendingPairing(c, db)
+	if !ok {
+		return
+	}
+	if err := db.Delete(&pairing).Error; err != nil {
+		requestLogger(c).Error("Error deleting pairing request", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	recordAudit(db, admin, "pairing_reject", "device", pairing.DeviceID, "code="+pairing.Code)
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"message":   "Pairing rejected",
+		"device_id": pairing.DeviceID,
+	}))
+	requestLogger(c).Info("Pairing rejected", "device_id", pairing.DeviceID, "code", pairing.Code)
+}
+
+func handleAdminForgetPairingRequest(c *gin.Context, db *gorm.DB) {
+	// Drop the pairing of a frame that lost its pairing secret, e.g. after a
+	// factory reset, so it can be paired again
+	admin, ok := requireAdmin(c, db, roleEditor)
+	if !ok {
+		return
+	}
+	var requestData map[string]interface{}
+	if err := c.BindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse("Invalid JSON"))
+		return
+	}
+	deviceID, ok := requestData["device_id"].(string)
+	if !ok || deviceID == "" {
+		c.JSON(http.StatusBadRequest, errorResponse("device_id is required"))
+		return
+	}
+	var device Device
+	result := db.Where("device_id = ?", deviceID).First(&device)
+	if result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, errorResponse("Device not found"))
+		} else {
+			requestLogger(c).Error("Error fetching device", "error", result.Error)
+			c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		}
+		return
+	}
+	ctx := withLogger(c.Request.Context(), requestLogger(c).With("device_id", device.DeviceID))
+	if err := forgetDevicePairing(ctx, db, &device); err != nil {
+		requestLogger(c).Error("Error forgetting pairing", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	recordAudit(db, admin, "device_forget_pairing", "device", device.DeviceID, "reapproval_required")
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"message":   "Pairing forgotten, device must be approved again through a new pairing code",
+		"device_id": device.DeviceID,
+	}))
+}
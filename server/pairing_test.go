@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestForgetPairingLetsResetFramePairAgain(t *testing.T) {
+	useTestConfig(t, nil)
+	db := newTestDB(t)
+	server := newTestServer(t, db)
+	_, token := pairTestDevice(t, server, "reset-frame")
+
+	// The frame was reflashed and lost its token and pairing secret
+	if status, _ := registerDevice(t, server, "reset-frame", ""); status != http.StatusUnauthorized {
+		t.Fatalf("register without the secret: status %d, want 401", status)
+	}
+
+	status, response := postJSON(t, server, "/admin/device_forget_pairing", testAdminKey, map[string]interface{}{"device_id": "reset-frame"})
+	if status != http.StatusOK {
+		t.Fatalf("forget pairing: status %d: %+v", status, response)
+	}
+	// A token the frame still holds is not revoked
+	if status, _ := postJSON(t, server, "/dev", token, map[string]interface{}{"action": "get_settings"}); status != http.StatusOK {
+		t.Errorf("token after forgetting the pairing: status %d, want 200", status)
+	}
+
+	status, response = registerDevice(t, server, "reset-frame", "")
+	if status != http.StatusAccepted {
+		t.Fatalf("register after forgetting the pairing: status %d, want 202: %+v", status, response)
+	}
+	data := responseData(t, response)
+	secret, _ := data["pairing_secret"].(string)
+	approvePairing(t, server, data["pairing_code"].(string))
+	newToken := registerWithSecret(t, server, "reset-frame", secret)
+	if status, _ := postJSON(t, server, "/dev", newToken, map[string]interface{}{"action": "get_settings"}); status != http.StatusOK {
+		t.Errorf("new token: status %d, want 200", status)
+	}
+
+	status, _ = postJSON(t, server, "/admin/device_forget_pairing", testAdminKey, map[string]interface{}{"device_id": "unknown"})
+	if status != http.StatusNotFound {
+		t.Errorf("unknown device: status %d, want 404", status)
+	}
+}
+
+func TestApprovedPairingIsNotReportedPending(t *testing.T) {
+	useTestConfig(t, nil)
+	db := newTestDB(t)
+	server := newTestServer(t, db)
+	secret, _ := pairTestDevice(t, server, "gone-frame")
+	var pairing PairingRequest
+	if err := db.Where("device_id = ?", "gone-frame").First(&pairing).Error; err != nil {
+		t.Fatalf("fetch pairing: %v", err)
+	}
+	// The device row is gone while its approved pairing is left behind
+	if err := db.Where("device_id = ?", "gone-frame").Delete(&Device{}).Error; err != nil {
+		t.Fatalf("delete device: %v", err)
+	}
+
+	status, response := registerDevice(t, server, "gone-frame", secret)
+	if status != http.StatusAccepted {
+		t.Fatalf("register: status %d, want 202: %+v", status, response)
+	}
+	data := responseData(t, response)
+	if data["message"] != "Pairing required" || data["pairing_code"] == pairing.Code {
+		t.Errorf("register: %v, want a new pairing code instead of the approved one", data)
+	}
+}
+
+func TestPairingCodeLimitIsKeptInDatabase(t *testing.T) {
+	useTestConfig(t, nil)
+	db := newTestDB(t)
+	server := newTestServer(t, db)
+	expirePairing := func() {
+		t.Helper()
+		if err := db.Model(&PairingRequest{}).Where("device_id = ?", "busy-frame").Update("expires_at", time.Now().Add(-time.Minute)).Error; err != nil {
+			t.Fatalf("expire pairing: %v", err)
+		}
+	}
+	for i := 0; i < pairingCodeLimit; i++ {
+		if status, response := registerDevice(t, server, "busy-frame", ""); status != http.StatusAccepted {
+			t.Fatalf("pairing request %d: status %d: %+v", i+1, status, response)
+		}
+		expirePairing()
+	}
+
+	// A restarted or second instance shares the count
+	other := newTestServer(t, db)
+	status, _ := registerDevice(t, other, "busy-frame", "")
+	if status != http.StatusTooManyRequests {
+		t.Fatalf("pairing request over the limit: status %d, want 429", status)
+	}
+	if status, _ := registerDevice(t, other, "other-frame", ""); status != http.StatusAccepted {
+		t.Errorf("pairing request of another device: status %d, want 202", status)
+	}
+
+	if err := db.Model(&PairingCodeIssue{}).Where("device_id = ?", "busy-frame").Update("issued_at", time.Now().Add(-pairingCodeWindow)).Error; err != nil {
+		t.Fatalf("age issued codes: %v", err)
+	}
+	if status, _ := registerDevice(t, other, "busy-frame", ""); status != http.StatusAccepted {
+		t.Errorf("pairing request after the window: status %d, want 202", status)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// pinActive reports whether a device has an image pinned at now
+func pinActive(device Device, now time.Time) bool {
+	return device.PinnedImage != "" && (device.PinnedUntil == nil || device.PinnedUntil.After(now))
+}
+
+// clearExpiredPin forgets a pin that has run out, so the playlist resumes
+func clearExpiredPin(device *Device, now time.Time) {
+	if device.PinnedImage != "" && !pinActive(*device, now) {
+		device.PinnedImage = ""
+		device.PinnedUntil = nil
+	}
+}
+
+// scheduledImage returns the image a device shows when its timer fires at
+// now: the pinned image while the pin lasts, otherwise the next one of the
+// playlist its schedule selects. pinned tells which one it is.
+func scheduledImage(ctx context.Context, db *gorm.DB, device Device, settings DeviceSetting, schedule deviceSchedule, now time.Time) (image DBImage, pinned bool, err error) {
+	if !pinActive(device, now) {
+		image, err = getNextImage(ctx, db, device, schedule.playlistAt(settings, now))
+		return image, false, err
+	}
+	if err := db.Where(&DBImage{UUID: device.PinnedImage}).First(&image).Error; err != nil {
+		return image, true, fmt.Errorf("failed to find pinned image %s: %w", device.PinnedImage, err)
+	}
+	return image, true, nil
+}
+
+// findDevices loads the devices with the given IDs, listing the ones missing
+func findDevices(db *gorm.DB, deviceIDs []string) ([]Device, error) {
+	deviceIDs = slices.Compact(slices.Sorted(slices.Values(deviceIDs)))
+	var devices []Device
+	if err := db.Where("device_id IN ?", deviceIDs).Find(&devices).Error; err != nil {
+		return nil, err
+	}
+	if len(devices) == len(deviceIDs) {
+		return devices, nil
+	}
+	found := make(map[string]bool, len(devices))
+	for _, device := range devices {
+		found[device.DeviceID] = true
+	}
+	var missing []string
+	for _, id := range deviceIDs {
+		if !found[id] {
+			missing = append(missing, id)
+		}
+	}
+	return nil, fmt.Errorf("devices not found: %s", strings.Join(missing, ", "))
+}
+
+// pinRequest is the body of device_pin and device_unpin
+type pinRequest struct {
+	DeviceIDs []string `json:"device_ids"`
+	// All devices of the group instead of device_ids
+	GroupID   uint   `json:"group_id"`
+	ImageUUID string `json:"image_uuid"`
+	// How long the image stays, until unpinned if 0
+	Seconds int `json:"seconds"`
+}
+
+func handleAdminDevicePinRequest(c *gin.Context, db *gorm.DB) {
+	// Show an image on devices, or all devices of group_id, from their next
+	// wake on instead of their playlist. The image is rendered for every
+	// device right away, so the devices only download it.
+	admin, ok := requireAdmin(c, db, roleEditor)
+	if !ok {
+		return
+	}
+	var request pinRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse("Invalid JSON"))
+		return
+	}
+	deviceIDs, err := targetDeviceIDs(db, request.DeviceIDs, request.GroupID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errorResponse(err.Error()))
+		return
+	}
+	if len(deviceIDs) == 0 {
+		c.JSON(http.StatusBadRequest, errorResponse("device_ids or group_id is required"))
+		return
+	}
+	if request.Seconds < 0 {
+		c.JSON(http.StatusBadRequest, errorResponse("seconds must not be negative"))
+		return
+	}
+	var image DBImage
+	if err := db.Where(&DBImage{UUID: request.ImageUUID}).First(&image).Error; err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse("image_uuid is not a library image"))
+		return
+	}
+	devices, err := findDevices(db, deviceIDs)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errorResponse(err.Error()))
+		return
+	}
+	for _, device := range devices {
+		var settings DeviceSetting
+		if err := db.Where(&DeviceSetting{DeviceID: device.DeviceID}).First(&settings).Error; err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse("Device "+device.DeviceID+" has no settings"))
+			return
+		}
+		settings, err := effectiveSettings(db, settings)
+		if err != nil {
+			requestLogger(c).Error("Error resolving settings", "error", err)
+			c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+			return
+		}
+		_, err = getDithered(c.Request.Context(), db, image, settings.Palette, settings.DitherAlgorithm, settings.DitherStrength, settings.Width, settings.Height, settings.ResizeMethod)
+		if err != nil {
+			requestLogger(c).Error("Error rendering pinned image", "device_id", device.DeviceID, "error", err)
+			c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+			return
+		}
+	}
+
+	var until *time.Time
+	details := "image=" + image.UUID
+	if request.Seconds > 0 {
+		end := time.Now().Add(time.Duration(request.Seconds) * time.Second)
+		until = &end
+		details += fmt.Sprintf(" seconds=%d", request.Seconds)
+	}
+	// UpdatedAt tracks image changes, so it is left alone
+	err = db.Model(&Device{}).Where("device_id IN ?", deviceIDs).
+		UpdateColumns(map[string]interface{}{"pinned_image": image.UUID, "pinned_until": until}).Error
+	if err != nil {
+		requestLogger(c).Error("Error pinning image", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	for _, device := range devices {
+		recordAudit(db, admin, "device_pin", "device", device.DeviceID, details)
+	}
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"message":      "Image pinned, devices show it on their next wake",
+		"device_ids":   deviceIDs,
+		"image_uuid":   image.UUID,
+		"pinned_until": until,
+	}))
+}
+
+func handleAdminDeviceUnpinRequest(c *gin.Context, db *gorm.DB) {
+	// End the pins of devices or a group, their playlist resumes on the next
+	// wake
+	admin, ok := requireAdmin(c, db, roleEditor)
+	if !ok {
+		return
+	}
+	var request pinRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse("Invalid JSON"))
+		return
+	}
+	deviceIDs, err := targetDeviceIDs(db, request.DeviceIDs, request.GroupID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errorResponse(err.Error()))
+		return
+	}
+	if len(deviceIDs) == 0 {
+		c.JSON(http.StatusBadRequest, errorResponse("device_ids or group_id is required"))
+		return
+	}
+	var devices []Device
+	if err := db.Where("device_id IN ? AND pinned_image <> ''", deviceIDs).Find(&devices).Error; err != nil {
+		requestLogger(c).Error("Error fetching devices", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	// An expired pin makes the device due for a new image, see imageDue
+	err = db.Model(&Device{}).Where("device_id IN ? AND pinned_image <> ''", deviceIDs).
+		UpdateColumn("pinned_until", time.Now()).Error
+	if err != nil {
+		requestLogger(c).Error("Error unpinning image", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	unpinned := make([]string, 0, len(devices))
+	for _, device := range devices {
+		recordAudit(db, admin, "device_unpin", "device", device.DeviceID, "image="+device.PinnedImage)
+		unpinned = append(unpinned, device.DeviceID)
+	}
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"message":    "Images unpinned",
+		"device_ids": unpinned,
+	}))
+}
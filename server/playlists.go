@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// playlistSummary is a playlist as listed by the admin API
+type playlistSummary struct {
+	ID         uint      `json:"id"`
+	Name       string    `json:"name"`
+	ImageCount int       `json:"image_count"`
+	ImageUUIDs []string  `json:"image_uuids,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// playlistImageUUIDs returns the images of a playlist in library order
+func playlistImageUUIDs(db *gorm.DB, playlistID uint) ([]string, error) {
+	var uuids []string
+	err := db.Model(&PlaylistImage{}).
+		Joins("JOIN random_images ON random_images.uuid = playlist_images.image_uuid").
+		Where("playlist_images.playlist_id = ?", playlistID).
+		Order("random_images.id").Pluck("playlist_images.image_uuid", &uuids).Error
+	return uuids, err
+}
+
+// getNextImage returns the image a device shows next: the one following its
+// current image in the shuffled library order, skipping images not in the
+// playlist. A nil playlist, or one without images, uses the whole library.
+func getNextImage(ctx context.Context, db *gorm.DB, device Device, playlistID *uint) (DBImage, error) {
+	if playlistID == nil {
+		return getNextRandom(db, device)
+	}
+	var current RandomImage
+	if device.CurrentImage != "" {
+		if err := db.Where(&RandomImage{UUID: device.CurrentImage}).Limit(1).Find(&current).Error; err != nil {
+			return DBImage{}, fmt.Errorf("database error: %w", err)
+		}
+	}
+	members := db.Model(&PlaylistImage{}).Select("image_uuid").Where("playlist_id = ?", *playlistID)
+	var next RandomImage
+	// Continue after the current image, or wrap around to the first one
+	for _, after := range []uint{current.ID, 0} {
+		result := db.Where("uuid IN (?) AND id > ?", members, after).Order("id").Limit(1).Find(&next)
+		if result.Error != nil {
+			return DBImage{}, fmt.Errorf("database error: %w", result.Error)
+		}
+		if result.RowsAffected > 0 {
+			var image DBImage
+			if err := db.Where(&DBImage{UUID: next.UUID}).First(&image).Error; err != nil {
+				return DBImage{}, fmt.Errorf("failed to find image with UUID: %s", next.UUID)
+			}
+			return image, nil
+		}
+	}
+	loggerFrom(ctx).Warn("Playlist has no images in the library, using the whole library", "playlist_id", *playlistID)
+	return getNextRandom(db, device)
+}
+
+// playlistExists checks an optional playlist reference
+func playlistExists(db *gorm.DB, playlistID *uint) error {
+	if playlistID == nil {
+		return nil
+	}
+	var count int64
+	if err := db.Model(&Playlist{}).Where("id = ?", *playlistID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("playlist %d not found", *playlistID)
+	}
+	return nil
+}
+
+// playlistRequest is the body of playlist_create and playlist_update, fields
+// left out keep their value on update
+type playlistRequest struct {
+	ID         uint      `json:"id"`
+	Name       *string   `json:"name"`
+	ImageUUIDs *[]string `json:"image_uuids"`
+}
+
+// errUnknownImages is returned when a playlist refers to images missing from
+// the library
+var errUnknownImages = errors.New("unknown image_uuids")
+
+// setPlaylistImages replaces the images of a playlist
+func setPlaylistImages(tx *gorm.DB, playlistID uint, uuids []string) error {
+	uuids = slices.Compact(slices.Sorted(slices.Values(uuids)))
+	var known int64
+	if err := tx.Model(&DBImage{}).Where("uuid IN ?", uuids).Count(&known).Error; err != nil {
+		return err
+	}
+	if int(known) != len(uuids) {
+		return errUnknownImages
+	}
+	if err := tx.Where("playlist_id = ?", playlistID).Delete(&PlaylistImage{}).Error; err != nil {
+		return err
+	}
+	rows := make([]PlaylistImage, len(uuids))
+	for i, uuid := range uuids {
+		rows[i] = PlaylistImage{PlaylistID: playlistID, ImageUUID: uuid}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return tx.CreateInBatches(rows, 500).Error
+}
+
+func handleAdminPlaylistListRequest(c *gin.Context, db *gorm.DB) {
+	// All playlists with their image counts
+	if _, ok := requireAdmin(c, db, roleViewer); !ok {
+		return
+	}
+	var playlists []Playlist
+	if err := db.Order("name").Find(&playlists).Error; err != nil {
+		requestLogger(c).Error("Error fetching playlists", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	var counts []struct {
+		PlaylistID uint
+		Count      int
+	}
+	err := db.Model(&PlaylistImage{}).Select("playlist_id, COUNT(*) AS count").Group("playlist_id").Scan(&counts).Error
+	if err != nil {
+		requestLogger(c).Error("Error counting playlist images", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	countByPlaylist := make(map[uint]int, len(counts))
+	for _, count := range counts {
+		countByPlaylist[count.PlaylistID] = count.Count
+	}
+	summaries := make([]playlistSummary, 0, len(playlists))
+	for _, playlist := range playlists {
+		summaries = append(summaries, playlistSummary{
+			ID:         playlist.ID,
+			Name:       playlist.Name,
+			ImageCount: countByPlaylist[playlist.ID],
+			UpdatedAt:  playlist.UpdatedAt,
+		})
+	}
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"playlists": summaries,
+	}))
+}
+
+func handleAdminPlaylistRequest(c *gin.Context, db *gorm.DB) {
+	// One playlist with its images in the order they are shown
+	if _, ok := requireAdmin(c, db, roleViewer); !ok {
+		return
+	}
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse("Invalid playlist id"))
+		return
+	}
+	var playlist Playlist
+	if err := db.First(&playlist, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, errorResponse("Playlist not found"))
+		return
+	}
+	uuids, err := playlistImageUUIDs(db, playlist.ID)
+	if err != nil {
+		requestLogger(c).Error("Error fetching playlist images", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"playlist": playlistSummary{
+			ID:         playlist.ID,
+			Name:       playlist.Name,
+			ImageCount: len(uuids),
+			ImageUUIDs: uuids,
+			UpdatedAt:  playlist.UpdatedAt,
+		},
+	}))
+}
+
+func handleAdminPlaylistSaveRequest(c *gin.Context, db *gorm.DB, create bool) {
+	// Create a playlist, or rename it and replace its images
+	admin, ok := requireAdmin(c, db, roleEditor)
+	if !ok {
+		return
+	}
+	var request playlistRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse("Invalid JSON"))
+		return
+	}
+	var playlist Playlist
+	if create {
+		if request.Name == nil || *request.Name == "" {
+			c.JSON(http.StatusBadRequest, errorResponse("name is required"))
+			return
+		}
+	} else if err := db.First(&playlist, request.ID).Error; err != nil {
+		c.JSON(http.StatusNotFound, errorResponse("Playlist not found"))
+		return
+	}
+	if request.Name != nil {
+		if *request.Name == "" {
+			c.JSON(http.StatusBadRequest, errorResponse("name must not be empty"))
+			return
+		}
+		var count int64
+		db.Model(&Playlist{}).Where("name = ? AND id <> ?", *request.Name, playlist.ID).Count(&count)
+		if count > 0 {
+			c.JSON(http.StatusConflict, errorResponse("Playlist already exists"))
+			return
+		}
+		playlist.Name = *request.Name
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&playlist).Error; err != nil {
+			return err
+		}
+		if request.ImageUUIDs != nil {
+			return setPlaylistImages(tx, playlist.ID, *request.ImageUUIDs)
+		}
+		return nil
+	})
+	if errors.Is(err, errUnknownImages) {
+		c.JSON(http.StatusBadRequest, errorResponse("image_uuids contains images that are not in the library"))
+		return
+	}
+	if err != nil {
+		requestLogger(c).Error("Error saving playlist", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	action := "playlist_update"
+	if create {
+		action = "playlist_create"
+	}
+	details := "name=" + playlist.Name
+	if request.ImageUUIDs != nil {
+		details += fmt.Sprintf(" images=%d", len(*request.ImageUUIDs))
+	}
+	recordAudit(db, admin, action, "playlist", strconv.FormatUint(uint64(playlist.ID), 10), details)
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"message":  "Playlist saved",
+		"playlist": playlist,
+	}))
+}
+
+func handleAdminPlaylistDeleteRequest(c *gin.Context, db *gorm.DB) {
+	// Delete a playlist. Devices and groups showing it go back to the whole
+	// library and schedule windows selecting it are removed.
+	admin, ok := requireAdmin(c, db, roleEditor)
+	if !ok {
+		return
+	}
+	var request playlistRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse("Invalid JSON"))
+		return
+	}
+	var playlist Playlist
+	if err := db.First(&playlist, request.ID).Error; err != nil {
+		c.JSON(http.StatusNotFound, errorResponse("Playlist not found"))
+		return
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("playlist_id = ?", playlist.ID).Delete(&PlaylistImage{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("playlist_id = ?", playlist.ID).Delete(&DeviceSchedule{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&DeviceSetting{}).Where("playlist_id = ?", playlist.ID).Update("playlist_id", nil).Error; err != nil {
+			return err
+		}
+		if err := dropGroupPlaylist(tx, playlist.ID); err != nil {
+			return err
+		}
+		return tx.Delete(&playlist).Error
+	})
+	if err != nil {
+		requestLogger(c).Error("Error deleting playlist", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	recordAudit(db, admin, "playlist_delete", "playlist", strconv.FormatUint(uint64(playlist.ID), 10), "name="+playlist.Name)
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"message": "Playlist deleted",
+		"id":      playlist.ID,
+	}))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Palette with the colors the panel actually shows, used for previews
+const defaultDisplayPalette = "7Eink"
+
+// simulatePanel maps a dithered image from the palette it was dithered with
+// to the colors the panel really produces. Both palettes list the same panel
+// states in the same order, so colors are mapped by index.
+func simulatePanel(img image.Image, palette string, display string) (image.Image, error) {
+	from, to := palettes[palette], palettes[display]
+	if len(from) != len(to) {
+		return nil, fmt.Errorf("palettes %s and %s have a different number of colors", palette, display)
+	}
+	simulated := image.NewPaletted(img.Bounds(), to)
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			// Dithered pixels are exact palette colors
+			simulated.SetColorIndex(x, y, uint8(color.Palette(from).Index(img.At(x, y))))
+		}
+	}
+	return simulated, nil
+}
+
+func handleAdminPreviewRequest(c *gin.Context, db *gorm.DB) {
+	// Render a library image with arbitrary settings, as the panel would show
+	// it. Settings default to those of device_id if given.
+	if _, ok := requireAdmin(c, db, roleViewer); !ok {
+		return
+	}
+	var source DBImage
+	if uuid := c.Query("uuid"); uuid == "" || db.Where(&DBImage{UUID: uuid}).First(&source).Error != nil {
+		c.JSON(http.StatusNotFound, errorResponse("Image not found"))
+		return
+	}
+
+	settings := renderSettings{Palette: "7Standard", Algorithm: "StevenPigeon", Strength: 1.0, Width: 800, Height: 480, ResizeMethod: "cut"}
+	if deviceID := c.Query("device_id"); deviceID != "" {
+		var deviceSettings DeviceSetting
+		if err := db.Where(&DeviceSetting{DeviceID: deviceID}).First(&deviceSettings).Error; err != nil {
+			c.JSON(http.StatusNotFound, errorResponse("Device settings not found"))
+			return
+		}
+		deviceSettings, err := effectiveSettings(db, deviceSettings)
+		if err != nil {
+			requestLogger(c).Error("Error resolving settings", "error", err)
+			c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+			return
+		}
+		settings = renderSettings{
+			Palette:      deviceSettings.Palette,
+			Algorithm:    deviceSettings.DitherAlgorithm,
+			Strength:     deviceSettings.DitherStrength,
+			Width:        deviceSettings.Width,
+			Height:       deviceSettings.Height,
+			ResizeMethod: deviceSettings.ResizeMethod,
+		}
+	}
+	settings.Palette = c.DefaultQuery("palette", settings.Palette)
+	settings.Algorithm = c.DefaultQuery("algorithm", settings.Algorithm)
+	settings.ResizeMethod = c.DefaultQuery("resize_method", settings.ResizeMethod)
+	display := c.DefaultQuery("display", defaultDisplayPalette)
+	var err error
+	if value := c.Query("strength"); value != "" {
+		var strength float64
+		strength, err = strconv.ParseFloat(value, 32)
+		settings.Strength = float32(strength)
+	}
+	if value := c.Query("width"); value != "" && err == nil {
+		settings.Width, err = strconv.Atoi(value)
+	}
+	if value := c.Query("height"); value != "" && err == nil {
+		settings.Height, err = strconv.Atoi(value)
+	}
+	if err != nil || settings.Strength < 0 {
+		c.JSON(http.StatusBadRequest, errorResponse("Invalid strength, width or height"))
+		return
+	}
+	// Previews are rendered at full size for every request, keep them to panel sizes
+	if settings.Width <= 0 || settings.Height <= 0 || settings.Width > 4096 || settings.Height > 4096 {
+		c.JSON(http.StatusBadRequest, errorResponse("width and height must be between 1 and 4096"))
+		return
+	}
+	if err := validateRenderSettings(settings.Palette, settings.Algorithm, settings.ResizeMethod); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(err.Error()))
+		return
+	}
+	if _, ok := palettes[display]; !ok {
+		c.JSON(http.StatusBadRequest, errorResponse("unknown display palette: "+display))
+		return
+	}
+
+	img, err := loadImage(source.Path)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse("Failed to load image"))
+		return
+	}
+	dithered := ditherImage(img, settings.Palette, settings.Algorithm, settings.Strength, settings.Width, settings.Height, settings.ResizeMethod)
+	preview, err := simulatePanel(dithered, settings.Palette, display)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(err.Error()))
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Header("Content-Type", "image/png")
+	c.Status(http.StatusOK)
+	if err := png.Encode(c.Writer, preview); err != nil {
+		requestLogger(c).Error("Error encoding preview", "path", source.Path, "error", err)
+	}
+}
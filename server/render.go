@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Resize methods understood by resizeImage, anything else stretches
+var resizeMethods = []string{"cut", "fill_white", "fill_black", "stretch"}
+
+// validateRenderSettings checks that a palette, dither algorithm and resize
+// method exist before an image is rendered with them.
+func validateRenderSettings(palette string, algorithm string, resizeMethod string) error {
+	if _, ok := palettes[palette]; !ok {
+		return fmt.Errorf("unknown palette: %s", palette)
+	}
+	_, isError := error_dither_algo[algorithm]
+	_, isOrdered := ordered_dither_algo[algorithm]
+	if !isError && !isOrdered {
+		return fmt.Errorf("unknown dither algorithm: %s", algorithm)
+	}
+	for _, method := range resizeMethods {
+		if method == resizeMethod {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown resize method: %s (one of %s)", resizeMethod, strings.Join(resizeMethods, ", "))
+}
+
+// renderSettings are the device settings that affect how an image is dithered
+type renderSettings struct {
+	Palette      string
+	Algorithm    string
+	Strength     float32
+	Width        int
+	Height       int
+	ResizeMethod string
+}
+
+func (rs renderSettings) String() string {
+	return fmt.Sprintf("%s/%s strength %g, %dx%d %s", rs.Palette, rs.Algorithm, rs.Strength, rs.Width, rs.Height, rs.ResizeMethod)
+}
+
+// runRenderCommand dithers an image and writes the result as PNG, optionally
+// with the payload files a device downloads and a contact sheet comparing
+// all dither algorithms, so settings can be tuned without waiting for a
+// frame. A file on disk is rendered directly without touching the database,
+// a library image UUID goes through the dithered image cache like a device
+// request does.
+func runRenderCommand(args []string) int {
+	fs := flag.NewFlagSet("render", flag.ContinueOnError)
+	palette := fs.String("palette", "7Standard", "color palette")
+	algorithm := fs.String("algo", "StevenPigeon", "dither algorithm")
+	strength := fs.Float64("strength", 1.0, "dither strength")
+	width := fs.Int("width", 800, "target width")
+	height := fs.Int("height", 480, "target height")
+	resizeMethod := fs.String("resize", "cut", "resize method: "+strings.Join(resizeMethods, ", "))
+	output := fs.String("o", "", "output PNG, defaults to <image>_<algo>.png")
+	payload := fs.Bool("payload", false, "also write the device payload files <output>_<n>.bin")
+	contactSheet := fs.String("contact-sheet", "", "also write a PNG comparing all dither algorithms")
+	columns := fs.Int("columns", 4, "tiles per row of the contact sheet")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(positional) != 1 || *columns <= 0 {
+		return commandUsage("render")
+	}
+	if *width <= 0 || *height <= 0 || (*width**height)%8 != 0 {
+		slog.Error("Invalid size, the pixel count must be a positive multiple of 8", "width", *width, "height", *height)
+		return 2
+	}
+	if err := validateRenderSettings(*palette, *algorithm, *resizeMethod); err != nil {
+		slog.Error("Invalid render settings", "error", err)
+		return 2
+	}
+	settings := renderSettings{
+		Palette:      *palette,
+		Algorithm:    *algorithm,
+		Strength:     float32(*strength),
+		Width:        *width,
+		Height:       *height,
+		ResizeMethod: *resizeMethod,
+	}
+
+	source := positional[0]
+	if *output == "" {
+		name := strings.TrimSuffix(filepath.Base(source), filepath.Ext(source))
+		*output = fmt.Sprintf("%s_%s.png", name, settings.Algorithm)
+	}
+
+	var img image.Image
+	sourcePath := source
+	if _, err := os.Stat(source); err == nil {
+		img = fetchAndDither(context.Background(), source, settings.Palette, settings.Algorithm, settings.Strength, settings.Width, settings.Height, settings.ResizeMethod)
+		if img == nil {
+			slog.Error("Failed to render", "path", source)
+			return 1
+		}
+	} else if errors.Is(err, os.ErrNotExist) {
+		// Not a file, look the image up in the library
+		img, sourcePath, err = renderLibraryImage(source, settings)
+		if err != nil {
+			slog.Error("Failed to render library image", "error", err)
+			return 1
+		}
+	} else {
+		slog.Error("Failed to read source image", "error", err)
+		return 1
+	}
+
+	if err := saveImage(*output, img); err != nil {
+		slog.Error("Failed to save rendered image", "path", *output, "error", err)
+		return 1
+	}
+	fmt.Printf("Rendered %s (%s) to %s\n", source, settings, *output)
+
+	if *payload {
+		prefix := strings.TrimSuffix(*output, filepath.Ext(*output))
+		files, err := writePayloadFiles(img, settings, prefix)
+		if err != nil {
+			slog.Error("Failed to write payload files", "error", err)
+			return 1
+		}
+		fmt.Printf("Wrote payload files: %s\n", strings.Join(files, " "))
+	}
+
+	if *contactSheet != "" {
+		if err := writeContactSheet(sourcePath, settings, *columns, *contactSheet); err != nil {
+			slog.Error("Failed to write contact sheet", "error", err)
+			return 1
+		}
+		fmt.Printf("Wrote contact sheet: %s\n", *contactSheet)
+	}
+	return 0
+}
+
+// renderLibraryImage renders the library image with the given UUID through
+// the dithered image cache. Returns the image and its source file.
+func renderLibraryImage(imageUUID string, settings renderSettings) (image.Image, string, error) {
+	db, err := openCommandDB()
+	if err != nil {
+		return nil, "", err
+	}
+	defer dbClose(db)
+	var source DBImage
+	if err := db.Where(&DBImage{UUID: imageUUID}).First(&source).Error; err != nil {
+		return nil, "", fmt.Errorf("%s is neither a file nor a library image UUID", imageUUID)
+	}
+	dithered, err := getDithered(context.Background(), db, source, settings.Palette, settings.Algorithm, settings.Strength, settings.Width, settings.Height, settings.ResizeMethod)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to render %s: %w", source.Path, err)
+	}
+	img, err := loadImage(dithered.Path)
+	if err != nil {
+		return nil, "", err
+	}
+	slog.Info("Rendered library image", "image_uuid", imageUUID, "source", source.Path, "cached", dithered.Path)
+	return img, source.Path, nil
+}
+
+// writePayloadFiles writes one bit plane per palette color, in the format the
+// server sends to devices. Returns the file names.
+func writePayloadFiles(img image.Image, settings renderSettings, prefix string) ([]string, error) {
+	bitmaps := imgToBitmap(img, settings.Palette, settings.Width, settings.Height)
+	files := make([]string, len(bitmaps))
+	for i, bits := range bitmaps {
+		files[i] = fmt.Sprintf("%s_%d.bin", prefix, i)
+		if err := saveBytesToFile(files[i], BitsToBytes(bits)); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// Height of the caption above each contact sheet tile
+const contactSheetLabelHeight = 20
+
+// writeContactSheet renders the source with every dither algorithm, keeping
+// the other settings, and lays the results out in a grid after the resized
+// original. Tiles are rendered in parallel.
+func writeContactSheet(sourcePath string, settings renderSettings, columns int, output string) error {
+	source, err := loadImage(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	labels := []string{"original"}
+	labels = append(labels, slices.Sorted(maps.Keys(error_dither_algo))...)
+	labels = append(labels, slices.Sorted(maps.Keys(ordered_dither_algo))...)
+	tiles := make([]image.Image, len(labels))
+	tiles[0] = resizeImage(source, settings.Width, settings.Height, "Lanczos", settings.ResizeMethod)
+
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, runtime.NumCPU())
+	for i := 1; i < len(labels); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			workers <- struct{}{}
+			defer func() { <-workers }()
+			tiles[i] = ditherImage(source, settings.Palette, labels[i], settings.Strength, settings.Width, settings.Height, settings.ResizeMethod)
+		}()
+	}
+	wg.Wait()
+
+	rows := (len(tiles) + columns - 1) / columns
+	tileHeight := settings.Height + contactSheetLabelHeight
+	sheet := image.NewRGBA(image.Rect(0, 0, columns*settings.Width, rows*tileHeight))
+	draw.Draw(sheet, sheet.Bounds(), image.White, image.Point{}, draw.Src)
+	for i, tile := range tiles {
+		x := (i % columns) * settings.Width
+		y := (i / columns) * tileHeight
+		label := labels[i]
+		if i == 0 {
+			label = fmt.Sprintf("original, %s strength %g", settings.Palette, settings.Strength)
+		}
+		// Long captions are clipped to the tile
+		caption := sheet.SubImage(image.Rect(x, y, x+settings.Width, y+contactSheetLabelHeight)).(draw.Image)
+		drawer := font.Drawer{
+			Dst:  caption,
+			Src:  image.Black,
+			Face: basicfont.Face7x13,
+			Dot:  fixed.P(x+4, y+contactSheetLabelHeight-6),
+		}
+		drawer.DrawString(label)
+		draw.Draw(sheet, image.Rect(x, y+contactSheetLabelHeight, x+settings.Width, y+tileHeight), tile, tile.Bounds().Min, draw.Src)
+	}
+	return saveImage(output, sheet)
+}
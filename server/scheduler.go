@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// runPeriodic runs job every interval() until ctx is cancelled. The interval
+// is re-read before each run so configuration reloads take effect; a
+// non-positive interval pauses the job and checks again a minute later.
+func runPeriodic(ctx context.Context, wg *sync.WaitGroup, name string, interval func() time.Duration, job func(ctx context.Context) error) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		slog.Info("Started background job", "job", name)
+		for {
+			wait := interval()
+			if wait <= 0 {
+				wait = time.Minute
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				slog.Info("Stopped background job", "job", name)
+				return
+			case <-timer.C:
+			}
+			if interval() <= 0 {
+				continue
+			}
+			if err := job(ctx); err != nil {
+				slog.Error("Background job failed", "job", name, "error", err)
+			}
+		}
+	}()
+}
+
+// startSchedulers starts the background jobs of the server. They stop when
+// ctx is cancelled, wg can be used to wait for them.
+func startSchedulers(ctx context.Context, wg *sync.WaitGroup, db *gorm.DB) {
+	runPeriodic(ctx, wg, "image directory refresh", func() time.Duration {
+		return time.Duration(config().ImageDirRefresh) * time.Second
+	}, func(ctx context.Context) error {
+		if err := refreshImages(db); err != nil {
+			return err
+		}
+		return updateRandomList(db)
+	})
+	runPeriodic(ctx, wg, "telemetry downsampling", func() time.Duration {
+		return time.Hour
+	}, func(ctx context.Context) error {
+		return maintainTelemetry(db)
+	})
+	runPeriodic(ctx, wg, "alert evaluation", func() time.Duration {
+		return time.Duration(config().Alerts.Interval) * time.Second
+	}, func(ctx context.Context) error {
+		return evaluateAlerts(ctx, db)
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Number of recent screens per device whose payload is kept for
+// reconstruction
+const screenHistoryLength = 20
+
+// decodeScreen rebuilds the image a device shows from the per-color payload
+// files sent to it. Like the firmware, the planes are drawn in order over a
+// white screen.
+func decodeScreen(cacheDir string, entry DisplayEvent, displayPalette []color.Color) (image.Image, error) {
+	screen := image.NewPaletted(image.Rect(0, 0, entry.Width, entry.Height), displayPalette)
+	pixels := entry.Width * entry.Height
+	// Unset pixels stay white, the second palette color
+	for i := range screen.Pix {
+		screen.Pix[i] = 1
+	}
+	for plane := range displayPalette {
+		path := filepath.Join(cacheDir, fmt.Sprintf("%s_%d.bin", entry.DitheredUUID, plane))
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(data)*8 != pixels {
+			return nil, fmt.Errorf("%s has %d bytes, expected %d for %dx%d", path, len(data), pixels/8, entry.Width, entry.Height)
+		}
+		for i, bit := range BytesToBits(data) {
+			if bit {
+				screen.Pix[i] = uint8(plane)
+			}
+		}
+	}
+	return screen, nil
+}
+
+func handleAdminDeviceScreenRequest(c *gin.Context, db *gorm.DB) {
+	// Reconstruct the screen of a device, the latest one or a history entry.
+	// display picks the palette used for output, e.g. 7Eink to see the real
+	// panel colors; by default the colors the device was sent are used.
+	if _, ok := requireAdmin(c, db, roleViewer); !ok {
+		return
+	}
+	query := db.Where("device_id = ?", c.Param("id"))
+	if entryID := c.Query("entry"); entryID != "" {
+		id, err := strconv.ParseUint(entryID, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse("Invalid entry"))
+			return
+		}
+		query = query.Where("id = ?", id)
+	}
+	var entry DisplayEvent
+	if err := query.Order("id DESC").First(&entry).Error; err != nil {
+		c.JSON(http.StatusNotFound, errorResponse("No screen recorded for this device"))
+		return
+	}
+	display := c.DefaultQuery("display", entry.Palette)
+	displayPalette, ok := palettes[display]
+	if !ok || len(displayPalette) != len(palettes[entry.Palette]) {
+		c.JSON(http.StatusBadRequest, errorResponse("unknown or incompatible display palette: "+display))
+		return
+	}
+	screen, err := decodeScreen(config().CacheDir, entry, displayPalette)
+	if err != nil {
+		requestLogger(c).Error("Error reconstructing screen", "device_id", entry.DeviceID, "error", err)
+		c.JSON(http.StatusNotFound, errorResponse("Screen payload is no longer cached"))
+		return
+	}
+	c.Header("Cache-Control", "private, no-cache")
+	c.Header("Content-Type", "image/png")
+	c.Status(http.StatusOK)
+	if err := png.Encode(c.Writer, screen); err != nil {
+		requestLogger(c).Error("Error encoding screen", "device_id", entry.DeviceID, "error", err)
+	}
+}
+
+func handleAdminDeviceScreenHistoryRequest(c *gin.Context, db *gorm.DB) {
+	// Screens shown by a device, newest first. Entries can be rendered with
+	// screen.png?entry=<ID>.
+	if _, ok := requireAdmin(c, db, roleViewer); !ok {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(screenHistoryLength)))
+	if err != nil || limit <= 0 || limit > screenHistoryLength {
+		limit = screenHistoryLength
+	}
+	var entries []DisplayEvent
+	if err := db.Where("device_id = ?", c.Param("id")).Order("id DESC").Limit(limit).Find(&entries).Error; err != nil {
+		requestLogger(c).Error("Error fetching screen history", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"history": entries,
+	}))
+}
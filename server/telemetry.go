@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// updateLastSeen stores the time of an authenticated request on the device.
+// UpdateColumn leaves UpdatedAt alone, it tracks image changes.
+func updateLastSeen(device *Device, db *gorm.DB) error {
+	now := time.Now()
+	if err := db.Model(device).UpdateColumn("last_seen_at", now).Error; err != nil {
+		return fmt.Errorf("failed to update last seen of device %s: %w", device.DeviceID, err)
+	}
+	device.LastSeenAt = &now
+	return nil
+}
+
+// telemetryFromRequest reads the telemetry a device reported. Fields it left
+// out stay NULL.
+func telemetryFromRequest(deviceID string, requestData map[string]interface{}) (DeviceTelemetry, error) {
+	telemetry := DeviceTelemetry{
+		DeviceID:   deviceID,
+		ReportedAt: time.Now(),
+		Samples:    1,
+	}
+	// JSON numbers are decoded as float64
+	number := func(key string) (float64, bool) {
+		value, ok := requestData[key].(float64)
+		return value, ok && !math.IsNaN(value) && !math.IsInf(value, 0)
+	}
+	integer := func(key string) *int {
+		if value, ok := number(key); ok {
+			rounded := int(math.Round(value))
+			return &rounded
+		}
+		return nil
+	}
+	if value, ok := number("battery_voltage"); ok {
+		telemetry.BatteryVoltage = &value
+	}
+	telemetry.BatteryLevel = integer("battery_level")
+	if telemetry.BatteryLevel != nil && (*telemetry.BatteryLevel < 0 || *telemetry.BatteryLevel > 100) {
+		return DeviceTelemetry{}, fmt.Errorf("battery_level must be between 0 and 100")
+	}
+	telemetry.RSSI = integer("rssi")
+	telemetry.WifiConnectMs = integer("wifi_connect_ms")
+	telemetry.DownloadMs = integer("download_ms")
+	telemetry.DownloadFailures = integer("download_failures")
+	if value, ok := number("free_heap"); ok {
+		heap := int64(value)
+		telemetry.FreeHeap = &heap
+	}
+	if value, ok := number("free_psram"); ok {
+		psram := int64(value)
+		telemetry.FreePSRAM = &psram
+	}
+	if value, ok := number("temperature"); ok {
+		telemetry.Temperature = &value
+	}
+	telemetry.WakeReason, _ = requestData["wake_reason"].(string)
+	telemetry.FirmwareVersion, _ = requestData["firmware_version"].(string)
+	return telemetry, nil
+}
+
+// latestTelemetry returns the most recent telemetry of a device that has a
+// value in column, found is false if the device never reported one.
+func latestTelemetry(db *gorm.DB, deviceID string, column string) (telemetry DeviceTelemetry, found bool, err error) {
+	result := db.Where("device_id = ? AND "+column+" IS NOT NULL", deviceID).Order("reported_at DESC").Limit(1).Find(&telemetry)
+	return telemetry, result.RowsAffected > 0, result.Error
+}
+
+// latestTelemetryByDevice returns the most recent telemetry with a value in
+// column of every device that reported one, in a single query.
+func latestTelemetryByDevice(db *gorm.DB, column string) (map[string]DeviceTelemetry, error) {
+	latest := db.Model(&DeviceTelemetry{}).Select("device_id, MAX(reported_at) AS reported_at").
+		Where(column + " IS NOT NULL").Group("device_id")
+	var reports []DeviceTelemetry
+	err := db.Table("device_telemetries AS t").Select("t.*").
+		Joins("JOIN (?) AS latest ON latest.device_id = t.device_id AND latest.reported_at = t.reported_at", latest).
+		Where("t." + column + " IS NOT NULL").Order("t.id").Find(&reports).Error
+	if err != nil {
+		return nil, err
+	}
+	byDevice := make(map[string]DeviceTelemetry, len(reports))
+	for _, report := range reports {
+		// Of reports sharing a timestamp the last one stored wins
+		byDevice[report.DeviceID] = report
+	}
+	return byDevice, nil
+}
+
+// weightedMean averages the values of field over reports, weighted by the
+// number of samples each one holds. Returns nil if no report has a value.
+func weightedMean[T int | int64 | float64](reports []DeviceTelemetry, field func(*DeviceTelemetry) *T) *T {
+	var sum float64
+	var count int
+	for i := range reports {
+		if value := field(&reports[i]); value != nil {
+			sum += float64(*value) * float64(reports[i].Samples)
+			count += reports[i].Samples
+		}
+	}
+	if count == 0 {
+		return nil
+	}
+	mean := sum / float64(count)
+	var result T
+	switch any(result).(type) {
+	case float64:
+		result = T(mean)
+	default:
+		result = T(math.Round(mean))
+	}
+	return &result
+}
+
+// mergeTelemetry combines the reports of one device and hour into a
+// downsampled row. Reports must be in order, text fields and the failure
+// counter keep the last value.
+func mergeTelemetry(hour time.Time, reports []DeviceTelemetry) DeviceTelemetry {
+	merged := DeviceTelemetry{
+		DeviceID:    reports[0].DeviceID,
+		ReportedAt:  hour,
+		Downsampled: true,
+	}
+	for _, report := range reports {
+		merged.Samples += report.Samples
+		if report.WakeReason != "" {
+			merged.WakeReason = report.WakeReason
+		}
+		if report.FirmwareVersion != "" {
+			merged.FirmwareVersion = report.FirmwareVersion
+		}
+		if report.DownloadFailures != nil {
+			merged.DownloadFailures = report.DownloadFailures
+		}
+	}
+	merged.BatteryVoltage = weightedMean(reports, func(t *DeviceTelemetry) *float64 { return t.BatteryVoltage })
+	merged.BatteryLevel = weightedMean(reports, func(t *DeviceTelemetry) *int { return t.BatteryLevel })
+	merged.RSSI = weightedMean(reports, func(t *DeviceTelemetry) *int { return t.RSSI })
+	merged.WifiConnectMs = weightedMean(reports, func(t *DeviceTelemetry) *int { return t.WifiConnectMs })
+	merged.DownloadMs = weightedMean(reports, func(t *DeviceTelemetry) *int { return t.DownloadMs })
+	merged.FreeHeap = weightedMean(reports, func(t *DeviceTelemetry) *int64 { return t.FreeHeap })
+	merged.FreePSRAM = weightedMean(reports, func(t *DeviceTelemetry) *int64 { return t.FreePSRAM })
+	merged.Temperature = weightedMean(reports, func(t *DeviceTelemetry) *float64 { return t.Temperature })
+	return merged
+}
+
+// downsampleTelemetry merges the reports older than before into one row per
+// device and hour. before should be a full hour so no hour is merged twice.
+func downsampleTelemetry(db *gorm.DB, before time.Time) error {
+	var deviceIDs []string
+	err := db.Model(&DeviceTelemetry{}).Distinct("device_id").
+		Where("downsampled = ? AND reported_at < ?", false, before).
+		Pluck("device_id", &deviceIDs).Error
+	if err != nil {
+		return fmt.Errorf("failed to find telemetry to downsample: %w", err)
+	}
+	for _, deviceID := range deviceIDs {
+		var merged, removed int
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var reports []DeviceTelemetry
+			err := tx.Where("device_id = ? AND downsampled = ? AND reported_at < ?", deviceID, false, before).
+				Order("reported_at").Find(&reports).Error
+			if err != nil {
+				return err
+			}
+			for start := 0; start < len(reports); {
+				hour := reports[start].ReportedAt.Truncate(time.Hour)
+				end := start + 1
+				for end < len(reports) && reports[end].ReportedAt.Truncate(time.Hour).Equal(hour) {
+					end++
+				}
+				row := mergeTelemetry(hour, reports[start:end])
+				if err := tx.Create(&row).Error; err != nil {
+					return err
+				}
+				ids := make([]uint, 0, end-start)
+				for _, report := range reports[start:end] {
+					ids = append(ids, report.ID)
+				}
+				if err := tx.Delete(&DeviceTelemetry{}, ids).Error; err != nil {
+					return err
+				}
+				merged++
+				removed += len(ids)
+				start = end
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to downsample telemetry of device %s: %w", deviceID, err)
+		}
+		slog.Info("Downsampled telemetry into hourly rows", "device_id", deviceID, "reports", removed, "rows", merged)
+	}
+	return nil
+}
+
+// maintainTelemetry downsamples old reports and deletes those past the
+// retention period.
+func maintainTelemetry(db *gorm.DB) error {
+	now := time.Now()
+	rawDays := config().TelemetryRawDays
+	if err := downsampleTelemetry(db, now.AddDate(0, 0, -rawDays).Truncate(time.Hour)); err != nil {
+		return err
+	}
+	retentionDays := config().TelemetryRetentionDays
+	if retentionDays == 0 {
+		return nil
+	}
+	result := db.Where("reported_at < ?", now.AddDate(0, 0, -retentionDays)).Delete(&DeviceTelemetry{})
+	if result.Error != nil {
+		return fmt.Errorf("failed to delete old telemetry: %w", result.Error)
+	}
+	if result.RowsAffected > 0 {
+		slog.Info("Deleted old telemetry", "rows", result.RowsAffected, "retention_days", retentionDays)
+	}
+	return nil
+}
+
+func handleAdminDeviceTelemetryRequest(c *gin.Context, db *gorm.DB) {
+	// Telemetry of a device in time order, by default of the last 7 days.
+	// since and until are RFC 3339 times.
+	if _, ok := requireAdmin(c, db, roleViewer); !ok {
+		return
+	}
+	until := time.Now()
+	since := until.AddDate(0, 0, -7)
+	for name, target := range map[string]*time.Time{"since": &since, "until": &until} {
+		if value := c.Query(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, errorResponse(name+" must be an RFC 3339 time"))
+				return
+			}
+			*target = parsed
+		}
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "5000"))
+	if err != nil || limit <= 0 || limit > 5000 {
+		limit = 5000
+	}
+	var telemetry []DeviceTelemetry
+	err = db.Where("device_id = ? AND reported_at >= ? AND reported_at <= ?", c.Param("id"), since, until).
+		Order("reported_at").Limit(limit).Find(&telemetry).Error
+	if err != nil {
+		requestLogger(c).Error("Error fetching telemetry", "error", err)
+		c.JSON(http.StatusInternalServerError, errorResponse("Internal server error"))
+		return
+	}
+	c.JSON(http.StatusOK, successResponse(map[string]interface{}{
+		"telemetry": telemetry,
+	}))
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// TLS modes of the API server
+const (
+	tlsModeNone       = "none"        // plain HTTP, e.g. behind a reverse proxy
+	tlsModeFile       = "file"        // certificate and key from cert_file/key_file
+	tlsModeSelfSigned = "self_signed" // generated CA and server certificate in tls_dir
+)
+
+// Self-signed certificate lifetimes. The server certificate is renewed on
+// startup once less than selfSignedRenewBefore of its lifetime is left.
+const (
+	selfSignedCAValidity     = 20 * 365 * 24 * time.Hour
+	selfSignedServerValidity = 2 * 365 * 24 * time.Hour
+	selfSignedRenewBefore    = 30 * 24 * time.Hour
+)
+
+// ensureSelfSignedCert makes sure a CA and a server certificate signed by it
+// exist in dir, creating them on first run. The CA is kept across restarts so
+// it only has to be embedded into the firmware once. Returns the paths of the
+// server certificate and key.
+func ensureSelfSignedCert(dir string, hosts []string) (string, string, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", "", fmt.Errorf("failed to create TLS directory: %w", err)
+	}
+	caCertFile := filepath.Join(dir, "ca.pem")
+	caKeyFile := filepath.Join(dir, "ca-key.pem")
+	certFile := filepath.Join(dir, "server.pem")
+	keyFile := filepath.Join(dir, "server-key.pem")
+
+	caCert, caKey, err := loadKeyPair(caCertFile, caKeyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		caCert, caKey, err = createCA(caCertFile, caKeyFile)
+		if err != nil {
+			return "", "", err
+		}
+		slog.Info("Generated self-signed CA", "path", caCertFile)
+	} else if err != nil {
+		return "", "", fmt.Errorf("failed to load CA: %w", err)
+	}
+
+	if len(hosts) == 0 {
+		hosts = defaultCertHosts()
+	}
+	serverCert, _, err := loadKeyPair(certFile, keyFile)
+	if err != nil || !serverCertUsable(serverCert, caCert, hosts) {
+		if err := createServerCert(certFile, keyFile, caCert, caKey, hosts); err != nil {
+			return "", "", err
+		}
+		slog.Info("Generated server certificate", "path", certFile, "hosts", hosts)
+	}
+
+	caPEM, err := os.ReadFile(caCertFile)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read CA certificate: %w", err)
+	}
+	slog.Info("Self-signed CA certificate follows, add it to the firmware cert bundle "+
+		"(arduino/certs: gen_crt_bundle.py -i ca.pem, then filetoarray.py x509_crt_bundle)", "path", caCertFile)
+	fmt.Fprintf(os.Stderr, "%s", caPEM)
+	return certFile, keyFile, nil
+}
+
+// defaultCertHosts returns localhost and the addresses of all local
+// interfaces, which covers frames connecting by IP on the local network.
+func defaultCertHosts() []string {
+	hosts := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append(hosts, hostname)
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		slog.Warn("Failed to list interface addresses", "error", err)
+		return hosts
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			hosts = append(hosts, ipNet.IP.String())
+		}
+	}
+	return hosts
+}
+
+func serverCertUsable(cert *x509.Certificate, caCert *x509.Certificate, hosts []string) bool {
+	if cert.CheckSignatureFrom(caCert) != nil {
+		return false
+	}
+	if time.Now().Add(selfSignedRenewBefore).After(cert.NotAfter) {
+		return false
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			if !slices.ContainsFunc(cert.IPAddresses, ip.Equal) {
+				return false
+			}
+		} else if !slices.Contains(cert.DNSNames, host) {
+			return false
+		}
+	}
+	return true
+}
+
+func loadKeyPair(certFile string, keyFile string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s: unsupported key type", keyFile)
+	}
+	return cert, key, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func createCA(certFile string, keyFile string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate CA key: %w", err)
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "EinkPhotoFrame CA", Organization: []string{"EinkPhotoFrame"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+	if err := writeKeyPair(certFile, keyFile, der, key); err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func createServerCert(certFile string, keyFile string, caCert *x509.Certificate, caKey *ecdsa.PrivateKey, hosts []string) error {
+	if len(hosts) == 0 {
+		return fmt.Errorf("no hosts for the server certificate")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate server key: %w", err)
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hosts[0], Organization: []string{"EinkPhotoFrame"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(selfSignedServerValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return fmt.Errorf("failed to create server certificate: %w", err)
+	}
+	return writeKeyPair(certFile, keyFile, der, key)
+}
+
+func writeKeyPair(certFile string, keyFile string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode private key: %w", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", keyFile, err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", certFile, err)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// hashToken returns the hex encoded SHA-256 of a bearer token. Tokens are
+// random and high entropy, so a fast unsalted hash is sufficient.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// issueDeviceToken creates a new bearer token for the device, replacing any
+// previous one. Only the hash is persisted; the plaintext token is returned
+// once so it can be handed to the device.
+func issueDeviceToken(ctx context.Context, db *gorm.DB, device *Device, reason string) (string, error) {
+	if db == nil {
+		return "", fmt.Errorf("database connection is nil")
+	}
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	expiresAt := now.Add(time.Duration(config().DeviceTokenTTL) * time.Second)
+	// UpdateColumns leaves UpdatedAt alone, which drives the image update timer
+	result := db.Model(device).UpdateColumns(map[string]interface{}{
+		"device_token_hash": hashToken(token),
+		"token_issued_at":   now,
+		"token_expires_at":  expiresAt,
+	})
+	if result.Error != nil {
+		return "", fmt.Errorf("failed to store device token: %w", result.Error)
+	}
+	device.DeviceTokenHash = hashToken(token)
+	device.TokenIssuedAt = now
+	device.TokenExpiresAt = expiresAt
+	loggerFrom(ctx).Info("Issued device token", "device_name", device.DeviceName, "reason", reason, "expires_at", device.TokenExpiresAt)
+	return token, nil
+}
+
+// revokeDeviceToken invalidates the current token of the device, forcing it
+// to register again.
+func revokeDeviceToken(ctx context.Context, db *gorm.DB, device *Device) error {
+	if db == nil {
+		return fmt.Errorf("database connection is nil")
+	}
+	result := db.Model(device).UpdateColumns(map[string]interface{}{
+		"device_token_hash": "",
+		"token_expires_at":  time.Now(),
+	})
+	if result.Error != nil {
+		return fmt.Errorf("failed to revoke device token: %w", result.Error)
+	}
+	device.DeviceTokenHash = ""
+	loggerFrom(ctx).Info("Revoked device token", "device_name", device.DeviceName)
+	return nil
+}
+
+// rotateDeviceToken revokes the token of the device on an admin's request.
+// Whoever got hold of the old token may have the pairing secret and know
+// device_id and name as well, so the approved pairing is dropped too and the
+// device has to be approved by an admin again to register.
+func rotateDeviceToken(ctx context.Context, db *gorm.DB, device *Device) error {
+	if err := revokeDeviceToken(ctx, db, device); err != nil {
+		return err
+	}
+	return forgetDevicePairing(ctx, db, device)
+}
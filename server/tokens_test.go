@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestRotationRevokesPairingSecret(t *testing.T) {
+	useTestConfig(t, nil)
+	db := newTestDB(t)
+	server := newTestServer(t, db)
+	secret, token := pairTestDevice(t, server, "rotate-frame")
+
+	var device Device
+	if err := db.Where("device_id = ?", "rotate-frame").First(&device).Error; err != nil {
+		t.Fatalf("fetch device: %v", err)
+	}
+	if err := rotateDeviceToken(context.Background(), db, &device); err != nil {
+		t.Fatalf("rotateDeviceToken: %v", err)
+	}
+
+	if status, _ := postJSON(t, server, "/dev", token, map[string]interface{}{"action": "get_settings"}); status != http.StatusUnauthorized {
+		t.Errorf("old token: status %d, want 401", status)
+	}
+	// A stolen secret alone no longer gets a token, the frame is paired again
+	status, response := registerDevice(t, server, "rotate-frame", secret)
+	if status != http.StatusAccepted {
+		t.Fatalf("register with the old secret: status %d, want 202: %+v", status, response)
+	}
+	data := responseData(t, response)
+	if data["message"] != "Pairing required" || data["token"] != nil {
+		t.Fatalf("register with the old secret: %v, want a new pairing code", data)
+	}
+	newSecret, _ := data["pairing_secret"].(string)
+	if newSecret == "" || newSecret == secret {
+		t.Fatalf("pairing secret %q, want a new one", newSecret)
+	}
+	// Until approved the new secret is not enough either
+	if status, response := registerDevice(t, server, "rotate-frame", newSecret); status != http.StatusAccepted || responseData(t, response)["message"] != "Pairing pending" {
+		t.Fatalf("register before approval: status %d: %+v", status, response)
+	}
+
+	approvePairing(t, server, data["pairing_code"].(string))
+	newToken := registerWithSecret(t, server, "rotate-frame", newSecret)
+	if status, _ := postJSON(t, server, "/dev", newToken, map[string]interface{}{"action": "get_settings"}); status != http.StatusOK {
+		t.Errorf("new token: status %d, want 200", status)
+	}
+	if err := db.First(&device, device.ID).Error; err != nil {
+		t.Fatalf("fetch device: %v", err)
+	}
+	if device.ReapprovalRequired {
+		t.Error("reapproval_required still set after the new approval")
+	}
+	var audit AuditLog
+	if err := db.Where("action = ? AND target_id = ?", "device_token_reissue", "rotate-frame").First(&audit).Error; err != nil {
+		t.Errorf("no audit entry for the reissued token: %v", err)
+	}
+}
@@ -3,7 +3,7 @@ package main
 import (
 	"fmt"
 	"image"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
@@ -16,7 +16,7 @@ import (
 func loadImage(path string) (image.Image, error) {
 	img, err := imgio.Open(path)
 	if err != nil {
-		log.Println(err)
+		slog.Error("Failed to open image", "path", path, "error", err)
 		return nil, err
 	}
 
@@ -27,7 +27,7 @@ func saveImage( path string,img image.Image) error {
 	// Save the image to the specified path using PNG format
 	encoder := imgio.PNGEncoder()
 	if err := imgio.Save(path, img, encoder); err != nil {
-		log.Println(err)
+		slog.Error("Failed to save image", "path", path, "error", err)
 		return err
 	}
 	return nil
@@ -159,14 +159,24 @@ func generateFileList(folder string,file_ext []string) ([]string, error) {
     return fileList, nil
 }
 func saveBytesToFile(filename string, data []byte) error {
-    file, err := os.Create(filename)
+    // Write to a temporary file and rename it into place, so a device that is
+    // still downloading the previous copy never sees a truncated file
+    file, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
     if err != nil {
         return err
     }
-    defer file.Close()
+    tmpName := file.Name()
 
     _, err = file.Write(data)
+    if closeErr := file.Close(); err == nil {
+        err = closeErr
+    }
     if err != nil {
+        os.Remove(tmpName)
+        return err
+    }
+    if err := os.Rename(tmpName, filename); err != nil {
+        os.Remove(tmpName)
         return err
     }
     return nil
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Shortest sleep returned to a device, so a frame never wakes in a tight loop
+const minWakeInterval = 30 * time.Second
+
+// Deep sleep timers drift, a device waking up to this much before its image
+// is due still gets it instead of going back to sleep for a few seconds
+const wakeEarlyTolerance = 30 * time.Second
+
+// nextImageAt returns when a device is due for its next image
+func nextImageAt(device Device, settings DeviceSetting) time.Time {
+	return device.UpdatedAt.Add(time.Duration(settings.ImgUpdateInterval) * time.Second)
+}
+
+// imageDue reports whether a device asking at now should get a new image:
+// never in a quiet window, while an image is pinned only if it is not shown
+// yet, otherwise once its interval passed or a different schedule window
+// began since its last image.
+func imageDue(device Device, settings DeviceSetting, schedule deviceSchedule, now time.Time) bool {
+	window, start := schedule.windowAt(now)
+	if window != nil && window.Quiet {
+		return false
+	}
+	if pinActive(device, now) {
+		return device.CurrentImage != device.PinnedImage
+	}
+	if device.CurrentImage == "" || device.PinnedImage != "" {
+		// Nothing shown yet, or a pin ran out and the playlist resumes
+		return true
+	}
+	previous, previousStart := schedule.windowAt(device.UpdatedAt)
+	if window != previous || !start.Equal(previousStart) {
+		return true
+	}
+	return !nextImageAt(device, settings).After(now.Add(wakeEarlyTolerance))
+}
+
+// nextWakeAt returns when a device answered at now should wake: when its
+// next image is due, a schedule window starts or ends or its pin runs out,
+// whichever is first, but not before a quiet window is over.
+func nextWakeAt(device Device, settings DeviceSetting, schedule deviceSchedule, now time.Time) time.Time {
+	wake := nextImageAt(device, settings)
+	if boundary, ok := schedule.nextBoundary(now); ok && boundary.Before(wake) {
+		wake = boundary
+	}
+	if device.PinnedImage != "" && device.PinnedUntil != nil && device.PinnedUntil.Before(wake) {
+		wake = *device.PinnedUntil
+	}
+	if wake.Before(now) {
+		wake = now
+	}
+	return schedule.skipQuiet(wake)
+}
+
+// nextWakeSeconds returns how long a device answered at now should sleep
+func nextWakeSeconds(device Device, settings DeviceSetting, schedule deviceSchedule, now time.Time) int {
+	wait := max(nextWakeAt(device, settings, schedule, now).Sub(now), minWakeInterval)
+	return int(math.Ceil(wait.Seconds()))
+}
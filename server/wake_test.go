@@ -0,0 +1,148 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestImageDue(t *testing.T) {
+	berlin := testLocation(t, "Europe/Berlin")
+	settings := DeviceSetting{ImgUpdateInterval: 600}
+	daily := DeviceSetting{ImgUpdateInterval: 86400}
+	quietNight := testSchedule(t, berlin, DeviceSchedule{Start: "22:00", End: "06:00", Quiet: true})
+	mornings := testSchedule(t, berlin, DeviceSchedule{Start: "09:00", End: "12:00", PlaylistID: new(uint)})
+	nights := testSchedule(t, berlin, DeviceSchedule{Start: "22:00", End: "06:00", PlaylistID: new(uint)})
+	noWindows := testSchedule(t, berlin)
+	shown := func(value string) Device {
+		return Device{CurrentImage: "a", UpdatedAt: at(t, berlin, value)}
+	}
+	pinned := func(value string, image string, until time.Time) Device {
+		device := shown(value)
+		device.PinnedImage = image
+		device.PinnedUntil = &until
+		return device
+	}
+	tests := []struct {
+		name     string
+		device   Device
+		settings DeviceSetting
+		schedule deviceSchedule
+		now      time.Time
+		want     bool
+	}{
+		{"interval not passed", shown("2026-06-05 12:00"), settings, noWindows, at(t, berlin, "2026-06-05 12:05"), false},
+		{"interval passed", shown("2026-06-05 12:00"), settings, noWindows, at(t, berlin, "2026-06-05 12:10"), true},
+		{"woke slightly early", shown("2026-06-05 12:00"), settings, noWindows, at(t, berlin, "2026-06-05 12:00").Add(580 * time.Second), true},
+		{"nothing shown", Device{UpdatedAt: at(t, berlin, "2026-06-05 12:00")}, settings, noWindows, at(t, berlin, "2026-06-05 12:01"), true},
+		{"quiet window", shown("2026-06-05 12:00"), settings, quietNight, at(t, berlin, "2026-06-05 23:00"), false},
+		{"quiet after midnight", Device{UpdatedAt: at(t, berlin, "2026-06-05 12:00")}, settings, quietNight, at(t, berlin, "2026-06-06 02:00"), false},
+		{"pin not shown", pinned("2026-06-05 12:00", "b", at(t, berlin, "2026-06-05 18:00")), settings, noWindows, at(t, berlin, "2026-06-05 12:01"), true},
+		{"pin shown", pinned("2026-06-05 12:00", "a", at(t, berlin, "2026-06-05 18:00")), settings, noWindows, at(t, berlin, "2026-06-05 14:00"), false},
+		{"pin ran out", pinned("2026-06-05 12:00", "a", at(t, berlin, "2026-06-05 12:02")), settings, noWindows, at(t, berlin, "2026-06-05 12:03"), true},
+		{"window began", shown("2026-06-05 08:55"), settings, mornings, at(t, berlin, "2026-06-05 09:01"), true},
+		{"same window", shown("2026-06-05 09:01"), settings, mornings, at(t, berlin, "2026-06-05 09:05"), false},
+		{"window ended", shown("2026-06-05 11:58"), settings, mornings, at(t, berlin, "2026-06-05 12:01"), true},
+		{"same window across midnight", shown("2026-06-05 23:00"), daily, nights, at(t, berlin, "2026-06-06 01:00"), false},
+		{"next night of the window", shown("2026-06-05 05:00"), daily, nights, at(t, berlin, "2026-06-05 23:00"), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := imageDue(test.device, test.settings, test.schedule, test.now); got != test.want {
+				t.Errorf("imageDue = %t, want %t", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNextWake(t *testing.T) {
+	berlin := testLocation(t, "Europe/Berlin")
+	newYork := testLocation(t, "America/New_York")
+	settings := DeviceSetting{ImgUpdateInterval: 600}
+	noWindows := testSchedule(t, berlin)
+	shown := func(location *time.Location, value string) Device {
+		return Device{CurrentImage: "a", UpdatedAt: at(t, location, value)}
+	}
+	until := at(t, berlin, "2026-06-05 12:04")
+	pinned := shown(berlin, "2026-06-05 12:00")
+	pinned.PinnedImage = "a"
+	pinned.PinnedUntil = &until
+	tests := []struct {
+		name        string
+		device      Device
+		schedule    deviceSchedule
+		now         time.Time
+		wantWake    time.Time
+		wantSeconds int
+	}{
+		{
+			name:        "next image",
+			device:      shown(berlin, "2026-06-05 12:00"),
+			schedule:    noWindows,
+			now:         at(t, berlin, "2026-06-05 12:01"),
+			wantWake:    at(t, berlin, "2026-06-05 12:10"),
+			wantSeconds: 540,
+		},
+		{
+			name:        "window starts first",
+			device:      shown(berlin, "2026-06-05 08:55"),
+			schedule:    testSchedule(t, berlin, DeviceSchedule{Start: "09:00", End: "12:00", PlaylistID: new(uint)}),
+			now:         at(t, berlin, "2026-06-05 08:56"),
+			wantWake:    at(t, berlin, "2026-06-05 09:00"),
+			wantSeconds: 240,
+		},
+		{
+			name:        "pin runs out first",
+			device:      pinned,
+			schedule:    noWindows,
+			now:         at(t, berlin, "2026-06-05 12:01"),
+			wantWake:    until,
+			wantSeconds: 180,
+		},
+		{
+			name:        "overdue",
+			device:      shown(berlin, "2026-06-05 11:00"),
+			schedule:    noWindows,
+			now:         at(t, berlin, "2026-06-05 12:00"),
+			wantWake:    at(t, berlin, "2026-06-05 12:00"),
+			wantSeconds: 30,
+		},
+		{
+			name:        "due within the minimum",
+			device:      shown(berlin, "2026-06-05 12:00"),
+			schedule:    noWindows,
+			now:         at(t, berlin, "2026-06-05 12:00").Add(590 * time.Second),
+			wantWake:    at(t, berlin, "2026-06-05 12:10"),
+			wantSeconds: 30,
+		},
+		{
+			name:   "back to back quiet windows",
+			device: shown(berlin, "2026-06-05 21:55"),
+			schedule: testSchedule(t, berlin,
+				DeviceSchedule{Start: "22:00", End: "06:00", Quiet: true},
+				DeviceSchedule{Start: "06:00", End: "07:00", Quiet: true},
+			),
+			now:         at(t, berlin, "2026-06-05 21:56"),
+			wantWake:    at(t, berlin, "2026-06-06 07:00"),
+			wantSeconds: 9*3600 + 4*60,
+		},
+		{
+			// 00:56 EST to 04:00 EDT is 2h4m
+			name:        "quiet over spring forward",
+			device:      shown(newYork, "2026-03-08 00:55"),
+			schedule:    testSchedule(t, newYork, DeviceSchedule{Start: "01:00", End: "04:00", Quiet: true}),
+			now:         at(t, newYork, "2026-03-08 00:56"),
+			wantWake:    at(t, newYork, "2026-03-08 04:00"),
+			wantSeconds: 2*3600 + 4*60,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := nextWakeAt(test.device, settings, test.schedule, test.now); !got.Equal(test.wantWake) {
+				t.Errorf("nextWakeAt = %v, want %v", got, test.wantWake)
+			}
+			if got := nextWakeSeconds(test.device, settings, test.schedule, test.now); got != test.wantSeconds {
+				t.Errorf("nextWakeSeconds = %d, want %d", got, test.wantSeconds)
+			}
+		})
+	}
+}
@@ -0,0 +1,336 @@
+// Admin dashboard. All data comes from the admin API, the Authorization
+// header is kept in sessionStorage until the tab is closed or logged out.
+"use strict";
+
+const libraryPageSize = 48;
+let libraryOffset = 0;
+let renderOptions = null;
+const objectURLs = [];
+
+function $(id) {
+  return document.getElementById(id);
+}
+
+function showMessage(text, isError) {
+  const message = $("message");
+  message.textContent = text;
+  message.className = isError ? "error" : "";
+  message.hidden = !text;
+}
+
+function authHeader() {
+  return sessionStorage.getItem("authorization");
+}
+
+async function api(path, options = {}) {
+  const headers = Object.assign({}, options.headers, { Authorization: authHeader() });
+  const response = await fetch(path, Object.assign({}, options, { headers }));
+  if (response.status === 401) {
+    logout();
+    throw new Error("Please log in");
+  }
+  return response;
+}
+
+async function apiJSON(path, options = {}) {
+  const response = await api(path, options);
+  const body = await response.json();
+  if (!body.success) {
+    throw new Error(body.error || response.statusText);
+  }
+  return body.data;
+}
+
+function postJSON(path, data) {
+  return apiJSON(path, {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify(data),
+  });
+}
+
+// Images need the Authorization header, so they are fetched as blobs.
+// Returns false if the image could not be loaded.
+async function loadImage(img, path) {
+  try {
+    const response = await api(path);
+    if (!response.ok) {
+      return false;
+    }
+    const url = URL.createObjectURL(await response.blob());
+    objectURLs.push(url);
+    img.src = url;
+    return true;
+  } catch (err) {
+    // Leave the image empty, the page shows the error of the list request
+    return false;
+  }
+}
+
+function loadThumbnail(img, uuid) {
+  return loadImage(img, "/admin/image_thumbnail?uuid=" + encodeURIComponent(uuid));
+}
+
+// Shows the reconstructed screen of a device in panel colors, or a thumbnail
+// of its current image if the payload is no longer cached
+async function loadScreen(img, device) {
+  const path = "/admin/devices/" + encodeURIComponent(device.DeviceID) + "/screen.png?display=7Eink";
+  if (!(await loadImage(img, path))) {
+    await loadThumbnail(img, device.CurrentImage);
+  }
+}
+
+function releaseThumbnails() {
+  while (objectURLs.length > 0) {
+    URL.revokeObjectURL(objectURLs.pop());
+  }
+}
+
+function formatTime(value) {
+  if (!value) {
+    return "never";
+  }
+  return new Date(value).toLocaleString();
+}
+
+function cell(row, content) {
+  const td = document.createElement("td");
+  if (content instanceof Node) {
+    td.appendChild(content);
+  } else {
+    td.textContent = content;
+  }
+  row.appendChild(td);
+  return td;
+}
+
+async function showDevices() {
+  const data = await apiJSON("/admin/devices");
+  const tbody = $("devices");
+  tbody.replaceChildren();
+  for (const entry of data.devices) {
+    const device = entry.device;
+    const row = document.createElement("tr");
+
+    if (device.CurrentImage) {
+      const img = document.createElement("img");
+      img.className = "thumb";
+      img.alt = device.CurrentImage;
+      cell(row, img);
+      loadScreen(img, device);
+    } else {
+      cell(row, "none");
+    }
+    cell(row, entry.group ? device.DeviceName + " (" + entry.group + ")" : device.DeviceName);
+    cell(row, device.DeviceID);
+    cell(row, formatTime(entry.last_seen));
+    const battery = cell(row, entry.battery_level == null ? "unknown" : entry.battery_level + "%");
+    if (entry.battery_level != null && entry.battery_level < 20) {
+      battery.className = "battery-low";
+    }
+
+    const edit = document.createElement("button");
+    edit.type = "button";
+    edit.textContent = "Edit";
+    edit.disabled = !entry.settings;
+    edit.addEventListener("click", () => editSettings(device, entry.settings));
+    cell(row, edit);
+    tbody.appendChild(row);
+  }
+  if (data.devices.length === 0) {
+    const row = document.createElement("tr");
+    cell(row, "No devices yet").colSpan = 6;
+    tbody.appendChild(row);
+  }
+}
+
+async function showLibrary() {
+  const data = await apiJSON("/admin/images?limit=" + libraryPageSize + "&offset=" + libraryOffset);
+  $("library-count").textContent = "(" + data.total + " images)";
+  const grid = $("library");
+  grid.replaceChildren();
+  for (const image of data.images) {
+    const figure = document.createElement("figure");
+    const img = document.createElement("img");
+    img.alt = image.name;
+    const caption = document.createElement("figcaption");
+    caption.textContent = image.name;
+    caption.title = image.uuid;
+    figure.append(img, caption);
+    grid.appendChild(figure);
+    loadThumbnail(img, image.uuid);
+  }
+  $("library-prev").disabled = libraryOffset === 0;
+  $("library-next").disabled = libraryOffset + libraryPageSize >= data.total;
+}
+
+function fillSelect(select, values, current) {
+  select.replaceChildren();
+  for (const value of values) {
+    const option = document.createElement("option");
+    option.value = value;
+    option.textContent = value;
+    option.selected = value === current;
+    select.appendChild(option);
+  }
+}
+
+async function editSettings(device, settings) {
+  if (!renderOptions) {
+    renderOptions = await apiJSON("/admin/render_options");
+  }
+  const form = $("settings-form");
+  $("settings-device").textContent = device.DeviceName;
+  form.device_id.value = device.DeviceID;
+  form.img_update_interval.value = settings.ImgUpdateInterval;
+  form.width.value = settings.Width;
+  form.height.value = settings.Height;
+  form.rotation.value = settings.Rotation;
+  form.dither_strength.value = settings.DitherStrength;
+  fillSelect(form.palette, renderOptions.palettes, settings.Palette);
+  fillSelect(form.dither_algorithm,
+    renderOptions.error_dither_algorithms.concat(renderOptions.ordered_dither_algorithms),
+    settings.DitherAlgorithm);
+  fillSelect(form.resize_method, renderOptions.resize_methods, settings.ResizeMethod);
+  fillSelect(form.overlay_corner, renderOptions.overlay_corners, settings.OverlayCorner);
+  fillSelect(form.overlay_battery, renderOptions.overlay_battery_modes, settings.OverlayBattery);
+  form.overlay_time.checked = settings.OverlayTime;
+  form.overlay_text.value = settings.OverlayText;
+  const { playlists } = await apiJSON("/admin/playlists");
+  form.playlist_id.replaceChildren(new Option("Whole library", "0"));
+  for (const playlist of playlists) {
+    form.playlist_id.add(new Option(playlist.name, playlist.id, false, playlist.id === settings.PlaylistID));
+  }
+  form.timezone.value = settings.Timezone;
+  form.dataset.image = device.CurrentImage || "";
+  $("settings-preview-button").disabled = !device.CurrentImage;
+  $("settings-preview-box").hidden = true;
+  $("settings-dialog").showModal();
+}
+
+// Renders the current image of the device with the settings in the form
+async function previewSettings() {
+  const form = $("settings-form");
+  const params = new URLSearchParams({
+    uuid: form.dataset.image,
+    palette: form.palette.value,
+    algorithm: form.dither_algorithm.value,
+    strength: form.dither_strength.value,
+    width: form.width.value,
+    height: form.height.value,
+    resize_method: form.resize_method.value,
+  });
+  const button = $("settings-preview-button");
+  button.disabled = true;
+  button.textContent = "Rendering...";
+  try {
+    const response = await api("/admin/preview?" + params);
+    if (!response.ok) {
+      const body = await response.json();
+      throw new Error(body.error || response.statusText);
+    }
+    const img = $("settings-preview");
+    if (img.src) {
+      URL.revokeObjectURL(img.src);
+    }
+    img.src = URL.createObjectURL(await response.blob());
+    $("settings-preview-box").hidden = false;
+  } catch (err) {
+    showMessage("Preview failed: " + err.message, true);
+  } finally {
+    button.disabled = false;
+    button.textContent = "Preview";
+  }
+}
+
+async function saveSettings() {
+  const form = $("settings-form");
+  try {
+    await postJSON("/admin/device_settings", {
+      device_id: form.device_id.value,
+      img_update_interval: Number(form.img_update_interval.value),
+      width: Number(form.width.value),
+      height: Number(form.height.value),
+      rotation: Number(form.rotation.value),
+      palette: form.palette.value,
+      dither_algorithm: form.dither_algorithm.value,
+      dither_strength: Number(form.dither_strength.value),
+      resize_method: form.resize_method.value,
+      overlay_corner: form.overlay_corner.value,
+      overlay_battery: form.overlay_battery.value,
+      overlay_time: form.overlay_time.checked,
+      overlay_text: form.overlay_text.value,
+      playlist_id: Number(form.playlist_id.value),
+      timezone: form.timezone.value,
+    });
+    showMessage("Settings saved, the frame applies them on its next image update", false);
+    await showDevices();
+  } catch (err) {
+    showMessage("Saving settings failed: " + err.message, true);
+  }
+}
+
+async function route() {
+  releaseThumbnails();
+  const loggedIn = Boolean(authHeader());
+  const view = loggedIn ? (location.hash.slice(1) || "devices") : "login";
+  $("nav").hidden = !loggedIn;
+  for (const name of ["login", "devices", "library"]) {
+    $(name + "-view").hidden = name !== view;
+  }
+  try {
+    if (view === "devices") {
+      await showDevices();
+    } else if (view === "library") {
+      await showLibrary();
+    }
+  } catch (err) {
+    showMessage(err.message, true);
+  }
+}
+
+function logout() {
+  sessionStorage.removeItem("authorization");
+  renderOptions = null;
+  route();
+}
+
+$("login-form").addEventListener("submit", async (event) => {
+  event.preventDefault();
+  const form = event.target;
+  let header;
+  if (form.api_key.value) {
+    header = "Bearer " + form.api_key.value;
+  } else {
+    header = "Basic " + btoa(form.username.value + ":" + form.password.value);
+  }
+  sessionStorage.setItem("authorization", header);
+  form.reset();
+  showMessage("", false);
+  await route();
+});
+
+$("settings-dialog").addEventListener("close", () => {
+  if ($("settings-dialog").returnValue === "save") {
+    saveSettings();
+  }
+});
+
+$("settings-preview-button").addEventListener("click", previewSettings);
+
+$("library-prev").addEventListener("click", () => {
+  libraryOffset = Math.max(0, libraryOffset - libraryPageSize);
+  route();
+});
+
+$("library-next").addEventListener("click", () => {
+  libraryOffset += libraryPageSize;
+  route();
+});
+
+$("logout").addEventListener("click", logout);
+window.addEventListener("hashchange", () => {
+  showMessage("", false);
+  route();
+});
+route();
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The admin dashboard is a static page using the admin API, credentials are
+// entered in the browser and sent with every API request
+//
+//go:embed web
+var webFiles embed.FS
+
+// registerWebUI serves the dashboard under /ui/
+func registerWebUI(router *gin.Engine) {
+	files, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err)
+	}
+	fileServer := http.StripPrefix("/ui", http.FileServer(http.FS(files)))
+	router.GET("/ui/*filepath", func(c *gin.Context) {
+		c.Header("Cache-Control", "no-cache")
+		fileServer.ServeHTTP(c.Writer, c.Request)
+	})
+	router.GET("/", func(c *gin.Context) {
+		c.Redirect(http.StatusFound, "/ui/")
+	})
+}